@@ -26,7 +26,9 @@ import (
 const (
 	FLOW_REF = "github.com/TIBCOSoftware/flogo-contrib/action/flow"
 
-	ENV_FLOW_RECORD = "FLOGO_FLOW_RECORD"
+	ENV_FLOW_RECORD      = "FLOGO_FLOW_RECORD"
+	ENV_FLOW_CHECKPOINT  = "FLOGO_FLOW_CHECKPOINT"
+	ENV_FLOW_CONCURRENCY = "FLOGO_FLOW_CONCURRENCY"
 )
 
 type FlowAction struct {
@@ -50,6 +52,7 @@ type ActionData struct {
 var ep ExtensionProvider
 var idGenerator *util.Generator
 var record bool
+var concurrency int
 var manager *support.FlowManager
 
 //todo expose and support this properly
@@ -85,10 +88,27 @@ func (ff *ActionFactory) Init() error {
 			record = true
 		} else {
 			ep = NewDefaultExtensionProvider()
-			record = recordFlows()
+			record = envFlag(ENV_FLOW_RECORD)
+
+			if record {
+				if recorder, ok := ep.GetStateRecorder().(util.Service); ok {
+					util.GetDefaultServiceManager().RegisterService(recorder)
+				}
+			}
+		}
+	}
+
+	if envFlag(ENV_FLOW_CHECKPOINT) {
+		if provider, ok := ep.(CheckpointProvider); ok {
+			checkpointer = provider.GetCheckpointer()
+			util.GetDefaultServiceManager().RegisterService(NewCheckpointService(checkpointer))
+		} else {
+			logger.Warn("Flow checkpoints are not supported by the extension provider, instances will not be resumed")
 		}
 	}
 
+	concurrency = flowConcurrency()
+
 	definition.SetMapperFactory(ep.GetMapperFactory())
 	definition.SetLinkExprManagerFactory(ep.GetLinkExprManagerFactory())
 
@@ -103,15 +123,29 @@ func (ff *ActionFactory) Init() error {
 	return nil
 }
 
-func recordFlows() bool {
-	recordFlows := os.Getenv(ENV_FLOW_RECORD)
-	if len(recordFlows) == 0 {
+func envFlag(name string) bool {
+	flag := os.Getenv(name)
+	if len(flag) == 0 {
 		return false
 	}
-	b, _ := strconv.ParseBool(recordFlows)
+	b, _ := strconv.ParseBool(flag)
 	return b
 }
 
+// flowConcurrency gets how many tasks of independent branches are evaluated in parallel
+func flowConcurrency() int {
+	flowConcurrency := os.Getenv(ENV_FLOW_CONCURRENCY)
+	if len(flowConcurrency) == 0 {
+		return 0
+	}
+	n, err := strconv.Atoi(flowConcurrency)
+	if err != nil || n < 0 {
+		logger.Warnf("Invalid %s '%s', tasks are evaluated one at a time", ENV_FLOW_CONCURRENCY, flowConcurrency)
+		return 0
+	}
+	return n
+}
+
 func GetFlowManager() *support.FlowManager {
 	return manager
 }
@@ -250,6 +284,13 @@ func (fa *FlowAction) Run(context context.Context, inputs map[string]*data.Attri
 	case instance.OpResume:
 		if initialState != nil {
 			inst = initialState
+			if inst.FlowDefinition() == nil {
+				// restored from its serialized state, bind it to its flow keeping its ID
+				err := inst.Restart(inst.ID(), manager)
+				if err != nil {
+					return err
+				}
+			}
 			logger.Debug("Resuming Flow Instance: ", inst.ID())
 		} else {
 			return errors.New("unable to resume instance, initial state not provided")
@@ -277,6 +318,13 @@ func (fa *FlowAction) Run(context context.Context, inputs map[string]*data.Attri
 		}
 	}
 
+	inst.SetConcurrency(concurrency)
+
+	if deadline, ok := context.Deadline(); ok {
+		// only the deadline applies, the trigger may cancel the context once the flow is started
+		inst.SetDeadline(deadline)
+	}
+
 	if execOptions != nil {
 		logger.Debugf("Applying Exec Options to instance: %s", inst.ID())
 		instance.ApplyExecOptions(inst, execOptions)
@@ -322,6 +370,13 @@ func (fa *FlowAction) Run(context context.Context, inputs map[string]*data.Attri
 		}
 
 		for hasWork && inst.Status() < model.FlowStatusCompleted && stepCount < maxStepCount {
+			if due, ok := inst.NextDue(); ok {
+				// only scheduled tasks are left, resume the steps when the next one is due
+				wait := time.Until(due)
+				logger.Debugf("Waiting %s for the next scheduled task", wait)
+				<-time.After(wait)
+			}
+
 			stepCount++
 			logger.Debugf("Step: %d", stepCount)
 			hasWork = inst.DoStep()
@@ -330,6 +385,10 @@ func (fa *FlowAction) Run(context context.Context, inputs map[string]*data.Attri
 				ep.GetStateRecorder().RecordSnapshot(inst)
 				ep.GetStateRecorder().RecordStep(inst)
 			}
+
+			if checkpointer != nil {
+				checkpoint(inst)
+			}
 		}
 
 		if inst.Status() == model.FlowStatusCompleted {
@@ -0,0 +1,114 @@
+package flow
+
+import (
+	"context"
+
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/instance"
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/model"
+	"github.com/TIBCOSoftware/flogo-lib/core/data"
+	"github.com/TIBCOSoftware/flogo-lib/logger"
+	"github.com/TIBCOSoftware/flogo-lib/util"
+)
+
+const (
+	ServiceFlowCheckpoints = "flowCheckpoints"
+)
+
+// CheckpointProvider is implemented by the ExtensionProviders that can checkpoint
+// running Flow Instances
+type CheckpointProvider interface {
+	GetCheckpointer() instance.Checkpointer
+}
+
+var checkpointer instance.Checkpointer
+
+// checkpoint saves the state of a running instance after a step, or releases it
+// once the instance is done
+func checkpoint(inst *instance.IndependentInstance) {
+
+	var err error
+	if inst.Status() < model.FlowStatusCompleted {
+		err = checkpointer.Checkpoint(inst)
+	} else {
+		err = checkpointer.Release(inst.ID())
+	}
+
+	if err != nil {
+		logger.Errorf("Unable to checkpoint flow instance [%s]: %s", inst.ID(), err.Error())
+	}
+}
+
+// CheckpointService resumes the unfinished Flow Instances of the checkpoint store
+// when the engine starts
+type CheckpointService struct {
+	checkpointer instance.Checkpointer
+}
+
+// NewCheckpointService creates a new CheckpointService
+func NewCheckpointService(checkpointer instance.Checkpointer) *CheckpointService {
+	return &CheckpointService{checkpointer: checkpointer}
+}
+
+func (cs *CheckpointService) Name() string {
+	return ServiceFlowCheckpoints
+}
+
+func (cs *CheckpointService) Enabled() bool {
+	return true
+}
+
+// Start implements util.Managed.Start()
+func (cs *CheckpointService) Start() error {
+
+	if managed, ok := cs.checkpointer.(util.Managed); ok {
+		if err := managed.Start(); err != nil {
+			return err
+		}
+	}
+
+	instances, err := cs.checkpointer.Unfinished()
+	if err != nil {
+		return err
+	}
+
+	for _, inst := range instances {
+		logger.Infof("Resuming flow instance [%s] from checkpoint", inst.ID())
+
+		ro := &instance.RunOptions{Op: instance.OpResume, FlowURI: inst.FlowURI(), InitialState: inst}
+		attr, _ := data.NewAttribute("_run_options", data.TypeAny, ro)
+		inputs := map[string]*data.Attribute{attr.Name(): attr}
+
+		fa := &FlowAction{flowURI: inst.FlowURI()}
+		if err := fa.Run(context.Background(), inputs, &resumedResultHandler{id: inst.ID()}); err != nil {
+			logger.Errorf("Unable to resume flow instance [%s]: %s", inst.ID(), err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Stop implements util.Managed.Stop()
+func (cs *CheckpointService) Stop() error {
+
+	if managed, ok := cs.checkpointer.(util.Managed); ok {
+		return managed.Stop()
+	}
+	return nil
+}
+
+// resumedResultHandler handles the results of a resumed instance. The trigger that
+// started it is gone, so the results are only logged
+type resumedResultHandler struct {
+	id string
+}
+
+func (rh *resumedResultHandler) HandleResult(results map[string]*data.Attribute, err error) {
+	if err != nil {
+		logger.Errorf("Resumed flow instance [%s] failed: %s", rh.id, err.Error())
+		return
+	}
+	logger.Debugf("Resumed flow instance [%s] results: %v", rh.id, results)
+}
+
+func (rh *resumedResultHandler) Done() {
+}
@@ -114,6 +114,8 @@ type ActivityConfig struct {
 
 	inputMapper  data.Mapper
 	outputMapper data.Mapper
+	// outputMappings is set when the output mapper comes from the mappings of the task, not the default one
+	outputMappings bool
 }
 
 // GetSetting gets the specified setting
@@ -165,6 +167,11 @@ func (ac *ActivityConfig) OutputMapper() data.Mapper {
 	return ac.outputMapper
 }
 
+// HasOutputMappings checks if the task maps the outputs of its activity, usually into the flow attributes
+func (ac *ActivityConfig) HasOutputMappings() bool {
+	return ac.outputMappings
+}
+
 func (ac *ActivityConfig) Ref() string {
 	return ac.Activity.Metadata().ID
 }
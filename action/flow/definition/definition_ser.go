@@ -277,6 +277,7 @@ func createActivityConfig(task *Task, rep *ActivityConfigRep) (*ActivityConfig,
 		}
 		if rep.Mappings.Output != nil {
 			activityCfg.outputMapper = GetMapperFactory().NewActivityOutputMapper(task, &data.MapperDef{Mappings: rep.Mappings.Output})
+			activityCfg.outputMappings = true
 		} else {
 			activityCfg.outputMapper = GetMapperFactory().GetDefaultActivityOutputMapper(task)
 		}
@@ -540,6 +541,7 @@ func createActivityConfigFromOld(task *Task, rep *TaskRepOld) (*ActivityConfig,
 		}
 		if rep.Mappings.Output != nil {
 			activityCfg.outputMapper = GetMapperFactory().NewActivityOutputMapper(task, &data.MapperDef{Mappings: rep.Mappings.Output})
+			activityCfg.outputMappings = true
 		} else {
 			activityCfg.outputMapper = GetMapperFactory().GetDefaultActivityOutputMapper(task)
 		}
@@ -553,6 +555,7 @@ func createActivityConfigFromOld(task *Task, rep *TaskRepOld) (*ActivityConfig,
 		}
 		if rep.Mappings.Output != nil {
 			activityCfg.outputMapper = GetMapperFactory().NewActivityOutputMapper(task, &data.MapperDef{Mappings: rep.Mappings.Output})
+			activityCfg.outputMappings = true
 		}
 	} else {
 		//temporary support for old configuration
@@ -562,6 +565,7 @@ func createActivityConfigFromOld(task *Task, rep *TaskRepOld) (*ActivityConfig,
 		}
 		if rep.OutputMappings != nil {
 			activityCfg.outputMapper = GetMapperFactory().NewActivityOutputMapper(task, &data.MapperDef{Mappings: rep.OutputMappings})
+			activityCfg.outputMappings = true
 		}
 	}
 
@@ -1,12 +1,23 @@
 package flow
 
 import (
+	"os"
+
 	"github.com/TIBCOSoftware/flogo-contrib/action/flow/definition"
 	"github.com/TIBCOSoftware/flogo-contrib/action/flow/instance"
 	"github.com/TIBCOSoftware/flogo-contrib/action/flow/model"
 	"github.com/TIBCOSoftware/flogo-contrib/action/flow/model/simple"
 	"github.com/TIBCOSoftware/flogo-contrib/action/flow/support"
 	"github.com/TIBCOSoftware/flogo-contrib/action/flow/tester"
+	"github.com/TIBCOSoftware/flogo-lib/util"
+)
+
+const (
+	ENV_FLOW_RECORD_PATH          = "FLOGO_FLOW_RECORD_PATH"
+	ENV_FLOW_RECORD_MAX_INSTANCES = "FLOGO_FLOW_RECORD_MAX_INSTANCES"
+	ENV_FLOW_RECORD_MAX_AGE       = "FLOGO_FLOW_RECORD_MAX_AGE"
+	ENV_FLOW_RECORD_FAILED_ONLY   = "FLOGO_FLOW_RECORD_FAILED_ONLY"
+	ENV_FLOW_CHECKPOINT_PATH      = "FLOGO_FLOW_CHECKPOINT_PATH"
 )
 
 // Provides the different extension points to the FlowBehavior Action
@@ -22,8 +33,10 @@ type ExtensionProvider interface {
 
 //ExtensionProvider is the extension provider for the flow action
 type DefaultExtensionProvider struct {
-	flowProvider definition.Provider
-	flowModel    *model.FlowModel
+	flowProvider  definition.Provider
+	flowModel     *model.FlowModel
+	stateRecorder instance.StateRecorder
+	checkpointer  instance.Checkpointer
 }
 
 func NewDefaultExtensionProvider() *DefaultExtensionProvider {
@@ -48,8 +61,38 @@ func (fp *DefaultExtensionProvider) GetDefaultFlowModel() *model.FlowModel {
 	return fp.flowModel
 }
 
+// GetStateRecorder returns a local recorder, so flows can be recorded without a
+// flow state service. It is configured with the FLOGO_FLOW_RECORD_* variables
 func (fp *DefaultExtensionProvider) GetStateRecorder() instance.StateRecorder {
-	return nil
+
+	if fp.stateRecorder == nil {
+		config := &util.ServiceConfig{Enabled: true}
+
+		settings := map[string]string{
+			"path":         os.Getenv(ENV_FLOW_RECORD_PATH),
+			"maxInstances": os.Getenv(ENV_FLOW_RECORD_MAX_INSTANCES),
+			"maxAge":       os.Getenv(ENV_FLOW_RECORD_MAX_AGE),
+			"failedOnly":   os.Getenv(ENV_FLOW_RECORD_FAILED_ONLY),
+		}
+		config.Settings = settings
+
+		fp.stateRecorder = instance.NewLocalStateRecorder(config)
+	}
+
+	return fp.stateRecorder
+}
+
+// GetCheckpointer returns a local checkpointer, configured with FLOGO_FLOW_CHECKPOINT_PATH
+func (fp *DefaultExtensionProvider) GetCheckpointer() instance.Checkpointer {
+
+	if fp.checkpointer == nil {
+		config := &util.ServiceConfig{Enabled: true}
+		config.Settings = map[string]string{"path": os.Getenv(ENV_FLOW_CHECKPOINT_PATH)}
+
+		fp.checkpointer = instance.NewLocalCheckpointer(config)
+	}
+
+	return fp.checkpointer
 }
 
 func (fp *DefaultExtensionProvider) GetMapperFactory() definition.MapperFactory {
@@ -0,0 +1,180 @@
+package instance
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/model"
+	"github.com/TIBCOSoftware/flogo-lib/logger"
+	"github.com/TIBCOSoftware/flogo-lib/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// LocalCheckpointerDefaultPath is the store file used when the 'path' setting is not set
+	LocalCheckpointerDefaultPath = "flowcheckpoints.db"
+)
+
+var bucketCheckpoints = []byte("checkpoints")
+
+// Checkpointer persists the state of running Flow Instances after each step, so
+// they can be resumed after the engine restarts
+type Checkpointer interface {
+	// Checkpoint saves the state of a running instance, replacing its previous checkpoint
+	Checkpoint(instance *IndependentInstance) error
+
+	// Release removes the checkpoint of an instance that is done
+	Release(instanceID string) error
+
+	// Unfinished gets the checkpointed instances that can be resumed. They
+	// still have to be bound to their flow (see IndependentInstance.Restart)
+	Unfinished() ([]*IndependentInstance, error)
+}
+
+// LocalCheckpointer is a Checkpointer that keeps the last state of each running
+// Flow Instance in a local BoltDB file.
+//
+// Settings:
+//
+//	path: store file (default flowcheckpoints.db)
+type LocalCheckpointer struct {
+	path string
+
+	db   *bolt.DB
+	lock sync.Mutex
+}
+
+// NewLocalCheckpointer creates a new LocalCheckpointer
+func NewLocalCheckpointer(config *util.ServiceConfig) *LocalCheckpointer {
+
+	checkpointer := &LocalCheckpointer{path: config.Settings["path"]}
+	if checkpointer.path == "" {
+		checkpointer.path = LocalCheckpointerDefaultPath
+	}
+
+	logger.Debugf("LocalCheckpointer: Checkpoint Store = %s", checkpointer.path)
+
+	return checkpointer
+}
+
+// Start implements util.Managed.Start()
+func (cp *LocalCheckpointer) Start() error {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	return cp.openLocked()
+}
+
+// Stop implements util.Managed.Stop()
+func (cp *LocalCheckpointer) Stop() error {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	if cp.db == nil {
+		return nil
+	}
+	err := cp.db.Close()
+	cp.db = nil
+	return err
+}
+
+// openLocked opens the store, when not open yet
+func (cp *LocalCheckpointer) openLocked() error {
+	if cp.db != nil {
+		return nil
+	}
+	db, err := bolt.Open(cp.path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("LocalCheckpointer: unable to open store '%s': %s", cp.path, err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketCheckpoints)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("LocalCheckpointer: unable to initialize store '%s': %s", cp.path, err.Error())
+	}
+	cp.db = db
+	return nil
+}
+
+// update runs a write transaction, opening the store if needed
+func (cp *LocalCheckpointer) update(fn func(checkpoints *bolt.Bucket) error) error {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	if err := cp.openLocked(); err != nil {
+		return err
+	}
+	return cp.db.Update(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(bucketCheckpoints))
+	})
+}
+
+// Checkpoint implements instance.Checkpointer.Checkpoint
+func (cp *LocalCheckpointer) Checkpoint(instance *IndependentInstance) error {
+
+	state, err := json.Marshal(instance)
+	if err != nil {
+		return fmt.Errorf("LocalCheckpointer: unable to serialize instance '%s': %s", instance.ID(), err.Error())
+	}
+
+	return cp.update(func(checkpoints *bolt.Bucket) error {
+		return checkpoints.Put([]byte(instance.ID()), state)
+	})
+}
+
+// Release implements instance.Checkpointer.Release
+func (cp *LocalCheckpointer) Release(instanceID string) error {
+
+	return cp.update(func(checkpoints *bolt.Bucket) error {
+		return checkpoints.Delete([]byte(instanceID))
+	})
+}
+
+// Unfinished implements instance.Checkpointer.Unfinished. Checkpoints of instances
+// that are done or cannot be resumed are released
+func (cp *LocalCheckpointer) Unfinished() ([]*IndependentInstance, error) {
+
+	var instances []*IndependentInstance
+
+	err := cp.update(func(checkpoints *bolt.Bucket) error {
+		var released [][]byte
+
+		err := checkpoints.ForEach(func(k, v []byte) error {
+			inst := &IndependentInstance{}
+			if err := json.Unmarshal(v, inst); err != nil {
+				logger.Errorf("LocalCheckpointer: unable to restore instance '%s': %s", string(k), err.Error())
+				released = append(released, k)
+				return nil
+			}
+			if inst.Status() >= model.FlowStatusCompleted {
+				released = append(released, k)
+				return nil
+			}
+			if len(inst.subFlows) > 0 {
+				//todo support resuming subflows, the tasks hosting them are not serialized
+				logger.Errorf("LocalCheckpointer: instance '%s' has running subflows and cannot be resumed", string(k))
+				released = append(released, k)
+				return nil
+			}
+			instances = append(instances, inst)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range released {
+			if err := checkpoints.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return instances, err
+}
@@ -0,0 +1,88 @@
+package instance
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/model"
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/support"
+	"github.com/TIBCOSoftware/flogo-lib/app/resource"
+	"github.com/TIBCOSoftware/flogo-lib/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalCheckpointerResume(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	checkpointer := NewLocalCheckpointer(&util.ServiceConfig{Enabled: true, Settings: map[string]string{"path": filepath.Join(dir, "checkpoints.db")}})
+	defer checkpointer.Stop()
+
+	manager := support.NewFlowManager(nil)
+	err = manager.LoadResource(&resource.Config{ID: "test", Data: json.RawMessage(defJSON)})
+	assert.Nil(t, err)
+
+	def, _ := manager.GetFlow("res://test")
+	assert.NotNil(t, def)
+
+	instance := NewIndependentInstance("12345", "res://test", def)
+	instance.Start(nil)
+
+	// the engine stops after the first task
+	instance.DoStep()
+	assert.Nil(t, checkpointer.Checkpoint(instance))
+
+	unfinished, err := checkpointer.Unfinished()
+	assert.Nil(t, err)
+	assert.Len(t, unfinished, 1)
+
+	resumed := unfinished[0]
+	assert.Nil(t, resumed.Restart(resumed.ID(), manager))
+	assert.Equal(t, "12345", resumed.ID())
+	assert.Equal(t, instance.StepID(), resumed.StepID())
+	assert.Equal(t, instance.workItemQueue.List.Len(), resumed.workItemQueue.List.Len())
+
+	hasWork := true
+	for hasWork && resumed.Status() < model.FlowStatusCompleted {
+		hasWork = resumed.DoStep()
+	}
+	assert.Equal(t, model.FlowStatusCompleted, resumed.Status())
+
+	assert.Nil(t, checkpointer.Release(resumed.ID()))
+
+	unfinished, err = checkpointer.Unfinished()
+	assert.Nil(t, err)
+	assert.Len(t, unfinished, 0)
+}
+
+func TestLocalCheckpointerReleasesDone(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	checkpointer := NewLocalCheckpointer(&util.ServiceConfig{Enabled: true, Settings: map[string]string{"path": filepath.Join(dir, "checkpoints.db")}})
+	defer checkpointer.Stop()
+
+	instance := runRecorded(t, &nilRecorder{}, "12345")
+	assert.Equal(t, model.FlowStatusCompleted, instance.Status())
+	assert.Nil(t, checkpointer.Checkpoint(instance))
+
+	unfinished, err := checkpointer.Unfinished()
+	assert.Nil(t, err)
+	assert.Len(t, unfinished, 0)
+}
+
+type nilRecorder struct {
+}
+
+func (nr *nilRecorder) RecordSnapshot(instance *IndependentInstance) {
+}
+
+func (nr *nilRecorder) RecordStep(instance *IndependentInstance) {
+}
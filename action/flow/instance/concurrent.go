@@ -0,0 +1,149 @@
+package instance
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/model"
+	"github.com/TIBCOSoftware/flogo-lib/core/activity"
+	"github.com/TIBCOSoftware/flogo-lib/core/data"
+	"github.com/TIBCOSoftware/flogo-lib/logger"
+)
+
+const (
+	settingConcurrent = "concurrent"
+)
+
+type preEvalResult struct {
+	done bool
+	err  error
+}
+
+// SetConcurrency sets how many ready work items of independent branches are evaluated
+// in parallel. Their activities are evaluated ahead of their step, but their outputs
+// are mapped into the instance and their successors entered one step at a time, in
+// queue order, as in the sequential mode. 0 or 1 evaluates the work items one at a time.
+//
+// Activities that act on the flow (return, reply, subflow) are not evaluated ahead.
+// Tasks whose activity changes the flow attributes (e.g. the mapper activity) must opt
+// out with the 'concurrent' task setting set to false. Tasks with output mappings end
+// the batch: the inputs of the tasks behind them would be mapped before their outputs
+func (inst *IndependentInstance) SetConcurrency(concurrency int) {
+	inst.concurrency = concurrency
+}
+
+// preEval evaluates the activities of the ready work items at the front of the queue
+// in parallel, starting with the work item of the current step
+func (inst *IndependentInstance) preEval(current *WorkItem) {
+
+	batch := inst.preEvalBatch(current)
+	if len(batch) < 2 {
+		return
+	}
+
+	logger.Debugf("Evaluating %d tasks in parallel", len(batch))
+
+	var wg sync.WaitGroup
+	for _, taskInst := range batch {
+		wg.Add(1)
+		go func(taskInst *TaskInst) {
+			defer wg.Done()
+			taskInst.preEvalActivity()
+		}(taskInst)
+	}
+	wg.Wait()
+}
+
+// preEvalBatch gets the tasks evaluated in parallel with the work item of the current step.
+// The batch ends after the first work item whose task maps its outputs into the flow, as the
+// sequential mode applies that mapping before it maps the inputs of the tasks behind it
+func (inst *IndependentInstance) preEvalBatch(current *WorkItem) []*TaskInst {
+
+	if inst.concurrency < 2 || !preEvaluable(current.taskInst) {
+		return nil
+	}
+
+	batch := []*TaskInst{current.taskInst}
+	added := map[*TaskInst]bool{current.taskInst: true}
+
+	if inst.mapsOutputs(current.taskInst) {
+		return batch
+	}
+
+	for e := inst.workItemQueue.List.Front(); e != nil && len(batch) < inst.concurrency; e = e.Next() {
+		workItem, ok := e.Value.(*WorkItem)
+		if !ok {
+			continue
+		}
+		if !added[workItem.taskInst] && preEvaluable(workItem.taskInst) {
+			batch = append(batch, workItem.taskInst)
+			added[workItem.taskInst] = true
+		}
+		if inst.mapsOutputs(workItem.taskInst) {
+			break
+		}
+	}
+
+	return batch
+}
+
+// mapsOutputs checks if the task maps the outputs of its activity into the flow, with its
+// own mappings or with those of the patch of the instance
+func (inst *IndependentInstance) mapsOutputs(taskInst *TaskInst) bool {
+
+	if taskInst == nil || taskInst.task.ActivityConfig() == nil {
+		return false
+	}
+
+	if inst.patch != nil && inst.patch.GetOutputMapper(taskInst.task.ID()) != nil {
+		return true
+	}
+
+	return taskInst.task.ActivityConfig().HasOutputMappings()
+}
+
+// preEvaluable checks if the activity of a task can be evaluated ahead of its step
+func preEvaluable(taskInst *TaskInst) bool {
+
+	if taskInst == nil || taskInst.preEvaluated != nil || taskInst.status != model.TaskStatusReady {
+		return false
+	}
+
+	task := taskInst.task
+	if task.TypeID() != "" || task.ActivityConfig() == nil {
+		// only the default task behavior evaluates the activity once per work item
+		return false
+	}
+
+	if value, set := task.GetSetting(settingConcurrent); set {
+		if concurrent, err := data.CoerceToBoolean(value); err == nil && !concurrent {
+			return false
+		}
+	}
+
+	act := activity.Get(task.ActivityConfig().Ref())
+	if act == nil {
+		return false
+	}
+
+	return !act.Metadata().ProducesResult && !act.Metadata().DynamicIO
+}
+
+// preEvalActivity evaluates the activity of the task, keeping the result for EvalActivity
+func (ti *TaskInst) preEvalActivity() {
+
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Warnf("Unhandled Error executing activity '%s'[%s] : %v\n", ti.task.Name(), ti.task.ActivityConfig().Ref(), r)
+
+			// todo: useful for debugging
+			logger.Debugf("StackTrace: %s", debug.Stack())
+
+			ti.preEvaluated = &preEvalResult{err: NewActivityEvalError(ti.task.Name(), "unhandled", fmt.Sprintf("%v", r))}
+		}
+	}()
+
+	done, err := ti.evalActivity()
+	ti.preEvaluated = &preEvalResult{done: done, err: err}
+}
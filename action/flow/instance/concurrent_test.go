@@ -0,0 +1,106 @@
+package instance
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/definition"
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/model"
+	"github.com/stretchr/testify/assert"
+)
+
+const forkJoinDefJSON = `
+{
+  "name": "forkjoin",
+  "model": "test",
+  "tasks": [
+    { "id": "a", "name": "a", "activity": { "ref": "test-sleep", "input": { "millis": 100 } } },
+    { "id": "b", "name": "b", "activity": { "ref": "test-sleep", "input": { "millis": 100 } } },
+    { "id": "c", "name": "c", "activity": { "ref": "test-sleep", "input": { "millis": 100 } } },
+    { "id": "join", "name": "join", "activity": { "ref": "test-counter", "input": { "counterName": "join" } } }
+  ],
+  "links": [
+    { "from": "a", "to": "join" },
+    { "from": "b", "to": "join" },
+    { "from": "c", "to": "join" }
+  ]
+}
+`
+
+func runForkJoin(t *testing.T, concurrency int) (*IndependentInstance, time.Duration) {
+
+	defRep := &definition.DefinitionRep{}
+	err := json.Unmarshal([]byte(forkJoinDefJSON), defRep)
+	assert.Nil(t, err)
+
+	def, err := definition.NewDefinition(defRep)
+	assert.Nil(t, err)
+
+	instance := NewIndependentInstance("12345", "uri", def)
+	instance.SetConcurrency(concurrency)
+	instance.Start(nil)
+
+	start := time.Now()
+
+	hasWork := true
+	for hasWork && instance.Status() < model.FlowStatusCompleted {
+		hasWork = instance.DoStep()
+	}
+	return instance, time.Since(start)
+}
+
+func TestConcurrentBranches(t *testing.T) {
+
+	instance, elapsed := runForkJoin(t, 3)
+	assert.Equal(t, model.FlowStatusCompleted, instance.Status())
+	assert.True(t, elapsed < 250*time.Millisecond, "branches were not evaluated in parallel: %s", elapsed)
+
+	instance, elapsed = runForkJoin(t, 0)
+	assert.Equal(t, model.FlowStatusCompleted, instance.Status())
+	assert.True(t, elapsed >= 300*time.Millisecond)
+}
+
+const outputMappingDefJSON = `
+{
+  "name": "outputmapping",
+  "model": "test",
+  "tasks": [
+    { "id": "a", "name": "a", "activity": { "ref": "test-log", "input": { "message": "a" } } },
+    {
+      "id": "b",
+      "name": "b",
+      "activity": {
+        "ref": "test-log",
+        "input": { "message": "b" },
+        "mappings": { "output": [ { "type": 1, "value": "$.message", "mapTo": "message" } ] }
+      }
+    },
+    { "id": "c", "name": "c", "activity": { "ref": "test-log", "input": { "message": "c" } } }
+  ]
+}
+`
+
+func TestConcurrentBatchEndsAtOutputMappings(t *testing.T) {
+
+	defRep := &definition.DefinitionRep{}
+	err := json.Unmarshal([]byte(outputMappingDefJSON), defRep)
+	assert.Nil(t, err)
+
+	def, err := definition.NewDefinition(defRep)
+	assert.Nil(t, err)
+
+	instance := NewIndependentInstance("12345", "uri", def)
+	instance.SetConcurrency(3)
+	instance.Start(nil)
+
+	item, ok := instance.workItemQueue.Pop()
+	assert.True(t, ok)
+
+	// c would read the flow attributes before b maps its outputs into them
+	var ids []string
+	for _, taskInst := range instance.preEvalBatch(item.(*WorkItem)) {
+		ids = append(ids, taskInst.task.ID())
+	}
+	assert.Equal(t, []string{"a", "b"}, ids)
+}
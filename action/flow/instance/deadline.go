@@ -0,0 +1,197 @@
+package instance
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/TIBCOSoftware/flogo-lib/core/activity"
+	"github.com/TIBCOSoftware/flogo-lib/core/data"
+	"github.com/TIBCOSoftware/flogo-lib/logger"
+)
+
+const (
+	// ErrorTypeTimeout is the type of the errors of the tasks that exceed their timeout
+	// or the deadline of the flow, so the error handler can branch on $error.type
+	ErrorTypeTimeout = "timeout"
+
+	settingTimeout = "timeout"
+)
+
+// SetDeadline sets the deadline of the Flow Instance. The tasks evaluated when it
+// expires fail with a timeout error. The error handler is not bound by it
+func (inst *IndependentInstance) SetDeadline(deadline time.Time) {
+	inst.deadline = deadline
+}
+
+// Deadline gets the deadline of the Flow Instance, if any
+func (inst *IndependentInstance) Deadline() (time.Time, bool) {
+	return inst.deadline, !inst.deadline.IsZero()
+}
+
+// activityEval is the activity.Context of one evaluation of an activity. It keeps the scopes and the Go
+// context the evaluation started with, so an evaluation left running after a timeout neither sees nor
+// changes those of the next evaluation of the task (e.g. a retry)
+type activityEval struct {
+	*TaskInst
+	ctx      context.Context
+	inScope  data.Scope
+	outScope data.Scope
+}
+
+// GoContext gets the context of the evaluation, which is done when the task timeout or the
+// flow deadline expire. Activities get it with:
+//
+//	if c, ok := context.(interface{ GoContext() gocontext.Context }); ok {
+//		ctx := c.GoContext()
+//	}
+func (e *activityEval) GoContext() context.Context {
+	return e.ctx
+}
+
+// InputScope implements activity.Context.InputScope
+func (e *activityEval) InputScope() data.Scope {
+	return e.inScope
+}
+
+// OutputScope implements activity.Context.OutputScope
+func (e *activityEval) OutputScope() data.Scope {
+	return e.outScope
+}
+
+// GetInput implements activity.Context.GetInput
+func (e *activityEval) GetInput(name string) interface{} {
+
+	val, found := e.inScope.GetAttr(name)
+	if found {
+		return val.Value()
+	}
+
+	return nil
+}
+
+// GetOutput implements activity.Context.GetOutput
+func (e *activityEval) GetOutput(name string) interface{} {
+
+	val, found := e.outScope.GetAttr(name)
+	if found {
+		return val.Value()
+	}
+
+	return nil
+}
+
+// SetOutput implements activity.Context.SetOutput
+func (e *activityEval) SetOutput(name string, value interface{}) {
+	e.outScope.SetAttrValue(name, value)
+}
+
+// timeout gets the 'timeout' setting of the task, in milliseconds
+func (ti *TaskInst) timeout() (time.Duration, error) {
+
+	value, set := ti.task.GetSetting(settingTimeout)
+	if !set {
+		return 0, nil
+	}
+
+	millis, err := data.CoerceToInteger(value)
+	if err != nil || millis < 0 {
+		return 0, fmt.Errorf("'%v' is not a valid timeout", value)
+	}
+
+	return time.Duration(millis) * time.Millisecond, nil
+}
+
+// evalContext creates the context of an activity evaluation, out of the task timeout
+// and the flow deadline
+func (ti *TaskInst) evalContext() (context.Context, context.CancelFunc, error) {
+
+	timeout, err := ti.timeout()
+	if err != nil {
+		return nil, nil, NewActivityEvalError(ti.task.Name(), "settings", err.Error())
+	}
+
+	deadline, hasDeadline := ti.flowInst.master.Deadline()
+	if ti.flowInst.isHandlingError {
+		hasDeadline = false
+	}
+
+	if timeout > 0 {
+		taskDeadline := time.Now().Add(timeout)
+		if !hasDeadline || taskDeadline.Before(deadline) {
+			deadline = taskDeadline
+			hasDeadline = true
+		}
+	}
+
+	if !hasDeadline {
+		return context.Background(), func() {}, nil
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	return ctx, cancel, nil
+}
+
+// evalWithContext runs an activity evaluation until it is done or the context expires.
+// An activity that does not return on time is left running, its results are ignored
+func (ti *TaskInst) evalWithContext(eval func(context activity.Context) (bool, error)) (done bool, evalErr error) {
+
+	ctx, cancel, err := ti.evalContext()
+	if err != nil {
+		return false, err
+	}
+	defer cancel()
+
+	evalCtx := &activityEval{TaskInst: ti, ctx: ctx, inScope: ti.InputScope(), outScope: ti.OutputScope()}
+
+	if ctx.Done() == nil {
+		return eval(evalCtx)
+	}
+
+	if ctx.Err() != nil {
+		return false, ti.timeoutError()
+	}
+
+	type evalResult struct {
+		done bool
+		err  error
+	}
+
+	result := make(chan evalResult, 1)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				result <- evalResult{false, NewActivityEvalError(ti.task.Name(), "unhandled", fmt.Sprintf("%v", r))}
+			}
+		}()
+
+		done, err := eval(evalCtx)
+		result <- evalResult{done, err}
+	}()
+
+	select {
+	case r := <-result:
+		if r.err != nil && ctx.Err() != nil {
+			// the activity gave up on the cancellation
+			return false, ti.timeoutError()
+		}
+		return r.done, r.err
+	case <-ctx.Done():
+		logger.Warnf("Activity '%s'[%s] did not return on time, it is left running and its outputs are dropped", ti.task.Name(), ti.task.ActivityConfig().Ref())
+		// the abandoned evaluation keeps its scopes, the next one gets new ones
+		ti.inScope = nil
+		ti.outScope = nil
+		return false, ti.timeoutError()
+	}
+}
+
+func (ti *TaskInst) timeoutError() error {
+
+	if deadline, ok := ti.flowInst.master.Deadline(); ok && !ti.flowInst.isHandlingError && !time.Now().Before(deadline) {
+		return NewActivityEvalError(ti.task.Name(), ErrorTypeTimeout, "flow deadline exceeded")
+	}
+
+	timeout, _ := ti.timeout()
+	return NewActivityEvalError(ti.task.Name(), ErrorTypeTimeout, fmt.Sprintf("task '%s' timed out after %s", ti.task.Name(), timeout))
+}
@@ -0,0 +1,73 @@
+package instance
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/definition"
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/model"
+	"github.com/stretchr/testify/assert"
+)
+
+const sleepDefJSON = `
+{
+  "name": "sleep",
+  "model": "test",
+  "tasks": [
+    {
+      "id": "sleep",
+      "name": "sleep",
+      "settings": { "timeout": %TIMEOUT% },
+      "activity": { "ref": "test-sleep", "input": { "millis": 50 } }
+    }
+  ]
+}
+`
+
+func runSleep(t *testing.T, timeout string, deadline time.Time) *IndependentInstance {
+
+	defRep := &definition.DefinitionRep{}
+	err := json.Unmarshal([]byte(strings.Replace(sleepDefJSON, "%TIMEOUT%", timeout, 1)), defRep)
+	assert.Nil(t, err)
+
+	def, err := definition.NewDefinition(defRep)
+	assert.Nil(t, err)
+
+	instance := NewIndependentInstance("12345", "uri", def)
+	if !deadline.IsZero() {
+		instance.SetDeadline(deadline)
+	}
+	instance.Start(nil)
+
+	hasWork := true
+	for hasWork && instance.Status() < model.FlowStatusCompleted {
+		hasWork = instance.DoStep()
+	}
+	return instance
+}
+
+func TestTaskTimeout(t *testing.T) {
+
+	instance := runSleep(t, "10", time.Time{})
+	assert.Equal(t, model.FlowStatusFailed, instance.Status())
+
+	evalErr, ok := instance.GetError().(*ActivityEvalError)
+	assert.True(t, ok)
+	assert.Equal(t, ErrorTypeTimeout, evalErr.Type())
+
+	instance = runSleep(t, "1000", time.Time{})
+	assert.Equal(t, model.FlowStatusCompleted, instance.Status())
+}
+
+func TestFlowDeadline(t *testing.T) {
+
+	instance := runSleep(t, "0", time.Now().Add(10*time.Millisecond))
+	assert.Equal(t, model.FlowStatusFailed, instance.Status())
+
+	evalErr, ok := instance.GetError().(*ActivityEvalError)
+	assert.True(t, ok)
+	assert.Equal(t, ErrorTypeTimeout, evalErr.Type())
+	assert.Equal(t, "flow deadline exceeded", evalErr.Error())
+}
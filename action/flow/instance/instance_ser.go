@@ -13,6 +13,7 @@ import (
 
 type serIndependentInstance struct {
 	ID        string            `json:"id"`
+	StepID    int               `json:"stepId,omitempty"`
 	Status    model.FlowStatus  `json:"status"`
 	FlowURI   string            `json:"flowUri"`
 	Attrs     []*data.Attribute `json:"attrs"`
@@ -44,12 +45,14 @@ type linkData struct {
 // MarshalJSON overrides the default MarshalJSON for FlowInstance
 func (inst *IndependentInstance) MarshalJSON() ([]byte, error) {
 
-	queue := make([]*WorkItem, inst.workItemQueue.List.Len())
+	queue := make([]*WorkItem, inst.workItemQueue.List.Len(), inst.workItemQueue.List.Len()+len(inst.delayed))
 
 	for i, e := 0, inst.workItemQueue.List.Front(); e != nil; i, e = i+1, e.Next() {
 		queue[i], _ = e.Value.(*WorkItem)
 	}
 
+	queue = append(queue, inst.delayed...)
+
 	attrs := make([]*data.Attribute, 0, len(inst.attrs))
 
 	for _, value := range inst.attrs {
@@ -101,6 +104,7 @@ func (inst *IndependentInstance) MarshalJSON() ([]byte, error) {
 
 	return json.Marshal(&serIndependentInstance{
 		ID:          inst.id,
+		StepID:      inst.stepID,
 		Status:      inst.status,
 		Attrs:       attrs,
 		FlowURI:     inst.flowURI,
@@ -121,7 +125,9 @@ func (inst *IndependentInstance) UnmarshalJSON(d []byte) error {
 	}
 
 	inst.Instance = &Instance{}
+	inst.master = inst
 	inst.id = ser.ID
+	inst.stepID = ser.StepID
 	inst.status = ser.Status
 	inst.flowURI = ser.FlowURI
 
@@ -185,7 +191,16 @@ func (inst *IndependentInstance) UnmarshalJSON(d []byte) error {
 		}
 
 		workItem.taskInst = taskInsts[workItem.TaskID]
-		inst.workItemQueue.Push(workItem)
+
+		if workItem.Due > 0 {
+			inst.addDelayed(workItem)
+		} else {
+			inst.workItemQueue.Push(workItem)
+		}
+
+		if workItem.ID > inst.wiCounter {
+			inst.wiCounter = workItem.ID
+		}
 	}
 
 	return nil
@@ -270,23 +285,35 @@ func (inst *Instance) UnmarshalJSON(d []byte) error {
 ////////////////////////////////////////////////////////////////////////////////////////////////////////
 // TaskInst Serialization
 
-// MarshalJSON overrides the default MarshalJSON for TaskInst
+// MarshalJSON overrides the default MarshalJSON for TaskInst. Only the working data
+// of simple types (e.g. the retries done) is kept, iterators start over
 func (ti *TaskInst) MarshalJSON() ([]byte, error) {
 
+	var workingData []*data.Attribute
+	for _, attr := range ti.workingData {
+		switch attr.Type() {
+		case data.TypeString, data.TypeInteger, data.TypeBoolean:
+			workingData = append(workingData, attr)
+		}
+	}
+
 	return json.Marshal(&struct {
-		TaskID string `json:"taskId"`
-		Status int    `json:"status"`
+		TaskID      string            `json:"taskId"`
+		Status      int               `json:"status"`
+		WorkingData []*data.Attribute `json:"workingData,omitempty"`
 	}{
-		TaskID: ti.task.ID(),
-		Status: int(ti.status),
+		TaskID:      ti.task.ID(),
+		Status:      int(ti.status),
+		WorkingData: workingData,
 	})
 }
 
 // UnmarshalJSON overrides the default UnmarshalJSON for TaskInst
 func (ti *TaskInst) UnmarshalJSON(d []byte) error {
 	ser := &struct {
-		TaskID string `json:"taskId"`
-		Status int    `json:"status"`
+		TaskID      string            `json:"taskId"`
+		Status      int               `json:"status"`
+		WorkingData []*data.Attribute `json:"workingData,omitempty"`
 	}{}
 
 	if err := json.Unmarshal(d, ser); err != nil {
@@ -296,6 +323,10 @@ func (ti *TaskInst) UnmarshalJSON(d []byte) error {
 	ti.status = model.TaskStatus(ser.Status)
 	ti.taskID = ser.TaskID
 
+	for _, attr := range ser.WorkingData {
+		ti.AddWorkingData(attr)
+	}
+
 	return nil
 }
 
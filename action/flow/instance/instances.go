@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"runtime/debug"
+	"sort"
+	"time"
 
 	"github.com/TIBCOSoftware/flogo-contrib/action/flow/definition"
 	"github.com/TIBCOSoftware/flogo-contrib/action/flow/model"
@@ -20,6 +22,7 @@ type IndependentInstance struct {
 	stepID        int
 	workItemQueue *util.SyncQueue //todo: change to faster non-threadsafe queue
 	wiCounter     int
+	delayed       []*WorkItem // work items not due yet, earliest first
 
 	ChangeTracker *InstanceChangeTracker
 
@@ -29,6 +32,9 @@ type IndependentInstance struct {
 	interceptor *support.Interceptor
 
 	subFlows map[int]*Instance
+
+	deadline    time.Time
+	concurrency int
 }
 
 // New creates a new Flow Instance from the specified Flow
@@ -155,6 +161,8 @@ func (inst *IndependentInstance) DoStep() bool {
 
 	if inst.status == model.FlowStatusActive {
 
+		inst.queueDelayed()
+
 		// get item to be worked on
 		item, ok := inst.workItemQueue.Pop()
 
@@ -172,8 +180,13 @@ func (inst *IndependentInstance) DoStep() bool {
 			// track the fact that the work item was removed from the queue
 			inst.ChangeTracker.trackWorkItem(&WorkItemQueueChange{ChgType: CtDel, ID: workItem.ID, WorkItem: workItem})
 
+			inst.preEval(workItem)
+
 			inst.execTask(behavior, workItem.taskInst)
 
+			hasNext = true
+		} else if len(inst.delayed) > 0 {
+			logger.Debug("Flow Instance waiting for its scheduled tasks")
 			hasNext = true
 		} else {
 			logger.Debug("Flow Instance work queue empty")
@@ -183,6 +196,23 @@ func (inst *IndependentInstance) DoStep() bool {
 	return hasNext
 }
 
+// NextDue gets when the next step of the Flow Instance can be done, when only scheduled
+// tasks are left. It is no later than the deadline of the instance, when the scheduled
+// tasks are evaluated and fail with a timeout error
+func (inst *IndependentInstance) NextDue() (time.Time, bool) {
+
+	if len(inst.delayed) == 0 || inst.workItemQueue.List.Len() > 0 {
+		return time.Time{}, false
+	}
+
+	due := time.Unix(0, inst.delayed[0].Due)
+	if !inst.deadline.IsZero() && inst.deadline.Before(due) {
+		due = inst.deadline
+	}
+
+	return due, true
+}
+
 func (inst *IndependentInstance) scheduleEval(taskInst *TaskInst) {
 
 	inst.wiCounter++
@@ -196,6 +226,58 @@ func (inst *IndependentInstance) scheduleEval(taskInst *TaskInst) {
 	inst.ChangeTracker.trackWorkItem(&WorkItemQueueChange{ChgType: CtAdd, ID: workItem.ID, WorkItem: workItem})
 }
 
+// scheduleEvalAfter schedules the evaluation of a task after the delay, the other work
+// items are executed meanwhile
+func (inst *IndependentInstance) scheduleEvalAfter(taskInst *TaskInst, delay time.Duration) {
+
+	if delay <= 0 {
+		inst.scheduleEval(taskInst)
+		return
+	}
+
+	inst.wiCounter++
+
+	workItem := NewWorkItem(inst.wiCounter, taskInst)
+	workItem.Due = time.Now().Add(delay).UnixNano()
+	logger.Debugf("Scheduling task '%s' in %s", taskInst.task.ID(), delay)
+
+	inst.addDelayed(workItem)
+
+	// track the fact that the work item was added to the queue
+	inst.ChangeTracker.trackWorkItem(&WorkItemQueueChange{ChgType: CtAdd, ID: workItem.ID, WorkItem: workItem})
+}
+
+func (inst *IndependentInstance) addDelayed(workItem *WorkItem) {
+
+	i := sort.Search(len(inst.delayed), func(i int) bool { return inst.delayed[i].Due > workItem.Due })
+
+	inst.delayed = append(inst.delayed, nil)
+	copy(inst.delayed[i+1:], inst.delayed[i:])
+	inst.delayed[i] = workItem
+}
+
+// queueDelayed moves the delayed work items that are due to the work queue. Once the
+// deadline of the instance expires, they are all due, their evaluation times out
+func (inst *IndependentInstance) queueDelayed() {
+
+	if len(inst.delayed) == 0 {
+		return
+	}
+
+	now := time.Now()
+	expired := !inst.deadline.IsZero() && !now.Before(inst.deadline)
+
+	due := 0
+	for due < len(inst.delayed) && (expired || inst.delayed[due].Due <= now.UnixNano()) {
+		workItem := inst.delayed[due]
+		workItem.Due = 0
+		inst.workItemQueue.Push(workItem)
+		due++
+	}
+
+	inst.delayed = inst.delayed[due:]
+}
+
 // execTask executes the specified Work Item of the Flow Instance
 func (inst *IndependentInstance) execTask(behavior model.TaskBehavior, taskInst *TaskInst) {
 
@@ -250,6 +332,9 @@ func (inst *IndependentInstance) execTask(behavior model.TaskBehavior, taskInst
 		taskInst.SetStatus(model.TaskStatusReady)
 		//task needs to iterate or retry
 		inst.scheduleEval(taskInst)
+	case model.EVAL_RETRY:
+		//task already scheduled by the behavior, see TaskInst.EvalAfter
+		taskInst.SetStatus(model.TaskStatusReady)
 	}
 }
 
@@ -463,6 +548,9 @@ type WorkItem struct {
 
 	TaskID    string `json:"taskID"`
 	SubFlowID int    `json:"subFlowId"`
+
+	// Due is when a delayed work item can be executed, in Unix nanoseconds
+	Due int64 `json:"due,omitempty"`
 }
 
 // NewWorkItem constructs a new WorkItem for the specified TaskInst
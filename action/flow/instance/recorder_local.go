@@ -0,0 +1,416 @@
+package instance
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/model"
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/service"
+	"github.com/TIBCOSoftware/flogo-lib/logger"
+	"github.com/TIBCOSoftware/flogo-lib/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// LocalRecorderDefaultPath is the store file used when the 'path' setting is not set
+	LocalRecorderDefaultPath = "flowstate.db"
+	// LocalRecorderDefaultMaxInstances is the number of instances kept when the 'maxInstances' setting is not set
+	LocalRecorderDefaultMaxInstances = 1000
+)
+
+var (
+	bucketInstances = []byte("instances")
+	bucketCreated   = []byte("created")
+	bucketSteps     = []byte("steps")
+	keyInfo         = []byte("info")
+	keySnapshot     = []byte("snapshot")
+)
+
+// LocalInstanceInfo describes a Flow Instance kept by the LocalStateRecorder
+type LocalInstanceInfo struct {
+	FlowID  string    `json:"flowID"`
+	FlowURI string    `json:"flowURI"`
+	Status  int       `json:"status"`
+	StepID  int       `json:"stepID"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// LocalStateRecorder is an implementation of StateRecorder service that keeps the
+// snapshots and steps of Flow Instances in a local BoltDB file, for sites without
+// a flow state service. Only the last snapshot of an instance is kept, along with
+// every step. The oldest instances are removed beyond 'maxInstances' or 'maxAge'.
+//
+// Settings:
+//
+//	path:         store file (default flowstate.db)
+//	maxInstances: instances kept, 0 keeps all (default 1000)
+//	maxAge:       age of the instances kept, as a duration (e.g. 72h). Empty keeps all
+//	failedOnly:   when true, instances that complete successfully are removed
+type LocalStateRecorder struct {
+	path         string
+	maxInstances int
+	maxAge       time.Duration
+	failedOnly   bool
+	enabled      bool
+
+	db   *bolt.DB
+	lock sync.Mutex
+}
+
+// NewLocalStateRecorder creates a new LocalStateRecorder
+func NewLocalStateRecorder(config *util.ServiceConfig) *LocalStateRecorder {
+
+	recorder := &LocalStateRecorder{enabled: config.Enabled}
+	recorder.init(config.Settings)
+
+	return recorder
+}
+
+func (sr *LocalStateRecorder) Name() string {
+	return service.ServiceStateRecorder
+}
+
+func (sr *LocalStateRecorder) Enabled() bool {
+	return sr.enabled
+}
+
+// Start implements util.Managed.Start()
+func (sr *LocalStateRecorder) Start() error {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	return sr.openLocked()
+}
+
+// Stop implements util.Managed.Stop()
+func (sr *LocalStateRecorder) Stop() error {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	if sr.db == nil {
+		return nil
+	}
+	err := sr.db.Close()
+	sr.db = nil
+	return err
+}
+
+func (sr *LocalStateRecorder) init(settings map[string]string) {
+
+	sr.path = settings["path"]
+	if sr.path == "" {
+		sr.path = LocalRecorderDefaultPath
+	}
+
+	sr.maxInstances = LocalRecorderDefaultMaxInstances
+	if maxInstances, set := settings["maxInstances"]; set && maxInstances != "" {
+		n, err := strconv.Atoi(maxInstances)
+		if err != nil || n < 0 {
+			panic("LocalStateRecorder: setting 'maxInstances' must be a positive integer")
+		}
+		sr.maxInstances = n
+	}
+
+	if maxAge, set := settings["maxAge"]; set && maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil || d < 0 {
+			panic("LocalStateRecorder: setting 'maxAge' must be a positive duration")
+		}
+		sr.maxAge = d
+	}
+
+	sr.failedOnly, _ = strconv.ParseBool(settings["failedOnly"])
+
+	logger.Debugf("LocalStateRecorder: StateRecorder Store = %s", sr.path)
+}
+
+// openLocked opens the store, when not open yet
+func (sr *LocalStateRecorder) openLocked() error {
+	if sr.db != nil {
+		return nil
+	}
+	db, err := bolt.Open(sr.path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("LocalStateRecorder: unable to open store '%s': %s", sr.path, err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketInstances); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketCreated)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("LocalStateRecorder: unable to initialize store '%s': %s", sr.path, err.Error())
+	}
+	sr.db = db
+	return nil
+}
+
+// update runs a write transaction, opening the store if needed. Recording errors
+// are logged, they must not fail the Flow Instance
+func (sr *LocalStateRecorder) update(fn func(tx *bolt.Tx) error) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	if err := sr.openLocked(); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if err := sr.db.Update(fn); err != nil {
+		logger.Errorf("LocalStateRecorder: unable to record: %s", err.Error())
+	}
+}
+
+// RecordSnapshot implements instance.StateRecorder.RecordSnapshot
+func (sr *LocalStateRecorder) RecordSnapshot(instance *IndependentInstance) {
+
+	if sr.failedOnly && instance.Status() == model.FlowStatusCompleted {
+		return
+	}
+
+	storeReq := &RecordSnapshotReq{
+		ID:           instance.StepID(),
+		FlowID:       instance.ID(),
+		Status:       int(instance.Status()),
+		SnapshotData: instance,
+	}
+
+	jsonReq, err := json.Marshal(storeReq)
+	if err != nil {
+		logger.Errorf("LocalStateRecorder: unable to serialize snapshot of instance '%s': %s", instance.ID(), err.Error())
+		return
+	}
+
+	sr.update(func(tx *bolt.Tx) error {
+		instBucket, err := sr.instanceBucket(tx, instance)
+		if err != nil {
+			return err
+		}
+		return instBucket.Put(keySnapshot, jsonReq)
+	})
+}
+
+// RecordStep implements instance.StateRecorder.RecordStep
+func (sr *LocalStateRecorder) RecordStep(instance *IndependentInstance) {
+
+	if sr.failedOnly && instance.Status() == model.FlowStatusCompleted {
+		sr.update(func(tx *bolt.Tx) error {
+			return deleteInstance(tx, instance.ID())
+		})
+		return
+	}
+
+	storeReq := &RecordStepReq{
+		ID:       instance.StepID(),
+		FlowID:   instance.ID(),
+		Status:   int(instance.Status()),
+		StepData: instance.ChangeTracker,
+		FlowURI:  instance.flowURI,
+	}
+
+	jsonReq, err := json.Marshal(storeReq)
+	if err != nil {
+		logger.Errorf("LocalStateRecorder: unable to serialize step %d of instance '%s': %s", instance.StepID(), instance.ID(), err.Error())
+		return
+	}
+
+	sr.update(func(tx *bolt.Tx) error {
+		instBucket, err := sr.instanceBucket(tx, instance)
+		if err != nil {
+			return err
+		}
+		steps, err := instBucket.CreateBucketIfNotExists(bucketSteps)
+		if err != nil {
+			return err
+		}
+		return steps.Put(stepKey(instance.StepID()), jsonReq)
+	})
+}
+
+// instanceBucket gets the bucket of an instance and updates its info. New instances
+// make room for themselves, removing the oldest instances beyond the retention limits
+func (sr *LocalStateRecorder) instanceBucket(tx *bolt.Tx, instance *IndependentInstance) (*bolt.Bucket, error) {
+
+	now := time.Now().UTC()
+	instances := tx.Bucket(bucketInstances)
+
+	instBucket := instances.Bucket([]byte(instance.ID()))
+	info := &LocalInstanceInfo{FlowID: instance.ID(), FlowURI: instance.flowURI, Created: now}
+
+	if instBucket == nil {
+		var err error
+		if instBucket, err = instances.CreateBucket([]byte(instance.ID())); err != nil {
+			return nil, err
+		}
+		if err = tx.Bucket(bucketCreated).Put(createdKey(now, instance.ID()), nil); err != nil {
+			return nil, err
+		}
+		if err = sr.prune(tx, now); err != nil {
+			return nil, err
+		}
+	} else if infoData := instBucket.Get(keyInfo); infoData != nil {
+		if err := json.Unmarshal(infoData, info); err != nil {
+			return nil, err
+		}
+	}
+
+	info.Status = int(instance.Status())
+	info.StepID = instance.StepID()
+	info.Updated = now
+
+	infoData, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	return instBucket, instBucket.Put(keyInfo, infoData)
+}
+
+// prune removes the oldest instances beyond maxInstances or maxAge
+func (sr *LocalStateRecorder) prune(tx *bolt.Tx, now time.Time) error {
+
+	created := tx.Bucket(bucketCreated)
+	instances := tx.Bucket(bucketInstances)
+	count := 0
+	created.ForEach(func(k, v []byte) error {
+		count++
+		return nil
+	})
+
+	c := created.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.First() {
+		createdTime := time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))
+		tooMany := sr.maxInstances > 0 && count > sr.maxInstances
+		tooOld := sr.maxAge > 0 && now.Sub(createdTime) > sr.maxAge
+		if !tooMany && !tooOld {
+			break
+		}
+		flowID := append([]byte(nil), k[8:]...)
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		if instances.Bucket(flowID) != nil {
+			if err := instances.DeleteBucket(flowID); err != nil {
+				return err
+			}
+		}
+		count--
+	}
+	return nil
+}
+
+// deleteInstance removes an instance and its creation index entry
+func deleteInstance(tx *bolt.Tx, flowID string) error {
+
+	instances := tx.Bucket(bucketInstances)
+	instBucket := instances.Bucket([]byte(flowID))
+	if instBucket == nil {
+		return nil
+	}
+
+	info := &LocalInstanceInfo{}
+	if infoData := instBucket.Get(keyInfo); infoData != nil {
+		if err := json.Unmarshal(infoData, info); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(bucketCreated).Delete(createdKey(info.Created, flowID)); err != nil {
+		return err
+	}
+	return instances.DeleteBucket([]byte(flowID))
+}
+
+// Instances gets the info of the Flow Instances kept, oldest first
+func (sr *LocalStateRecorder) Instances() ([]*LocalInstanceInfo, error) {
+
+	var infos []*LocalInstanceInfo
+	err := sr.view(func(tx *bolt.Tx) error {
+		instances := tx.Bucket(bucketInstances)
+		return tx.Bucket(bucketCreated).ForEach(func(k, v []byte) error {
+			instBucket := instances.Bucket(k[8:])
+			if instBucket == nil {
+				return nil
+			}
+			infoData := instBucket.Get(keyInfo)
+			if infoData == nil {
+				return nil
+			}
+			info := &LocalInstanceInfo{}
+			if err := json.Unmarshal(infoData, info); err != nil {
+				return err
+			}
+			infos = append(infos, info)
+			return nil
+		})
+	})
+	return infos, err
+}
+
+// Snapshot gets the last snapshot recorded for a Flow Instance, as a RecordSnapshotReq JSON document
+func (sr *LocalStateRecorder) Snapshot(flowID string) (json.RawMessage, error) {
+
+	var snapshot json.RawMessage
+	err := sr.view(func(tx *bolt.Tx) error {
+		instBucket := tx.Bucket(bucketInstances).Bucket([]byte(flowID))
+		if instBucket == nil {
+			return fmt.Errorf("instance '%s' not found", flowID)
+		}
+		if data := instBucket.Get(keySnapshot); data != nil {
+			snapshot = append(json.RawMessage(nil), data...)
+		}
+		return nil
+	})
+	return snapshot, err
+}
+
+// Steps gets the steps recorded for a Flow Instance in order, as RecordStepReq JSON documents
+func (sr *LocalStateRecorder) Steps(flowID string) ([]json.RawMessage, error) {
+
+	var steps []json.RawMessage
+	err := sr.view(func(tx *bolt.Tx) error {
+		instBucket := tx.Bucket(bucketInstances).Bucket([]byte(flowID))
+		if instBucket == nil {
+			return fmt.Errorf("instance '%s' not found", flowID)
+		}
+		stepsBucket := instBucket.Bucket(bucketSteps)
+		if stepsBucket == nil {
+			return nil
+		}
+		return stepsBucket.ForEach(func(k, v []byte) error {
+			steps = append(steps, append(json.RawMessage(nil), v...))
+			return nil
+		})
+	})
+	return steps, err
+}
+
+// view runs a read transaction, opening the store if needed
+func (sr *LocalStateRecorder) view(fn func(tx *bolt.Tx) error) error {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	if err := sr.openLocked(); err != nil {
+		return err
+	}
+	return sr.db.View(fn)
+}
+
+// stepKey orders the steps of an instance
+func stepKey(stepID int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(stepID))
+	return key
+}
+
+// createdKey orders the instances by creation time
+func createdKey(created time.Time, flowID string) []byte {
+	key := make([]byte, 8, 8+len(flowID))
+	binary.BigEndian.PutUint64(key, uint64(created.UnixNano()))
+	return append(key, flowID...)
+}
@@ -0,0 +1,109 @@
+package instance
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/definition"
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/model"
+	"github.com/TIBCOSoftware/flogo-lib/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRecorder(t *testing.T, settings map[string]string) (*LocalStateRecorder, func()) {
+	dir, err := ioutil.TempDir("", "recorder")
+	assert.Nil(t, err)
+
+	settings["path"] = filepath.Join(dir, "flowstate.db")
+	recorder := NewLocalStateRecorder(&util.ServiceConfig{Enabled: true, Settings: settings})
+	assert.Nil(t, recorder.Start())
+
+	return recorder, func() {
+		recorder.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func runRecorded(t *testing.T, recorder StateRecorder, id string) *IndependentInstance {
+	defRep := &definition.DefinitionRep{}
+	err := json.Unmarshal([]byte(defJSON), defRep)
+	assert.Nil(t, err)
+
+	def, _ := definition.NewDefinition(defRep)
+	assert.NotNil(t, def)
+
+	instance := NewIndependentInstance(id, "uri", def)
+	instance.Start(nil)
+
+	hasWork := true
+	for hasWork && instance.Status() < model.FlowStatusCompleted {
+		hasWork = instance.DoStep()
+		recorder.RecordSnapshot(instance)
+		recorder.RecordStep(instance)
+	}
+	return instance
+}
+
+func TestLocalStateRecorder(t *testing.T) {
+
+	recorder, cleanup := newTestRecorder(t, map[string]string{})
+	defer cleanup()
+
+	instance := runRecorded(t, recorder, "12345")
+
+	infos, err := recorder.Instances()
+	assert.Nil(t, err)
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "12345", infos[0].FlowID)
+	assert.Equal(t, "uri", infos[0].FlowURI)
+	assert.Equal(t, int(instance.Status()), infos[0].Status)
+	assert.Equal(t, instance.StepID(), infos[0].StepID)
+
+	steps, err := recorder.Steps("12345")
+	assert.Nil(t, err)
+	assert.Len(t, steps, instance.StepID())
+
+	snapshot, err := recorder.Snapshot("12345")
+	assert.Nil(t, err)
+
+	snapshotReq := &RecordSnapshotReq{}
+	assert.Nil(t, json.Unmarshal(snapshot, snapshotReq))
+	assert.Equal(t, instance.StepID(), snapshotReq.ID)
+	assert.Equal(t, "12345", snapshotReq.FlowID)
+}
+
+func TestLocalStateRecorderRetention(t *testing.T) {
+
+	recorder, cleanup := newTestRecorder(t, map[string]string{"maxInstances": "2"})
+	defer cleanup()
+
+	for i := 0; i < 4; i++ {
+		runRecorded(t, recorder, strconv.Itoa(i))
+	}
+
+	infos, err := recorder.Instances()
+	assert.Nil(t, err)
+	assert.Len(t, infos, 2)
+	assert.Equal(t, "2", infos[0].FlowID)
+	assert.Equal(t, "3", infos[1].FlowID)
+
+	_, err = recorder.Steps("0")
+	assert.NotNil(t, err)
+}
+
+func TestLocalStateRecorderFailedOnly(t *testing.T) {
+
+	recorder, cleanup := newTestRecorder(t, map[string]string{"failedOnly": "true"})
+	defer cleanup()
+
+	instance := runRecorded(t, recorder, "12345")
+	assert.Equal(t, model.FlowStatusCompleted, instance.Status())
+
+	infos, err := recorder.Instances()
+	assert.Nil(t, err)
+	assert.Len(t, infos, 0)
+}
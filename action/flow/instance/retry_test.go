@@ -0,0 +1,132 @@
+package instance
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/definition"
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/model"
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/support"
+	"github.com/TIBCOSoftware/flogo-lib/app/resource"
+	"github.com/TIBCOSoftware/flogo-lib/core/data"
+	"github.com/stretchr/testify/assert"
+)
+
+const retryDefJSON = `
+{
+  "name": "retry",
+  "model": "test",
+  "tasks": [
+    {
+      "id": "retry",
+      "name": "retry",
+      "settings": { "retryCount": 1, "retryInterval": %INTERVAL% },
+      "activity": { "ref": "test-fail", "input": { "counterName": "%COUNTER%", "failures": 1 } }
+    },
+    { "id": "other", "name": "other", "activity": { "ref": "test-sleep", "input": { "millis": 20 } } },
+    { "id": "join", "name": "join", "activity": { "ref": "test-counter", "input": { "counterName": "%COUNTER%" } } }
+  ],
+  "links": [
+    { "from": "retry", "to": "join" },
+    { "from": "other", "to": "join" }
+  ]
+}
+`
+
+// runRetry runs the flow as the flow action does, waiting for the scheduled tasks between the
+// steps. It also returns when the first wait started, the other branch must be done by then
+func runRetry(t *testing.T, counter string, interval string, deadline time.Time) (*IndependentInstance, time.Duration, time.Duration) {
+
+	defJSON := strings.Replace(strings.Replace(retryDefJSON, "%INTERVAL%", interval, 1), "%COUNTER%", counter, -1)
+
+	defRep := &definition.DefinitionRep{}
+	err := json.Unmarshal([]byte(defJSON), defRep)
+	assert.Nil(t, err)
+
+	def, err := definition.NewDefinition(defRep)
+	assert.Nil(t, err)
+
+	instance := NewIndependentInstance("12345", "uri", def)
+	if !deadline.IsZero() {
+		instance.SetDeadline(deadline)
+	}
+	instance.Start(nil)
+
+	start := time.Now()
+	waited := time.Duration(-1)
+
+	hasWork := true
+	for hasWork && instance.Status() < model.FlowStatusCompleted {
+		if due, ok := instance.NextDue(); ok {
+			if waited < 0 {
+				waited = time.Since(start)
+				other, entered := instance.taskInsts["other"]
+				assert.True(t, !entered || other.Status() == model.TaskStatusDone, "the other branch is not done")
+			}
+			time.Sleep(time.Until(due))
+		}
+		hasWork = instance.DoStep()
+	}
+	return instance, waited, time.Since(start)
+}
+
+func TestRetryDoesNotBlockOtherBranches(t *testing.T) {
+
+	instance, waited, elapsed := runRetry(t, "retry-branches", "200", time.Time{})
+	assert.Equal(t, model.FlowStatusCompleted, instance.Status())
+
+	// the other branch finished during the backoff, then the retry succeeded
+	assert.True(t, waited >= 0 && waited < 150*time.Millisecond, "the other branch waited for the retry: %s", waited)
+	assert.True(t, elapsed >= 200*time.Millisecond, "the retry was not delayed: %s", elapsed)
+}
+
+func TestRetryDelayCappedAtDeadline(t *testing.T) {
+
+	instance, _, elapsed := runRetry(t, "retry-deadline", "5000", time.Now().Add(100*time.Millisecond))
+	assert.Equal(t, model.FlowStatusFailed, instance.Status())
+	assert.True(t, elapsed < time.Second, "the retry delay outlived the deadline: %s", elapsed)
+
+	evalErr, ok := instance.GetError().(*ActivityEvalError)
+	assert.True(t, ok)
+	assert.Equal(t, ErrorTypeTimeout, evalErr.Type())
+}
+
+func TestRetryCountSurvivesCheckpoint(t *testing.T) {
+
+	defJSON := strings.Replace(strings.Replace(retryDefJSON, "%INTERVAL%", "0", 1), "%COUNTER%", "retry-checkpoint", -1)
+
+	manager := support.NewFlowManager(nil)
+	err := manager.LoadResource(&resource.Config{ID: "retry", Data: json.RawMessage(defJSON)})
+	assert.Nil(t, err)
+
+	def, _ := manager.GetFlow("res://retry")
+	assert.NotNil(t, def)
+
+	instance := NewIndependentInstance("12345", "res://retry", def)
+	instance.Start(nil)
+
+	// the first evaluation fails and the retry is scheduled, then the engine stops
+	instance.DoStep()
+	retries, ok := instance.taskInsts["retry"].GetWorkingData("_retries")
+	assert.True(t, ok)
+
+	state, err := json.Marshal(instance)
+	assert.Nil(t, err)
+
+	resumed := &IndependentInstance{}
+	assert.Nil(t, json.Unmarshal(state, resumed))
+	assert.Nil(t, resumed.Restart(resumed.ID(), manager))
+
+	resumedRetries, ok := resumed.taskInsts["retry"].GetWorkingData("_retries")
+	assert.True(t, ok)
+	count, _ := data.CoerceToInteger(resumedRetries.Value())
+	assert.Equal(t, retries.Value(), count)
+
+	hasWork := true
+	for hasWork && resumed.Status() < model.FlowStatusCompleted {
+		hasWork = resumed.DoStep()
+	}
+	assert.Equal(t, model.FlowStatusCompleted, resumed.Status())
+}
@@ -37,6 +37,8 @@ type TaskInst struct {
 
 	returnError error
 
+	preEvaluated *preEvalResult // result of the activity evaluated ahead, see IndependentInstance.SetConcurrency
+
 	taskID string //needed for serialization
 }
 
@@ -341,6 +343,45 @@ func (ti *TaskInst) EvalActivity() (done bool, evalErr error) {
 		}
 	}()
 
+	if result := ti.preEvaluated; result != nil {
+		// evaluated ahead, in parallel with other branches
+		ti.preEvaluated = nil
+		done, evalErr = result.done, result.err
+	} else {
+		done, evalErr = ti.evalActivity()
+	}
+
+	if evalErr != nil {
+		return false, evalErr
+	}
+
+	if done {
+
+		//if taskData.HasAttrs() {
+		applyOutputInterceptor(ti)
+
+		if ti.task.ActivityConfig().OutputMapper() != nil {
+
+			appliedMapper, err := applyOutputMapper(ti)
+
+			if err != nil {
+				evalErr = NewActivityEvalError(ti.task.Name(), "mapper", err.Error())
+				return done, evalErr
+			}
+
+			if !appliedMapper && !ti.task.IsScope() {
+
+				logger.Debug("Mapper not applied")
+			}
+		}
+	}
+
+	return done, nil
+}
+
+// evalActivity applies the input mapper and evaluates the activity
+func (ti *TaskInst) evalActivity() (done bool, evalErr error) {
+
 	eval := true
 
 	if ti.task.ActivityConfig().InputMapper() != nil {
@@ -360,7 +401,9 @@ func (ti *TaskInst) EvalActivity() (done bool, evalErr error) {
 	if eval {
 
 		act := activity.Get(ti.task.ActivityConfig().Ref())
-		done, evalErr = act.Eval(ti)
+		done, evalErr = ti.evalWithContext(func(context activity.Context) (bool, error) {
+			return act.Eval(context)
+		})
 
 		if evalErr != nil {
 			e, ok := evalErr.(*activity.Error)
@@ -374,27 +417,6 @@ func (ti *TaskInst) EvalActivity() (done bool, evalErr error) {
 		done = true
 	}
 
-	if done {
-
-		//if taskData.HasAttrs() {
-		applyOutputInterceptor(ti)
-
-		if ti.task.ActivityConfig().OutputMapper() != nil {
-
-			appliedMapper, err := applyOutputMapper(ti)
-
-			if err != nil {
-				evalErr = NewActivityEvalError(ti.task.Name(), "mapper", err.Error())
-				return done, evalErr
-			}
-
-			if !appliedMapper && !ti.task.IsScope() {
-
-				logger.Debug("Mapper not applied")
-			}
-		}
-	}
-
 	return done, nil
 }
 
@@ -424,7 +446,9 @@ func (ti *TaskInst) PostEvalActivity() (done bool, evalErr error) {
 	done = true
 
 	if ok {
-		done, evalErr = aa.PostEval(ti, nil)
+		done, evalErr = ti.evalWithContext(func(context activity.Context) (bool, error) {
+			return aa.PostEval(context, nil)
+		})
 
 		if evalErr != nil {
 			e, ok := evalErr.(*activity.Error)
@@ -458,6 +482,11 @@ func (ti *TaskInst) PostEvalActivity() (done bool, evalErr error) {
 	return done, nil
 }
 
+// EvalAfter implements model.TaskContext.EvalAfter
+func (ti *TaskInst) EvalAfter(delay time.Duration) {
+	ti.flowInst.master.scheduleEvalAfter(ti, delay)
+}
+
 // FlowReply is used to reply to the Flow Host with the results of the execution
 func (ti *TaskInst) FlowReply(replyData map[string]*data.Attribute, err error) {
 	//ignore
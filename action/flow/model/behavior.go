@@ -44,6 +44,8 @@ const (
 	EVAL_REPEAT
 	EVAL_WAIT
 	EVAL_SKIP
+	// EVAL_RETRY indicates that the Task was scheduled to be evaluated again (see TaskContext.EvalAfter)
+	EVAL_RETRY
 )
 
 type EnterResult int
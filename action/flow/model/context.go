@@ -1,6 +1,8 @@
 package model
 
 import (
+	"time"
+
 	"github.com/TIBCOSoftware/flogo-contrib/action/flow/definition"
 	"github.com/TIBCOSoftware/flogo-lib/core/data"
 )
@@ -46,6 +48,10 @@ type TaskContext interface {
 	// PostActivity does post evaluation of the Activity associated with the Task
 	PostEvalActivity() (done bool, err error)
 
+	// EvalAfter schedules the Task to be evaluated again after the delay. The other
+	// tasks of the Flow Instance are evaluated meanwhile
+	EvalAfter(delay time.Duration)
+
 	Resolve(toResolve string) (value interface{}, err error)
 
 	//todo  move to a mutable scope
@@ -0,0 +1,200 @@
+package simple
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/definition"
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/model"
+	"github.com/TIBCOSoftware/flogo-lib/core/data"
+)
+
+const (
+	settingRetryCount       = "retryCount"
+	settingRetryInterval    = "retryInterval"
+	settingRetryBackoff     = "retryBackoff"
+	settingRetryMaxInterval = "retryMaxInterval"
+	settingRetryJitter      = "retryJitter"
+	settingRetryOn          = "retryOn"
+
+	BackoffFixed       = "fixed"
+	BackoffExponential = "exponential"
+)
+
+// RetryPolicy describes how a task is evaluated again when its activity fails. It is
+// configured with the task settings:
+//
+//	retryCount:       retries after the first failure (default 0, no retries)
+//	retryInterval:    delay before the first retry, in milliseconds (default 0)
+//	retryBackoff:     'fixed' or 'exponential', which doubles the delay on each retry (default fixed)
+//	retryMaxInterval: longest delay between retries, in milliseconds. 0 does not limit it
+//	retryJitter:      random variation of the delays, as a fraction of them (0 to 1)
+//	retryOn:          error types retried (see ActivityEvalError.Type), as a list or comma
+//	                  separated. When not set, every error is retried
+type RetryPolicy struct {
+	Count       int
+	Interval    time.Duration
+	Backoff     string
+	MaxInterval time.Duration
+	Jitter      float64
+	RetryOn     []string
+}
+
+// GetRetryPolicy gets the retry policy of a task, nil when it is not retried
+func GetRetryPolicy(task *definition.Task) (*RetryPolicy, error) {
+
+	value, set := task.GetSetting(settingRetryCount)
+	if !set {
+		return nil, nil
+	}
+
+	count, err := data.CoerceToInteger(value)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("'%v' is not a valid retry count", value)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	policy := &RetryPolicy{Count: count, Backoff: BackoffFixed}
+
+	if policy.Interval, err = getMillis(task, settingRetryInterval); err != nil {
+		return nil, err
+	}
+	if policy.MaxInterval, err = getMillis(task, settingRetryMaxInterval); err != nil {
+		return nil, err
+	}
+
+	if value, set := task.GetSetting(settingRetryBackoff); set {
+		backoff := strings.ToLower(fmt.Sprintf("%v", value))
+		if backoff != BackoffFixed && backoff != BackoffExponential {
+			return nil, fmt.Errorf("'%v' is not a valid retry backoff", value)
+		}
+		policy.Backoff = backoff
+	}
+
+	if value, set := task.GetSetting(settingRetryJitter); set {
+		policy.Jitter, err = data.CoerceToNumber(value)
+		if err != nil || policy.Jitter < 0 || policy.Jitter > 1 {
+			return nil, fmt.Errorf("'%v' is not a valid retry jitter", value)
+		}
+	}
+
+	if value, set := task.GetSetting(settingRetryOn); set {
+		switch t := value.(type) {
+		case string:
+			for _, errType := range strings.Split(t, ",") {
+				if errType = strings.TrimSpace(errType); errType != "" {
+					policy.RetryOn = append(policy.RetryOn, errType)
+				}
+			}
+		case []interface{}:
+			for _, errType := range t {
+				policy.RetryOn = append(policy.RetryOn, fmt.Sprintf("%v", errType))
+			}
+		default:
+			return nil, fmt.Errorf("'%v' is not a valid list of retried errors", value)
+		}
+	}
+
+	return policy, nil
+}
+
+func getMillis(task *definition.Task, setting string) (time.Duration, error) {
+
+	value, set := task.GetSetting(setting)
+	if !set {
+		return 0, nil
+	}
+
+	millis, err := data.CoerceToInteger(value)
+	if err != nil || millis < 0 {
+		return 0, fmt.Errorf("'%v' is not a valid %s", value, setting)
+	}
+
+	return time.Duration(millis) * time.Millisecond, nil
+}
+
+// Retryable checks if the error is retried. Errors without a type are only retried
+// when the policy does not list the retried errors
+func (p *RetryPolicy) Retryable(err error) bool {
+
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+
+	typed, ok := err.(interface {
+		Type() string
+	})
+	if !ok {
+		return false
+	}
+
+	for _, errType := range p.RetryOn {
+		if errType == typed.Type() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Delay gets the delay before a retry, starting at 1
+func (p *RetryPolicy) Delay(retry int) time.Duration {
+
+	delay := float64(p.Interval)
+
+	if p.Backoff == BackoffExponential && retry > 1 {
+		delay *= math.Pow(2, float64(retry-1))
+	}
+
+	if p.MaxInterval > 0 && delay > float64(p.MaxInterval) {
+		delay = float64(p.MaxInterval)
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(delay)
+}
+
+// retry schedules a failed task to be evaluated again, according to its retry policy.
+// The retries done are kept in the working data of the task
+func retry(ctx model.TaskContext, evalErr error) (bool, error) {
+
+	task := ctx.Task()
+
+	policy, err := GetRetryPolicy(task)
+	if err != nil {
+		return false, fmt.Errorf("Task '%s' retry not properly configured. %s", task.Name(), err.Error())
+	}
+	if policy == nil || !policy.Retryable(evalErr) {
+		return false, nil
+	}
+
+	retries := 0
+	if retriesAttr, ok := ctx.GetWorkingData("_retries"); ok {
+		// restored from a checkpoint, it may be a JSON number
+		retries, _ = data.CoerceToInteger(retriesAttr.Value())
+	}
+
+	if retries >= policy.Count {
+		log.Debugf("Task '%s' failed after %d retries", task.ID(), retries)
+		return false, nil
+	}
+
+	retries++
+	retriesAttr, _ := data.NewAttribute("_retries", data.TypeInteger, retries)
+	ctx.AddWorkingData(retriesAttr)
+
+	delay := policy.Delay(retries)
+	log.Infof("Task '%s' failed, retry %d of %d in %s", task.ID(), retries, policy.Count, delay)
+
+	ctx.EvalAfter(delay)
+
+	return true, nil
+}
@@ -0,0 +1,76 @@
+package simple
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TIBCOSoftware/flogo-contrib/action/flow/definition"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRetryTask(t *testing.T, settings string) *definition.Task {
+
+	defJSON := `{"name": "retry", "tasks": [{"id": "a", "name": "a", "settings": ` + settings + `}]}`
+
+	defRep := &definition.DefinitionRep{}
+	err := json.Unmarshal([]byte(defJSON), defRep)
+	assert.Nil(t, err)
+
+	def, err := definition.NewDefinition(defRep)
+	assert.Nil(t, err)
+
+	return def.GetTask("a")
+}
+
+type typedError struct {
+	errType string
+}
+
+func (e *typedError) Type() string {
+	return e.errType
+}
+
+func (e *typedError) Error() string {
+	return e.errType + " error"
+}
+
+func TestGetRetryPolicy(t *testing.T) {
+
+	task := newRetryTask(t, `{"retryCount": 3, "retryInterval": 100, "retryBackoff": "exponential", "retryMaxInterval": 300, "retryOn": "mapper, unhandled"}`)
+
+	policy, err := GetRetryPolicy(task)
+	assert.Nil(t, err)
+	assert.NotNil(t, policy)
+	assert.Equal(t, 3, policy.Count)
+	assert.Equal(t, []string{"mapper", "unhandled"}, policy.RetryOn)
+
+	assert.Equal(t, 100*time.Millisecond, policy.Delay(1))
+	assert.Equal(t, 200*time.Millisecond, policy.Delay(2))
+	assert.Equal(t, 300*time.Millisecond, policy.Delay(3))
+
+	assert.True(t, policy.Retryable(&typedError{"mapper"}))
+	assert.False(t, policy.Retryable(&typedError{"activity"}))
+	assert.False(t, policy.Retryable(errors.New("untyped")))
+}
+
+func TestGetRetryPolicyDefaults(t *testing.T) {
+
+	policy, err := GetRetryPolicy(newRetryTask(t, `{}`))
+	assert.Nil(t, err)
+	assert.Nil(t, policy)
+
+	policy, err = GetRetryPolicy(newRetryTask(t, `{"retryCount": 2, "retryInterval": 50, "retryJitter": 0.5}`))
+	assert.Nil(t, err)
+	assert.Equal(t, BackoffFixed, policy.Backoff)
+	assert.True(t, policy.Retryable(errors.New("untyped")))
+
+	for retry := 1; retry <= 2; retry++ {
+		delay := policy.Delay(retry)
+		assert.True(t, delay >= 25*time.Millisecond && delay <= 75*time.Millisecond)
+	}
+
+	_, err = GetRetryPolicy(newRetryTask(t, `{"retryCount": 2, "retryBackoff": "linear"}`))
+	assert.NotNil(t, err)
+}
@@ -76,6 +76,14 @@ func (tb *TaskBehavior) Eval(ctx model.TaskContext) (evalResult model.EvalResult
 
 	if err != nil {
 		log.Errorf("Error evaluating activity '%s'[%s] - %s", ctx.Task().ID(), ctx.Task().ActivityConfig().Ref(), err.Error())
+
+		retried, retryErr := retry(ctx, err)
+		if retryErr != nil {
+			log.Error(retryErr)
+		} else if retried {
+			return model.EVAL_RETRY, nil
+		}
+
 		ctx.SetStatus(model.TaskStatusFailed)
 		return model.EVAL_FAIL, err
 	}
@@ -1,6 +1,10 @@
 package test
 
 import (
+	gocontext "context"
+	"fmt"
+	"time"
+
 	"github.com/TIBCOSoftware/flogo-lib/core/activity"
 	"github.com/TIBCOSoftware/flogo-lib/core/data"
 	"github.com/TIBCOSoftware/flogo-lib/logger"
@@ -11,6 +15,8 @@ var log = logger.GetLogger("test-activity")
 func init() {
 	activity.Register(NewLogActivity())
 	activity.Register(NewCounterActivity())
+	activity.Register(NewSleepActivity())
+	activity.Register(NewFailActivity())
 }
 
 type LogActivity struct {
@@ -98,3 +104,76 @@ func (a *CounterActivity) Eval(context activity.Context) (done bool, err error)
 
 	return true, nil
 }
+
+type SleepActivity struct {
+	metadata *activity.Metadata
+}
+
+// NewSleepActivity creates a new activity that sleeps, until cancelled
+func NewSleepActivity() activity.Activity {
+	metadata := &activity.Metadata{ID: "test-sleep"}
+	input := map[string]*data.Attribute{
+		"millis": data.NewZeroAttribute("millis", data.TypeInteger),
+	}
+	metadata.Input = input
+	return &SleepActivity{metadata: metadata}
+}
+
+// Metadata returns the activity's metadata
+func (a *SleepActivity) Metadata() *activity.Metadata {
+	return a.metadata
+}
+
+// Eval implements api.Activity.Eval - Sleeps for the specified millis
+func (a *SleepActivity) Eval(context activity.Context) (done bool, err error) {
+
+	millis, _ := data.CoerceToInteger(context.GetInput("millis"))
+
+	ctx := gocontext.Background()
+	if c, ok := context.(interface{ GoContext() gocontext.Context }); ok {
+		ctx = c.GoContext()
+	}
+
+	select {
+	case <-time.After(time.Duration(millis) * time.Millisecond):
+		return true, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+type FailActivity struct {
+	metadata *activity.Metadata
+	counters map[string]int
+}
+
+// NewFailActivity creates a new activity that fails its first evaluations
+func NewFailActivity() activity.Activity {
+	metadata := &activity.Metadata{ID: "test-fail"}
+	input := map[string]*data.Attribute{
+		"counterName": data.NewZeroAttribute("counterName", data.TypeString),
+		"failures":    data.NewZeroAttribute("failures", data.TypeInteger),
+	}
+	metadata.Input = input
+	return &FailActivity{metadata: metadata, counters: make(map[string]int)}
+}
+
+// Metadata returns the activity's metadata
+func (a *FailActivity) Metadata() *activity.Metadata {
+	return a.metadata
+}
+
+// Eval implements api.Activity.Eval - Fails the first 'failures' evaluations of the counter
+func (a *FailActivity) Eval(context activity.Context) (done bool, err error) {
+
+	counterName, _ := context.GetInput("counterName").(string)
+	failures, _ := data.CoerceToInteger(context.GetInput("failures"))
+
+	a.counters[counterName]++
+
+	if count := a.counters[counterName]; count <= failures {
+		return false, fmt.Errorf("failure %d of %d", count, failures)
+	}
+
+	return true, nil
+}
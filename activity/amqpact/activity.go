@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"time"
 	"github.com/TIBCOSoftware/flogo-lib/core/activity"
 	"github.com/TIBCOSoftware/flogo-lib/logger"
 	"github.com/mtorre-iot/flogo-contrib/activity/kxcommon"
@@ -23,15 +24,23 @@ var (
 	rsDurable      = "responseDurable"
 	rsAutoDelete   = "responseAutoDelete"
 	rsReliable     = "responseReliable"
+	rsMaxInFlight  = "responseMaxInFlight"
+	rsSpillFile    = "responseSpillFile"
+	rsPrefix       = "response"
+	rqRequestReply = "requestReply"
+	rqReplyTimeout = "replyTimeout"
 	ivInputMessage = "inputMessage"
+	ivCorrelationId = "correlationId"
 	ovMessage	   = "outputMessage"
+	ovSpilled      = "spilled"
+	ovReplyMessage = "replyMessage"
+	ovCorrelationId = "correlationId"
 	msgs           amqp.Delivery
 )
 //
 // AmqpActivity is simple AMQP Activity
 type AmqpActivity struct {
 	metadata       *activity.Metadata
-	resExch        *kxcommon.AMQPExchange
 }
 
 func init() {
@@ -81,65 +90,121 @@ func (a *AmqpActivity) Eval(context activity.Context) (done bool, err error) {
 	responseReliable := context.GetInput(rsReliable).(bool)
 	responseDurable := context.GetInput(rsDurable).(bool)
 	responseAutoDelete := context.GetInput(rsAutoDelete).(bool)
+	responseMaxInFlight := 0
+	if maxInFlight := context.GetInput(rsMaxInFlight); maxInFlight != nil && maxInFlight != "" {
+		inFlight, err := kxcommon.ToFloat(maxInFlight)
+		if err != nil || inFlight < 1 {
+			activityLog.Error(fmt.Sprintf("[amqpact] Response Exchange: Invalid max in flight %v", maxInFlight))
+			return false, fmt.Errorf("[amqpact] Invalid max in flight %v", maxInFlight)
+		}
+		responseMaxInFlight = int(inFlight)
+	}
+	responseSpillFile, _ := context.GetInput(rsSpillFile).(string)
+	requestReply, _ := kxcommon.ToBool(context.GetInput(rqRequestReply))
+	replyTimeout := 30 * time.Second
+	if timeout := context.GetInput(rqReplyTimeout); timeout != nil && timeout != "" {
+		seconds, err := kxcommon.ToFloat(timeout)
+		if err != nil || seconds <= 0 {
+			activityLog.Error(fmt.Sprintf("[amqpact] Invalid reply timeout %v", timeout))
+			return false, fmt.Errorf("[amqpact] Invalid reply timeout %v", timeout)
+		}
+		replyTimeout = time.Duration(seconds * float64(time.Second))
+	}
 	//
 	// Get message 
 	//
-	message :=  context.GetInput(ivInputMessage).(string)
+	// a JSON string, records (sent as a scan message) or any other object (sent as JSON)
+	message, err := kxcommon.EncodeMessage(context.GetInput(ivInputMessage))
+	if err != nil {
+		activityLog.Error(fmt.Sprintf("[amqpact] Input message could not be encoded. Error: %s", err))
+		return false, err
+	}
 	//
-	//	Create the response exchange object
+	//	Get the response publisher. It is shared across evaluations and stays connected,
+	//	reconnecting on its own when the broker restarts
 	//
 	if message != "" {
-		a.resExch = kxcommon.AMQPExchangeNew(responseHostName,
-			responsePort,
-			responseExchangeName,
-			responseExchangeType,
-			"",
-			responseRoutingKey,
-			responseUser,
-			responsePassword,
-			responseDurable,
-			responseAutoDelete,
-			responseReliable)
-
-		if a.resExch == nil {
-			errMsg := fmt.Sprintf("[amqpact] Response Exchange: Unable to Create Exchange Object: %s", a.resExch.ExchangeName)
-			activityLog.Error(fmt.Sprintf("%s", errMsg))
-			return false, errors.New(errMsg)
+		broker := kxcommon.AMQPConnectionConfig{
+			HostName: responseHostName,
+			Port: responsePort,
+			UserName: responseUser,
+			Password: responsePassword,
+		}
+		// vhost, TLS, connection name and heartbeat
+		if err := broker.ApplySettings(rsPrefix, context.GetInput); err != nil {
+			activityLog.Error(fmt.Sprintf("[amqpact] Response Exchange: %s", err))
+			return false, err
+		}
+		publisher, err := kxcommon.GetPooledAMQPPublisher(kxcommon.AMQPPublisherConfig{
+			Broker: broker,
+			ExchangeName: responseExchangeName,
+			ExchangeType: responseExchangeType,
+			Durable: responseDurable,
+			AutoDelete: responseAutoDelete,
+			Reliable: responseReliable,
+			MaxInFlight: responseMaxInFlight,
+			SpillFile: responseSpillFile,
+		})
+		if err != nil {
+			activityLog.Error(fmt.Sprintf("[amqpact] Response Exchange: Unable to Create Publisher: %s : %s", responseExchangeName, err))
+			return false, err
+		}
+		correlationId, _ := context.GetInput(ivCorrelationId).(string)
+		// headers, content type and encoding, persistent, priority, expiration, message id and timestamp
+		props, err := kxcommon.AMQPPropertiesFromSettings(context.GetInput)
+		if err != nil {
+			activityLog.Error(fmt.Sprintf("[amqpact] Invalid message properties. Error: %s", err))
+			return false, err
 		}
 		//
-		// Create the AMQP Response Exchange
+		// send the request and wait for its reply
 		//
-		if err := a.resExch.Open(false); err != nil {
-			activityLog.Error(fmt.Sprintf("[amqpact] Response Exchange: Unable to Open Exchange: %s : %s", a.resExch.ExchangeName, err))
-			return false, err
+		if requestReply {
+			reply, err := a.RequestMessage(publisher, kxcommon.AMQPMessage{RoutingKey: responseRoutingKey, Body: message, CorrelationID: correlationId, Properties: &props}, replyTimeout)
+			if (err != nil) {
+				return false, err
+			}
+			context.SetOutput(ovMessage, message)
+			context.SetOutput(ovReplyMessage, reply.Body)
+			context.SetOutput(ovCorrelationId, reply.CorrelationID)
+			context.SetOutput(ovSpilled, publisher.Spilled())
+			return true, nil
 		}
 		//
 		// publish the message
 		//
-		err := a.PublishMessage(message)
+		err = a.PublishMessage(publisher, kxcommon.AMQPMessage{RoutingKey: responseRoutingKey, Body: message, CorrelationID: correlationId, Properties: &props})
 		if (err != nil) {
 			return false, err
 		}
 		context.SetOutput(ovMessage, message)
-		//
-		// Close the Response Exchange
-		//
-		if err:= a.resExch.Close(); err != nil {
-			activityLog.Error(fmt.Sprintf("[amqpact] Response Exchange: Unable to Close Exchange: %s : %s", a.resExch.ExchangeName, err))
-			return false, err
-		}
+		context.SetOutput(ovSpilled, publisher.Spilled())
 	}
 	return true, nil
 }
 
 
-func (a *AmqpActivity) PublishMessage(message string) error {
+// PublishMessage publishes a message with the shared publisher of the evaluation
+func (a *AmqpActivity) PublishMessage(publisher *kxcommon.AMQPPublisher, msg kxcommon.AMQPMessage) error {
 
-	err := a.resExch.Publish(message)
+	err := publisher.Publish(msg)
 	if err != nil {
-		// Timeout occurred
-		activityLog.Error(fmt.Sprintf("[amqpact] Error occurred while trying to publish to Exchange '%s'", a.resExch.ExchangeName))
+		activityLog.Error(fmt.Sprintf("[amqpact] Error occurred while trying to publish to Exchange '%s'. Error: %s", publisher.ExchangeName(), err))
 		return err
 	}
+	if !publisher.Connected() {
+		activityLog.Warn(fmt.Sprintf("[amqpact] Broker unreachable, message kept until it reconnects. Error: %s", publisher.LastError()))
+	}
 	return nil
 }
+
+// RequestMessage publishes a request and waits for the correlated reply
+func (a *AmqpActivity) RequestMessage(publisher *kxcommon.AMQPPublisher, msg kxcommon.AMQPMessage, timeout time.Duration) (kxcommon.AMQPReply, error) {
+
+	reply, err := publisher.Request(msg, timeout)
+	if err != nil {
+		activityLog.Error(fmt.Sprintf("[amqpact] Request to Exchange '%s' failed. Error: %s", publisher.ExchangeName(), err))
+		return kxcommon.AMQPReply{}, err
+	}
+	return reply, nil
+}
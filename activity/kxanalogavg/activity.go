@@ -25,7 +25,11 @@ const (
 	ivInputTags = "inputTags"
 	ivOutputTags = "outputTags"
 	ivTSDB = "TSDB"
+	ivQualityPolicy = "qualityPolicy"
+	ivComputation = "computation"
+	ivResolution = "resolution"
 	ovOutput = "outputStream"
+	ovRecords = "outputRecords"
 )
 
 func init() {
@@ -50,24 +54,16 @@ func (a *KXAnalogAvgActivity) Metadata() *activity.Metadata {
 // Eval implements api.Activity.Eval - Logs the Message
 func (a *KXAnalogAvgActivity) Eval(context activity.Context) (done bool, err error) {
  
-	tsdbString := context.GetInput(ivTSDB).(string)
-	pObjectConfigFile := context.GetInput(ivpObjectConfigFile).(string)
+	pObjectConfigFile, _ := context.GetInput(ivpObjectConfigFile).(string)
 	
-	// decode (unmarshall) the TSDB server pars
-	//<hostname>:<port>:<userName>:<password>:<databaseName>:<historyTable>:<precision>
-	
- 	tsdbPars := strings.Split(tsdbString,":")
-	// create the Time Stamp DB access object
-
-	port, err := strconv.Atoi(tsdbPars[1])
+	// decode the TSDB connection setting (URI, JSON object or <hostname>:<port>:<userName>:<password>:<databaseName>:<historyTable>)
+	tsdbConfig, err := kxcommon.ParseTSDBConfig(context.GetInput(ivTSDB))
 	if err != nil {
+		activityLog.Errorf("[kxanalogavg] Invalid TSDB setting. Error %s", err)
 		return false, err
 	}
-	hostName := tsdbPars[0]
-	userName := tsdbPars[2]
-	password := tsdbPars[3]
-	databaseName := tsdbPars[4]
-	tableName := tsdbPars[5]
+	databaseName := tsdbConfig.Database
+	tableName := tsdbConfig.Table
 
 	// get the input tags
 	inputTagsInterface :=  context.GetInput(ivInputTags).(map[string]interface{})
@@ -93,6 +89,24 @@ func (a *KXAnalogAvgActivity) Eval(context activity.Context) (done bool, err err
         strValue := fmt.Sprintf("%v", value)
         outputTags[strKey] = strValue
 	}
+	qualityPolicy, _ := context.GetInput(ivQualityPolicy).(string)
+	qualityRule, err := kxcommon.ResolveQualityRule("kxanalogavg", qualityPolicy)
+	if err != nil {
+		activityLog.Errorf("[kxanalogavg] Invalid quality policy. Error %s", err)
+		return false, err
+	}
+	// averages are calculated from raw points (client) or from buckets aggregated by the TSDB (server)
+	computation, _ := context.GetInput(ivComputation).(string)
+	serverSide := strings.ToLower(computation) == "server"
+	resolution := 60 * time.Second
+	if resolutionInput := context.GetInput(ivResolution); resolutionInput != nil && resolutionInput != "" {
+		seconds, err := kxcommon.ToFloat(resolutionInput)
+		if err != nil || seconds <= 0 {
+			activityLog.Errorf("[kxanalogavg] Invalid resolution %v", resolutionInput)
+			return false, fmt.Errorf("[kxanalogavg] Invalid resolution %v", resolutionInput)
+		}
+		resolution = time.Duration(seconds * float64(time.Second))
+	}
 	// Check if number of input tags matches with output tags
 	if len(inputTags) != len(outputTags) {
 		activityLog.Errorf("[kxanalogavg] TimeNumber of Input Tags do not match with number of Output Tags.")
@@ -100,7 +114,7 @@ func (a *KXAnalogAvgActivity) Eval(context activity.Context) (done bool, err err
 	}
 
 	// Open the TSDB
-	tsdb := kxcommon.TSDBNew(hostName, port, userName, password) 
+	tsdb := tsdbConfig.NewTSDB()
 	err = tsdb.OpenTSDB()
 	if err != nil {
 		activityLog.Errorf("[kxanalogavg] Time Stamp Database could not be opened. Error %s", err)
@@ -113,9 +127,11 @@ func (a *KXAnalogAvgActivity) Eval(context activity.Context) (done bool, err err
 	//
 	// Go get history data of each tag from kxhistDB
 	// 
-	badData := false
- 	for key, comb := range inputTags {
+	for key, comb := range inputTags {
 		var avg float64
+		// quality is tracked per tag, so a gap in one input does not spoil the others
+		badData := false
+		qualityInputs := []kxcommon.QualityInput{}
 		tag := comb["tag"]
 		if  tag != "" {
 			// get window and check it is valid
@@ -128,115 +144,133 @@ func (a *KXAnalogAvgActivity) Eval(context activity.Context) (done bool, err err
 			windowEndTime := time.Now().UTC()
 			windowStartTime := windowEndTime.Add(-time.Duration(timeWindow) * time.Second)
 
-			windowResult, err := tsdb.QueryTSOneTagTimeRange(databaseName, tableName, tag,
-				 windowStartTime, windowEndTime)
-			if (err != nil)	{
-				activityLog.Errorf("[kxanalogavg] Tag: %s could not be accessed from Time Stamp database. Error %s", key, err)
-				return false, err
-			}
+			if serverSide {
+				// buckets are aggregated by the TSDB, only one record per resolution interval is transferred
+				window, err := tsdb.QueryTSWindowDownsampled(databaseName, tableName, tag, windowStartTime, windowEndTime, resolution)
+				if (err != nil)	{
+					activityLog.Errorf("[kxanalogavg] Tag: %s could not be accessed from Time Stamp database. Error %s", key, err)
+					return false, err
+				}
+				avg, err = window.Mean()
+				if err != nil {
+					activityLog.Warnf("[kxanalogavg] No time stamp records found for %s in the time window - skipped", tag)
+					badData = true
+				}
+				qualityInputs = window.QualityInputs()
+				activityLog.Debugf("average %f", avg)
+			} else {
+				windowResult, err := tsdb.QueryTSOneTagTimeRange(databaseName, tableName, tag,
+					 windowStartTime, windowEndTime)
+				if (err != nil)	{
+					activityLog.Errorf("[kxanalogavg] Tag: %s could not be accessed from Time Stamp database. Error %s", key, err)
+					return false, err
+				}
 			
-			lastValueOutOfWindow, err := tsdb.QueryTSOneTagLastValue(databaseName, tableName, tag, windowStartTime)
-		   	if (err != nil)	{
-			   activityLog.Errorf("[kxanalogavg] Tag: %s could not be accessed from Time Stamp database. Error %s", key, err)
-			   return false, err
-		   	}
-			noDataBeforeWindow := len(lastValueOutOfWindow) == 0 
-			noDataInWindow := len(windowResult) == 0
-			if noDataInWindow && noDataBeforeWindow {
-				activityLog.Warnf("[kxanalogavg] No time stamp records found for %s in the time window - skipped", tag)
-				badData = true
-			}
-			avgData := make([]avgItems, 0)
-			var t0 time.Time 
-			var v float64
+				lastValueOutOfWindow, err := tsdb.QueryTSOneTagLastValue(databaseName, tableName, tag, windowStartTime)
+			   	if (err != nil)	{
+				   activityLog.Errorf("[kxanalogavg] Tag: %s could not be accessed from Time Stamp database. Error %s", key, err)
+				   return false, err
+			   	}
+				noDataBeforeWindow := len(lastValueOutOfWindow) == 0 
+				noDataInWindow := len(windowResult) == 0
+				if noDataInWindow && noDataBeforeWindow {
+					activityLog.Warnf("[kxanalogavg] No time stamp records found for %s in the time window - skipped", tag)
+					badData = true
+				}
+				avgData := make([]avgItems, 0)
+				var t0 time.Time 
+				var v float64
 
-			if !badData {
+				if !badData {
 			
-				t0 = windowStartTime
+					t0 = windowStartTime
 
-				if !noDataBeforeWindow {  
-					v, err = lastValueOutOfWindow["value"].(json.Number).Float64()
-					if err != nil {
-						activityLog.Warnf("[kxanalogavg] value is invalid %s for tag %s - skipped", lastValueOutOfWindow["value"].(string), tag)
-						badData = true
-						continue
+					if !noDataBeforeWindow {  
+						v, err = lastValueOutOfWindow["value"].(json.Number).Float64()
+						if err != nil {
+							activityLog.Warnf("[kxanalogavg] value is invalid %s for tag %s - skipped", lastValueOutOfWindow["value"].(string), tag)
+							badData = true
+							continue
+						}
+						avgItem := avgItems {t0, v}
+						avgData = append(avgData, avgItem) 
+						qualityInputs = append(qualityInputs, sampleQuality(lastValueOutOfWindow))
 					}
-					avgItem := avgItems {t0, v}
-					avgData = append(avgData, avgItem) 
-				}
-				// go through all values
-				for _, wr := range windowResult {
-					//get record time
+					// go through all values
+					for _, wr := range windowResult {
+						//get record time
 
-					tint, err := wr["time"].(json.Number).Int64()
-					if err != nil {
-						activityLog.Warnf("[kxanalogavg] time is invalid %d for tag %s - skipped", wr["time"].(json.Number), tag)
-						badData = true
-						continue
+						tint, err := wr["time"].(json.Number).Int64()
+						if err != nil {
+							activityLog.Warnf("[kxanalogavg] time is invalid %d for tag %s - skipped", wr["time"].(json.Number), tag)
+							badData = true
+							continue
+						}
+						t := time.Unix(0, tint)
+						v, err = wr["value"].(json.Number).Float64()
+						if err != nil {
+							activityLog.Warnf("[kxanalogavg] value is invalid %d for tag %s - skipped", wr["value"].(json.Number), tag)
+							badData = true
+							continue
+						}
+						avgItem := avgItems {t, v}
+						avgData = append(avgData, avgItem)
+						qualityInputs = append(qualityInputs, sampleQuality(wr))
 					}
-					t := time.Unix(0, tint)
-					v, err = wr["value"].(json.Number).Float64()
-					if err != nil {
-						activityLog.Warnf("[kxanalogavg] value is invalid %d for tag %s - skipped", wr["value"].(json.Number), tag)
-						badData = true
-						continue
-					}
-					avgItem := avgItems {t, v}
-					avgData = append(avgData, avgItem)
 				}
-			}
-			//
-			// add remaining 
-			//
-			if !badData {
-				if !noDataInWindow {
-					v, err = windowResult[len(windowResult)-1]["value"].(json.Number).Float64()
-					if err != nil {
-						activityLog.Warnf("[kxanalogavg] value is invalid %d for tag %s - skipped", windowResult[len(windowResult)-1]["value"].(json.Number), tag)
-						continue
+				//
+				// add remaining 
+				//
+				if !badData {
+					if !noDataInWindow {
+						v, err = windowResult[len(windowResult)-1]["value"].(json.Number).Float64()
+						if err != nil {
+							activityLog.Warnf("[kxanalogavg] value is invalid %d for tag %s - skipped", windowResult[len(windowResult)-1]["value"].(json.Number), tag)
+							continue
+						}
+					} else {
+						v, err = lastValueOutOfWindow["value"].(json.Number).Float64()
+						if err != nil {
+							activityLog.Warnf("[kxanalogavg] value is invalid %d for tag %s - skipped", lastValueOutOfWindow["value"].(json.Number), tag)
+							continue
+						}
 					}
-				} else {
-					v, err = lastValueOutOfWindow["value"].(json.Number).Float64()
-					if err != nil {
-						activityLog.Warnf("[kxanalogavg] value is invalid %d for tag %s - skipped", lastValueOutOfWindow["value"].(json.Number), tag)
-						continue
-					}
-				}
-				avgItem := avgItems {windowEndTime, v}
-				avgData = append(avgData, avgItem) 
+					avgItem := avgItems {windowEndTime, v}
+					avgData = append(avgData, avgItem) 
 
-				var prevTime time.Time
-				var prevVal float64
-				var diff float64
-				var apt float64
+					var prevTime time.Time
+					var prevVal float64
+					var diff float64
+					var apt float64
 
-				totalInterval := avgData[len(avgData)-1].tim.Sub(avgData[0].tim).Nanoseconds() 
-				activityLog.Debugf("total Interval %d", totalInterval)
-				for i, v := range avgData {
-					if i == len(avgData) {
-						diff = float64(windowEndTime.Sub(prevTime).Nanoseconds())
-						apt = diff * prevVal / float64(totalInterval)
-						avg = avg + apt
-					} else if (i != 0) {
-						diff = float64(v.tim.Sub(prevTime).Nanoseconds())
-						apt = diff * prevVal / float64(totalInterval)
-						avg = avg + apt
+					totalInterval := avgData[len(avgData)-1].tim.Sub(avgData[0].tim).Nanoseconds() 
+					activityLog.Debugf("total Interval %d", totalInterval)
+					for i, v := range avgData {
+						if i == len(avgData) {
+							diff = float64(windowEndTime.Sub(prevTime).Nanoseconds())
+							apt = diff * prevVal / float64(totalInterval)
+							avg = avg + apt
+						} else if (i != 0) {
+							diff = float64(v.tim.Sub(prevTime).Nanoseconds())
+							apt = diff * prevVal / float64(totalInterval)
+							avg = avg + apt
+						}
+						activityLog.Debugf("Tag: %s, Time %d, Diff: %f, CurrValu %f, PrevVal: %f, Apt: %f", tag, v.tim.UnixNano(), diff, v.val, prevVal, apt)
+						prevTime = v.tim
+						prevVal = v.val
 					}
-					activityLog.Debugf("Tag: %s, Time %d, Diff: %f, CurrValu %f, PrevVal: %f, Apt: %f", tag, v.tim.UnixNano(), diff, v.val, prevVal, apt)
-					prevTime = v.tim
-					prevVal = v.val
+					activityLog.Debugf("average %f", avg)
 				}
-				activityLog.Debugf("average %f", avg)
 			}
 		}
 		//
 		// Calculation complete. Now place in the buffer for transmittal
 		//
 		if !badData {
-			outp := kxcommon.AnalyticsArgNew(key, fmt.Sprintf("%f", avg), kxcommon.QualityOk.String())
+			outp := kxcommon.AnalyticsArgNewTyped(key, kxcommon.FloatValue(avg), qualityRule.Propagate(qualityInputs).String())
 			response.Results = append(response.Results, outp)
 		} else {
-			outp := kxcommon.AnalyticsArgNew(key, fmt.Sprintf("%f", 0.0), kxcommon.QualityBad.String())
+			outp := kxcommon.AnalyticsArgNewTyped(key, kxcommon.FloatValue(0), kxcommon.QualityBad.String())
 			response.Results = append(response.Results, outp)
 		}
 	}
@@ -245,9 +279,9 @@ func (a *KXAnalogAvgActivity) Eval(context activity.Context) (done bool, err err
 	//
 	scanMessage := kxcommon.ScanMessageNew()
 	for _,res := range response.Results {
-		messageType := kxcommon.MessageUnitTypeValue
-		if badData { messageType = kxcommon.MessageUnitTypeQuality} 
-		smu := kxcommon.ScanMessageUnitNew(-1, outputTags[res.Name], res.Value, res.Quality, messageType, time.Now().UTC())
+		quality, _ := kxcommon.GetQualityFromString(res.Quality)
+		messageType := kxcommon.MessageUnitTypeForQuality(quality)
+		smu := kxcommon.ScanMessageUnitNewTyped(-1, outputTags[res.Name], res.TypedValue(), res.Quality, messageType, time.Now().UTC())
 		scanMessage.ScanMessageAdd(smu)
 	}
 	jsonMessage, err := kxcommon.SerializeObject(scanMessage)
@@ -256,6 +290,25 @@ func (a *KXAnalogAvgActivity) Eval(context activity.Context) (done bool, err err
 		return false, err
 	}
 	activityLog.Debug(fmt.Sprintf("[kxanalogavg] Output Message: %s", jsonMessage))
-	context.SetOutput(ovOutput, jsonMessage) 
+	context.SetOutput(ovOutput, jsonMessage)
+	// the same results, addressable one by one by the flow mappers
+	context.SetOutput(ovRecords, scanMessage.Records()) 
 	return true, nil
 }
+
+// sampleQuality gets the quality of a history record. Records without quality are assumed OK
+func sampleQuality(record map[string]interface{}) kxcommon.QualityInput {
+	quality := kxcommon.QualityOk
+	if qualityStr, ok := record["quality"].(string); ok {
+		if q, err := kxcommon.GetQualityFromString(qualityStr); err == nil {
+			quality = q
+		}
+	}
+	var timeStamp time.Time
+	if tnum, ok := record["time"].(json.Number); ok {
+		if tint, err := tnum.Int64(); err == nil {
+			timeStamp = time.Unix(0, tint)
+		}
+	}
+	return kxcommon.QualityInputNew(quality, timeStamp)
+}
@@ -0,0 +1,220 @@
+package kxanalogstats
+
+import (
+	"fmt"
+	"errors"
+	"time"
+	"strings"
+	"strconv"
+	"github.com/TIBCOSoftware/flogo-lib/core/activity"
+	"github.com/TIBCOSoftware/flogo-lib/logger"
+	"github.com/mtorre-iot/flogo-contrib/activity/kxcommon"
+)
+
+// activityLog is the default logger for the Log Activity
+var activityLog = logger.GetLogger("activity-flogo-kxanalogstats")
+
+const (
+	ivInputTags = "inputTags"
+	ivOutputTags = "outputTags"
+	ivTSDB = "TSDB"
+	ivQualityPolicy = "qualityPolicy"
+	ivComputation = "computation"
+	ivResolution = "resolution"
+	ovOutput = "outputStream"
+	ovRecords = "outputRecords"
+)
+
+// statistics functions
+const (
+	fnMean = "mean"
+	fnMin = "min"
+	fnMax = "max"
+	fnStdDev = "stddev"
+	fnIntegral = "integral"
+	fnTimeInState = "timeinstate"
+	fnRateOfChange = "rateofchange"
+	fnPercentile = "percentile"
+)
+
+func init() {
+	activityLog.SetLogLevel(logger.InfoLevel)
+}
+
+// KXAnalogStatsActivity is an Activity that is used get time stamp data from tags, and calculate time-weighted statistics
+type KXAnalogStatsActivity struct {
+	metadata *activity.Metadata
+}
+
+// NewActivity creates a new AppActivity
+func NewActivity(metadata *activity.Metadata) activity.Activity {
+	return &KXAnalogStatsActivity{metadata: metadata}
+}
+
+// Metadata returns the activity's metadata
+func (a *KXAnalogStatsActivity) Metadata() *activity.Metadata {
+	return a.metadata
+}
+
+// Eval implements api.Activity.Eval - Calculates the statistics
+func (a *KXAnalogStatsActivity) Eval(context activity.Context) (done bool, err error) {
+
+	// decode the TSDB connection setting (URI, JSON object or <hostname>:<port>:<userName>:<password>:<databaseName>:<historyTable>)
+	tsdbConfig, err := kxcommon.ParseTSDBConfig(context.GetInput(ivTSDB))
+	if err != nil {
+		activityLog.Errorf("[kxanalogstats] Invalid TSDB setting. Error %s", err)
+		return false, err
+	}
+	databaseName := tsdbConfig.Database
+	tableName := tsdbConfig.Table
+
+	// get the input tags
+	inputTagsInterface :=  context.GetInput(ivInputTags).(map[string]interface{})
+	inputTags := make(map[string]map[string]string)
+
+	for key, value := range inputTagsInterface {
+		inpObj, ok := value.(map[string]interface{})
+		if !ok {
+			return false, fmt.Errorf("[kxanalogstats] Input %s must be an object with tag, window, function and param", key)
+		}
+		comb := make(map[string]string)
+		for _, field := range []string{"tag", "window", "function", "param"} {
+			if v, ok := inpObj[field]; ok {
+				comb[field] = fmt.Sprintf("%v", v)
+			}
+		}
+		inputTags[key] = comb
+	}
+
+	// get the output tags
+	outputTagsInterface :=  context.GetInput(ivOutputTags).(map[string]interface{})
+	outputTags := make(map[string]string)
+
+	for key, value := range outputTagsInterface {
+		outputTags[key] = fmt.Sprintf("%v", value)
+	}
+	if len(inputTags) != len(outputTags) {
+		activityLog.Errorf("[kxanalogstats] Number of Input Tags do not match with number of Output Tags.")
+		return false, errors.New("[kxanalogstats] Number of Input Tags do not match with number of Output Tags")
+	}
+	qualityPolicy, _ := context.GetInput(ivQualityPolicy).(string)
+	qualityRule, err := kxcommon.ResolveQualityRule("kxanalogstats", qualityPolicy)
+	if err != nil {
+		activityLog.Errorf("[kxanalogstats] Invalid quality policy. Error %s", err)
+		return false, err
+	}
+	// statistics are calculated from raw points (client) or from buckets aggregated by the TSDB (server)
+	computation, _ := context.GetInput(ivComputation).(string)
+	serverSide := strings.ToLower(computation) == "server"
+	resolution := 60 * time.Second
+	if resolutionInput := context.GetInput(ivResolution); resolutionInput != nil && resolutionInput != "" {
+		seconds, err := kxcommon.ToFloat(resolutionInput)
+		if err != nil || seconds <= 0 {
+			activityLog.Errorf("[kxanalogstats] Invalid resolution %v", resolutionInput)
+			return false, fmt.Errorf("[kxanalogstats] Invalid resolution %v", resolutionInput)
+		}
+		resolution = time.Duration(seconds * float64(time.Second))
+	}
+
+	// Open the TSDB
+	tsdb := tsdbConfig.NewTSDB()
+	err = tsdb.OpenTSDB()
+	if err != nil {
+		activityLog.Errorf("[kxanalogstats] Time Stamp Database could not be opened. Error %s", err)
+		return false, err
+	}
+	// make sure it closes after finish
+	defer tsdb.CloseTSDB()
+
+	var response kxcommon.AnalyticsResponse
+	for key, comb := range inputTags {
+		tag := comb["tag"]
+		timeWindow, err := strconv.ParseFloat(comb["window"], 64)
+		if err != nil || timeWindow <= 0 {
+			activityLog.Warnf("[kxanalogstats] Time window for %s invalid: %s", tag, comb["window"])
+			response.Results = append(response.Results, kxcommon.AnalyticsArgNewTyped(key, kxcommon.FloatValue(0), kxcommon.QualityBad.String()))
+			continue
+		}
+		windowEndTime := time.Now().UTC()
+		windowStartTime := windowEndTime.Add(-time.Duration(timeWindow * float64(time.Second)))
+
+		var window kxcommon.TSWindow
+		if serverSide {
+			window, err = tsdb.QueryTSWindowDownsampled(databaseName, tableName, tag, windowStartTime, windowEndTime, resolution)
+		} else {
+			window, err = tsdb.QueryTSWindow(databaseName, tableName, tag, windowStartTime, windowEndTime)
+		}
+		if err != nil {
+			activityLog.Errorf("[kxanalogstats] Tag: %s could not be accessed from Time Stamp database. Error %s", tag, err)
+			return false, err
+		}
+		result, err := calculate(window, comb["function"], comb["param"])
+		if err != nil {
+			activityLog.Warnf("[kxanalogstats] %s of %s could not be calculated: %s", comb["function"], tag, err)
+			response.Results = append(response.Results, kxcommon.AnalyticsArgNewTyped(key, kxcommon.FloatValue(0), kxcommon.QualityBad.String()))
+			continue
+		}
+		activityLog.Debugf("[kxanalogstats] Tag: %s, %s: %f", tag, comb["function"], result)
+		quality := qualityRule.Propagate(window.QualityInputs())
+		response.Results = append(response.Results, kxcommon.AnalyticsArgNewTyped(key, kxcommon.FloatValue(result), quality.String()))
+	}
+	//
+	// Create the json scan message back to KXDataproc
+	//
+	scanMessage := kxcommon.ScanMessageNew()
+	for _,res := range response.Results {
+		quality, _ := kxcommon.GetQualityFromString(res.Quality)
+		smu := kxcommon.ScanMessageUnitNewTyped(-1, outputTags[res.Name], res.TypedValue(), res.Quality, kxcommon.MessageUnitTypeForQuality(quality), time.Now().UTC())
+		scanMessage.ScanMessageAdd(smu)
+	}
+	jsonMessage, err := kxcommon.SerializeObject(scanMessage)
+	if err != nil {
+		activityLog.Error(fmt.Sprintf("[kxanalogstats] Error trying to serialize output message. Error %s", err))
+		return false, err
+	}
+	activityLog.Debug(fmt.Sprintf("[kxanalogstats] Output Message: %s", jsonMessage))
+	context.SetOutput(ovOutput, jsonMessage)
+	// the same results, addressable one by one by the flow mappers
+	context.SetOutput(ovRecords, scanMessage.Records())
+	return true, nil
+}
+
+// calculate applies a statistics function to a time window. param is the percentile (0-100),
+// the state value for timeinstate or the time unit in seconds for integral (default 1)
+func calculate(window kxcommon.TSWindow, function string, param string) (float64, error) {
+	switch strings.ToLower(function) {
+	case fnMean, "":
+		return window.Mean()
+	case fnMin:
+		return window.Min()
+	case fnMax:
+		return window.Max()
+	case fnStdDev:
+		return window.StdDev()
+	case fnIntegral:
+		unit := 1.0
+		if param != "" {
+			var err error
+			if unit, err = strconv.ParseFloat(param, 64); err != nil {
+				return 0, fmt.Errorf("integral time unit %s is invalid", param)
+			}
+		}
+		return window.Integral(unit)
+	case fnTimeInState:
+		state, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return 0, fmt.Errorf("state %s is invalid", param)
+		}
+		return window.TimeInState(state)
+	case fnRateOfChange:
+		return window.RateOfChange()
+	case fnPercentile:
+		percentile, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return 0, fmt.Errorf("percentile %s is invalid", param)
+		}
+		return window.Percentile(percentile)
+	default:
+		return 0, fmt.Errorf("function %s is unknown", function)
+	}
+}
@@ -0,0 +1,66 @@
+package kxanalogstats
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/TIBCOSoftware/flogo-lib/core/activity"
+	"github.com/mtorre-iot/flogo-contrib/activity/kxcommon"
+)
+
+var activityMetadata *activity.Metadata
+
+func getActivityMetadata() *activity.Metadata {
+
+	if activityMetadata == nil {
+		jsonMetadataBytes, err := ioutil.ReadFile("activity.json")
+		if err != nil {
+			panic("No Json Metadata found for activity.json path")
+		}
+
+		activityMetadata = activity.NewMetadata(string(jsonMetadataBytes))
+	}
+
+	return activityMetadata
+}
+
+func TestCreate(t *testing.T) {
+
+	act := NewActivity(getActivityMetadata())
+
+	if act == nil {
+		t.Error("Activity Not Created")
+		t.Fail()
+		return
+	}
+}
+
+func TestCalculate(t *testing.T) {
+
+	start := time.Unix(0, 0)
+	window := kxcommon.TSWindow{Tag: "T1", Start: start, End: start.Add(10 * time.Second), Samples: []kxcommon.TSSample{
+		{TimeStamp: start, Value: 1},
+		{TimeStamp: start.Add(5 * time.Second), Value: 3},
+		{TimeStamp: start.Add(8 * time.Second), Value: 0},
+	}}
+	expected := map[string]float64{
+		"mean":         1.4,
+		"min":          0,
+		"max":          3,
+		"integral":     14,
+		"rateofchange": -0.125,
+	}
+	for function, value := range expected {
+		result, err := calculate(window, function, "")
+		if err != nil || result != value {
+			t.Errorf("%s: expected %f, got %f (%v)", function, value, result, err)
+		}
+	}
+	if result, _ := calculate(window, "timeinstate", "3"); result != 3 {
+		t.Errorf("timeinstate: expected 3, got %f", result)
+	}
+	if result, _ := calculate(window, "percentile", "50"); result != 1 {
+		t.Errorf("percentile: expected 1, got %f", result)
+	}
+}
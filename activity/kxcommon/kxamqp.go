@@ -0,0 +1,366 @@
+package kxcommon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// names of the optional broker connection settings, after their request/response prefix
+const (
+	amqpVHost          = "VHost"
+	amqpTLS            = "TLS"
+	amqpCACertFile     = "CACertFile"
+	amqpCertFile       = "CertFile"
+	amqpKeyFile        = "KeyFile"
+	amqpConnectionName = "ConnectionName"
+	amqpHeartbeat      = "Heartbeat"
+)
+
+// names of the message properties, as activity inputs, trigger outputs and flow replies
+const (
+	AMQPHeaders         = "headers"
+	AMQPContentType     = "contentType"
+	AMQPContentEncoding = "contentEncoding"
+	AMQPPersistent      = "persistent"
+	AMQPPriority        = "priority"
+	AMQPExpiration      = "expiration"
+	AMQPMessageID       = "messageId"
+	AMQPTimestamp       = "timestamp"
+)
+
+// AMQPProperties are the properties a message is published with
+type AMQPProperties struct {
+	Headers map[string]interface{} `json:",omitempty"`
+	// ContentType defaults to text/plain
+	ContentType     string `json:",omitempty"`
+	ContentEncoding string `json:",omitempty"`
+	// Persistent messages sent to durable queues survive a broker restart
+	Persistent bool `json:",omitempty"`
+	// Priority is 0 (default) to 255. Queues are usually declared with 10 levels at most
+	Priority uint8 `json:",omitempty"`
+	// Expiration is the time to live of the message, in milliseconds. Empty never expires
+	Expiration string `json:",omitempty"`
+	MessageID  string `json:",omitempty"`
+	Timestamp  time.Time
+}
+
+// AMQPPropertiesFromSettings reads the message properties named by the AMQP* constants. Missing or empty
+// settings are left unset
+func AMQPPropertiesFromSettings(get func(name string) interface{}) (AMQPProperties, error) {
+	var props AMQPProperties
+	isSet := func(value interface{}) bool {
+		return value != nil && value != ""
+	}
+	if headers := get(AMQPHeaders); isSet(headers) {
+		var ok bool
+		if headerStr, isString := headers.(string); isString {
+			// a JSON object
+			headers = nil
+			if err := json.Unmarshal([]byte(headerStr), &headers); err != nil {
+				return props, fmt.Errorf("Headers must be an object: %s", err)
+			}
+		}
+		if props.Headers, ok = headers.(map[string]interface{}); !ok {
+			return props, fmt.Errorf("Headers must be an object, not %T", headers)
+		}
+		if _, err := amqpTable(props.Headers); err != nil {
+			return props, err
+		}
+	}
+	props.ContentType, _ = get(AMQPContentType).(string)
+	props.ContentEncoding, _ = get(AMQPContentEncoding).(string)
+	if persistent := get(AMQPPersistent); isSet(persistent) {
+		value, err := ToBool(persistent)
+		if err != nil {
+			return props, fmt.Errorf("Persistent must be a boolean. Found '%v'", persistent)
+		}
+		props.Persistent = value
+	}
+	if priority := get(AMQPPriority); isSet(priority) {
+		value, err := ToFloat(priority)
+		if err != nil || value < 0 || value > 255 || value != float64(int(value)) {
+			return props, fmt.Errorf("Priority must be an integer from 0 to 255. Found '%v'", priority)
+		}
+		props.Priority = uint8(value)
+	}
+	if expiration := get(AMQPExpiration); isSet(expiration) {
+		value, err := ToFloat(expiration)
+		if err != nil || value < 0 || value != float64(int64(value)) {
+			return props, fmt.Errorf("Expiration must be a number of milliseconds. Found '%v'", expiration)
+		}
+		// 0 would expire the message unless a consumer takes it right away; it is read as no expiration
+		if value > 0 {
+			props.Expiration = strconv.FormatInt(int64(value), 10)
+		}
+	}
+	props.MessageID, _ = get(AMQPMessageID).(string)
+	switch timestamp := get(AMQPTimestamp).(type) {
+	case time.Time:
+		props.Timestamp = timestamp
+	case string:
+		if timestamp != "" {
+			value, err := time.Parse(time.RFC3339Nano, timestamp)
+			if err != nil {
+				return props, fmt.Errorf("Timestamp must be a RFC 3339 date. Found '%s'", timestamp)
+			}
+			props.Timestamp = value
+		}
+	}
+	return props, nil
+}
+
+// AMQPPropertiesFromDelivery gets the properties of a received message
+func AMQPPropertiesFromDelivery(d amqp.Delivery) AMQPProperties {
+	return AMQPProperties{
+		Headers:         map[string]interface{}(d.Headers),
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		Persistent:      d.DeliveryMode == amqp.Persistent,
+		Priority:        d.Priority,
+		Expiration:      d.Expiration,
+		MessageID:       d.MessageId,
+		Timestamp:       d.Timestamp,
+	}
+}
+
+// Outputs gets the properties by the names of the AMQP* constants. The timestamp is a RFC 3339 date, empty when unset
+func (props AMQPProperties) Outputs() map[string]interface{} {
+	timestamp := ""
+	if !props.Timestamp.IsZero() {
+		timestamp = props.Timestamp.Format(time.RFC3339Nano)
+	}
+	headers := props.Headers
+	if headers == nil {
+		headers = map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		AMQPHeaders:         headers,
+		AMQPContentType:     props.ContentType,
+		AMQPContentEncoding: props.ContentEncoding,
+		AMQPPersistent:      props.Persistent,
+		AMQPPriority:        int(props.Priority),
+		AMQPExpiration:      props.Expiration,
+		AMQPMessageID:       props.MessageID,
+		AMQPTimestamp:       timestamp,
+	}
+}
+
+// publishing builds the message to publish
+func (msg AMQPMessage) publishing() (amqp.Publishing, error) {
+	publishing := amqp.Publishing{
+		ContentType:   "text/plain",
+		CorrelationId: msg.CorrelationID,
+		ReplyTo:       msg.ReplyTo,
+		Body:          []byte(msg.Body),
+		DeliveryMode:  amqp.Transient,
+	}
+	props := msg.Properties
+	if props == nil {
+		publishing.Headers = amqp.Table{}
+		return publishing, nil
+	}
+	headers, err := amqpTable(props.Headers)
+	if err != nil {
+		return publishing, err
+	}
+	publishing.Headers = headers
+	if props.ContentType != "" {
+		publishing.ContentType = props.ContentType
+	}
+	publishing.ContentEncoding = props.ContentEncoding
+	if props.Persistent {
+		publishing.DeliveryMode = amqp.Persistent
+	}
+	publishing.Priority = props.Priority
+	publishing.Expiration = props.Expiration
+	publishing.MessageId = props.MessageID
+	publishing.Timestamp = props.Timestamp
+	return publishing, nil
+}
+
+// amqpTable converts headers into the field types AMQP can carry
+func amqpTable(headers map[string]interface{}) (amqp.Table, error) {
+	table := amqp.Table{}
+	for name, value := range headers {
+		field, err := amqpField(value)
+		if err != nil {
+			return nil, fmt.Errorf("Header '%s': %s", name, err)
+		}
+		table[name] = field
+	}
+	return table, table.Validate()
+}
+
+func amqpField(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return amqpFieldTable(v)
+	case amqp.Table:
+		return amqpFieldTable(map[string]interface{}(v))
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, item := range v {
+			field, err := amqpField(item)
+			if err != nil {
+				return nil, err
+			}
+			array[i] = field
+		}
+		return array, nil
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case nil, bool, byte, int16, int32, int64, float32, float64, string, []byte, amqp.Decimal, time.Time:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("type %T cannot be sent", value)
+	}
+}
+
+func amqpFieldTable(headers map[string]interface{}) (interface{}, error) {
+	table, err := amqpTable(headers)
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// AMQPConnectionConfig defines how to reach and log into the broker. All fields are comparable, so it can be
+// part of a pool key
+type AMQPConnectionConfig struct {
+	HostName string
+	// Port defaults to 5672, or 5671 with TLS
+	Port     int
+	UserName string
+	Password string
+	// VHost is the virtual host (default "/")
+	VHost string
+	// TLS connects with amqps. CACertFile verifies the broker (the system roots are used when empty);
+	// CertFile and KeyFile authenticate the client with a certificate
+	TLS        bool
+	CACertFile string
+	CertFile   string
+	KeyFile    string
+	// ConnectionName is shown by the broker management tools
+	ConnectionName string
+	// Heartbeat is the heartbeat interval asked to the broker (default 10s)
+	Heartbeat time.Duration
+}
+
+// ApplySettings reads the optional <prefix>VHost, <prefix>TLS, <prefix>CACertFile, <prefix>CertFile,
+// <prefix>KeyFile, <prefix>ConnectionName and <prefix>Heartbeat (seconds) settings. Missing or empty
+// settings keep their current value
+func (config *AMQPConnectionConfig) ApplySettings(prefix string, get func(name string) interface{}) error {
+	getString := func(name string) string {
+		value, _ := get(prefix + name).(string)
+		return value
+	}
+	if vhost := getString(amqpVHost); vhost != "" {
+		config.VHost = vhost
+	}
+	if useTLS := get(prefix + amqpTLS); useTLS != nil && useTLS != "" {
+		value, err := ToBool(useTLS)
+		if err != nil {
+			return fmt.Errorf("Setting '%s%s' must be a boolean. Found '%v'", prefix, amqpTLS, useTLS)
+		}
+		config.TLS = value
+	}
+	if caCertFile := getString(amqpCACertFile); caCertFile != "" {
+		config.CACertFile = caCertFile
+	}
+	if certFile := getString(amqpCertFile); certFile != "" {
+		config.CertFile = certFile
+	}
+	if keyFile := getString(amqpKeyFile); keyFile != "" {
+		config.KeyFile = keyFile
+	}
+	if connectionName := getString(amqpConnectionName); connectionName != "" {
+		config.ConnectionName = connectionName
+	}
+	if heartbeat := get(prefix + amqpHeartbeat); heartbeat != nil && heartbeat != "" {
+		seconds, err := ToFloat(heartbeat)
+		if err != nil || seconds < 1 {
+			return fmt.Errorf("Setting '%s%s' must be a number of seconds. Found '%v'", prefix, amqpHeartbeat, heartbeat)
+		}
+		config.Heartbeat = time.Duration(seconds * float64(time.Second))
+	}
+	return nil
+}
+
+// URI builds the broker URI. The virtual host is not part of it: Dial sets it apart, so it needs no escaping
+func (config AMQPConnectionConfig) URI() string {
+	scheme, port := "amqp", 5672
+	if config.TLS {
+		scheme, port = "amqps", 5671
+	}
+	if config.Port > 0 {
+		port = config.Port
+	}
+	uri := url.URL{
+		Scheme: scheme,
+		User:   url.UserPassword(config.UserName, config.Password),
+		Host:   config.HostName + ":" + strconv.Itoa(port),
+	}
+	return uri.String()
+}
+
+// Dial connects to the broker
+func (config AMQPConnectionConfig) Dial() (*amqp.Connection, error) {
+	amqpConfig := amqp.Config{
+		Vhost:      config.VHost,
+		Heartbeat:  config.Heartbeat,
+		Locale:     "en_US",
+		Properties: amqp.Table{},
+	}
+	if amqpConfig.Heartbeat <= 0 {
+		amqpConfig.Heartbeat = 10 * time.Second
+	}
+	if config.ConnectionName != "" {
+		amqpConfig.Properties["connection_name"] = config.ConnectionName
+	}
+	if config.TLS {
+		tlsConfig, err := config.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		amqpConfig.TLSClientConfig = tlsConfig
+	}
+	return amqp.DialConfig(config.URI(), amqpConfig)
+}
+
+// tlsConfig loads the CA and client certificates
+func (config AMQPConnectionConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if config.CACertFile != "" {
+		caCert, err := ioutil.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("CA certificate could not be read: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("CA certificate file %s holds no PEM certificate", config.CACertFile)
+		}
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Client certificate could not be loaded: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
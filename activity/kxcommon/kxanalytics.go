@@ -0,0 +1,276 @@
+package kxcommon
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AnalyticsAnyInput is the name of the input that takes every argument not declared by name, for functions with
+// any number of inputs (sum, min, max...)
+const AnalyticsAnyInput = "*"
+
+// AnalyticsFunctionIO describes an input or output of an analytics function. Inputs are converted to its type
+// before the function runs
+type AnalyticsFunctionIO struct {
+	Name        string
+	Type        ValueType
+	Description string
+}
+
+// AnalyticsFunctionMetadata describes an analytics function. Functions with a quality rule get it registered as
+// their default rule (see RegisterQualityRule)
+type AnalyticsFunctionMetadata struct {
+	Name        string
+	Description string
+	Inputs      []AnalyticsFunctionIO
+	Outputs     []AnalyticsFunctionIO
+	Params      []string
+	QualityRule *QualityRule
+}
+
+// AnalyticsFunction is an analytics calculation run in process, instead of by a remote analytics processor.
+// Eval gets the inputs by name, already converted to their declared types, and the function parameters
+type AnalyticsFunction interface {
+	Metadata() AnalyticsFunctionMetadata
+	Eval(inputs map[string]TypedValue, params map[string]string) (map[string]TypedValue, error)
+}
+
+// AnalyticsFunc is the calculation of an analytics function
+type AnalyticsFunc func(inputs map[string]TypedValue, params map[string]string) (map[string]TypedValue, error)
+
+type analyticsFunction struct {
+	metadata AnalyticsFunctionMetadata
+	eval     AnalyticsFunc
+}
+
+func (f *analyticsFunction) Metadata() AnalyticsFunctionMetadata {
+	return f.metadata
+}
+
+func (f *analyticsFunction) Eval(inputs map[string]TypedValue, params map[string]string) (map[string]TypedValue, error) {
+	return f.eval(inputs, params)
+}
+
+// AnalyticsFunctionNew creates an analytics function out of its metadata and calculation
+func AnalyticsFunctionNew(metadata AnalyticsFunctionMetadata, eval AnalyticsFunc) AnalyticsFunction {
+	return &analyticsFunction{metadata, eval}
+}
+
+var (
+	analyticsFunctions     = make(map[string]AnalyticsFunction)
+	analyticsFunctionsLock sync.RWMutex
+)
+
+// RegisterAnalyticsFunction adds a function to the registry. Names are unique
+func RegisterAnalyticsFunction(function AnalyticsFunction) error {
+	metadata := function.Metadata()
+	if metadata.Name == "" {
+		return fmt.Errorf("Analytics function must have a name")
+	}
+	if len(metadata.Outputs) == 0 {
+		return fmt.Errorf("Analytics function %s must have outputs", metadata.Name)
+	}
+	analyticsFunctionsLock.Lock()
+	defer analyticsFunctionsLock.Unlock()
+	if _, ok := analyticsFunctions[metadata.Name]; ok {
+		return fmt.Errorf("Analytics function %s is already registered", metadata.Name)
+	}
+	analyticsFunctions[metadata.Name] = function
+	if metadata.QualityRule != nil {
+		RegisterQualityRule(metadata.Name, *metadata.QualityRule)
+	}
+	return nil
+}
+
+// GetAnalyticsFunction gets a registered function
+func GetAnalyticsFunction(name string) (AnalyticsFunction, bool) {
+	analyticsFunctionsLock.RLock()
+	defer analyticsFunctionsLock.RUnlock()
+	function, ok := analyticsFunctions[name]
+	return function, ok
+}
+
+// AnalyticsFunctionNames gets the names of the registered functions, sorted
+func AnalyticsFunctionNames() []string {
+	analyticsFunctionsLock.RLock()
+	defer analyticsFunctionsLock.RUnlock()
+	names := make([]string, 0, len(analyticsFunctions))
+	for name := range analyticsFunctions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EvalAnalyticsRequest runs a request with its registered function. Results get the request quality, so inputs
+// qualities propagate as the activity rule decided. Results are in the order of the function outputs
+func EvalAnalyticsRequest(request AnalyticsRequest, params map[string]string) (AnalyticsResponse, error) {
+	function, ok := GetAnalyticsFunction(request.Function)
+	if !ok {
+		return AnalyticsResponse{}, fmt.Errorf("Analytics function %s is not registered", request.Function)
+	}
+	metadata := function.Metadata()
+	inputs, err := analyticsInputs(metadata, request.Args)
+	if err != nil {
+		return AnalyticsResponse{}, fmt.Errorf("%s: %s", metadata.Name, err)
+	}
+	outputs, err := function.Eval(inputs, params)
+	if err != nil {
+		return AnalyticsResponse{}, fmt.Errorf("%s: %s", metadata.Name, err)
+	}
+	quality := request.Quality
+	if quality == "" {
+		quality = QualityOk.String()
+	}
+	response := AnalyticsResponse{Success: true}
+	for _, output := range metadata.Outputs {
+		value, ok := outputs[output.Name]
+		if !ok {
+			continue
+		}
+		response.Results = append(response.Results, AnalyticsArgNewTyped(output.Name, value, quality))
+	}
+	return response, nil
+}
+
+// analyticsInputs matches the arguments of a request with the function inputs, converted to their types
+func analyticsInputs(metadata AnalyticsFunctionMetadata, args []AnalyticsArg) (map[string]TypedValue, error) {
+	byName := make(map[string]AnalyticsArg)
+	for _, arg := range args {
+		byName[arg.Name] = arg
+	}
+	inputs := make(map[string]TypedValue)
+	var anyInput *AnalyticsFunctionIO
+	for i, input := range metadata.Inputs {
+		if input.Name == AnalyticsAnyInput {
+			anyInput = &metadata.Inputs[i]
+			continue
+		}
+		arg, ok := byName[input.Name]
+		if !ok {
+			return nil, fmt.Errorf("input %s is missing", input.Name)
+		}
+		value, err := ConvertTypedValue(arg.TypedValue(), input.Type)
+		if err != nil {
+			return nil, fmt.Errorf("input %s: %s", input.Name, err)
+		}
+		inputs[input.Name] = value
+		delete(byName, input.Name)
+	}
+	if anyInput == nil {
+		return inputs, nil
+	}
+	if len(byName) == 0 {
+		return nil, fmt.Errorf("at least one input is needed")
+	}
+	for name, arg := range byName {
+		value, err := ConvertTypedValue(arg.TypedValue(), anyInput.Type)
+		if err != nil {
+			return nil, fmt.Errorf("input %s: %s", name, err)
+		}
+		inputs[name] = value
+	}
+	return inputs, nil
+}
+
+// ConvertTypedValue converts a value to another type, keeping its units. Text converts when it can be parsed
+func ConvertTypedValue(value TypedValue, valueType ValueType) (TypedValue, error) {
+	if value.Type == valueType {
+		return value, nil
+	}
+	var converted TypedValue
+	var err error
+	switch {
+	case value.Type == ValueTypeString:
+		converted, err = ParseTypedValue(valueType, value.Str)
+	case valueType == ValueTypeFloat:
+		converted = FloatValue(value.Float64())
+	case valueType == ValueTypeBool:
+		converted = BoolValue(value.Float64() != 0)
+	default:
+		converted, err = ParseTypedValue(valueType, value.String())
+	}
+	if err != nil {
+		return TypedValue{}, err
+	}
+	return converted.WithUnits(value.Units), nil
+}
+
+// AnalyticsExecution enum - where an analytics request runs
+type AnalyticsExecution int
+
+const (
+	AnalyticsExecutionAuto AnalyticsExecution = iota
+	AnalyticsExecutionLocal
+	AnalyticsExecutionRemote
+)
+
+func (execution AnalyticsExecution) String() string {
+	names := [...]string{
+		"auto",
+		"local",
+		"remote"}
+	if execution < AnalyticsExecutionAuto || execution > AnalyticsExecutionRemote {
+		return "auto"
+	}
+	return names[execution]
+}
+
+// GetAnalyticsExecutionFromString decodes an execution mode (auto, local or remote). Empty is auto
+func GetAnalyticsExecutionFromString(executionStr string) (AnalyticsExecution, error) {
+	switch strings.ToLower(strings.TrimSpace(executionStr)) {
+	case "", "auto":
+		return AnalyticsExecutionAuto, nil
+	case "local":
+		return AnalyticsExecutionLocal, nil
+	case "remote":
+		return AnalyticsExecutionRemote, nil
+	}
+	return AnalyticsExecutionAuto, fmt.Errorf("Execution %s is unknown", executionStr)
+}
+
+// RunsLocally checks if a request for a function runs in process: always for local, never for remote, and for auto
+// when the function is registered and the results have output tags to go to
+func (execution AnalyticsExecution) RunsLocally(function string, outputTags map[string]string) (bool, error) {
+	_, registered := GetAnalyticsFunction(function)
+	switch execution {
+	case AnalyticsExecutionRemote:
+		return false, nil
+	case AnalyticsExecutionLocal:
+		if !registered {
+			return false, fmt.Errorf("Analytics function %s is not registered", function)
+		}
+		if len(outputTags) == 0 {
+			return false, fmt.Errorf("Output tags are needed to run %s locally", function)
+		}
+		return true, nil
+	}
+	return registered && len(outputTags) > 0, nil
+}
+
+// ScanMessageFromAnalyticsResponse builds the scan message of the results of a request. outputTags maps the result
+// names to their tags; results without a tag are skipped
+func ScanMessageFromAnalyticsResponse(response AnalyticsResponse, outputTags map[string]string, timeStamp time.Time) ScanMessage {
+	scanMessage := ScanMessageNew()
+	for _, res := range response.Results {
+		tag, ok := outputTags[res.Name]
+		if !ok {
+			continue
+		}
+		quality, _ := GetQualityFromString(res.Quality)
+		scanMessage.ScanMessageAdd(ScanMessageUnitNewTyped(-1, tag, res.TypedValue(), res.Quality, MessageUnitTypeForQuality(quality), timeStamp))
+	}
+	return scanMessage
+}
+
+// StringParams converts the values of a params activity input to strings
+func StringParams(params map[string]interface{}) map[string]string {
+	strParams := make(map[string]string)
+	for key, value := range params {
+		strParams[key] = fmt.Sprintf("%v", value)
+	}
+	return strParams
+}
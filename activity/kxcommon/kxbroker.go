@@ -10,14 +10,11 @@ import (
 // AMQPExchange contains all parameters required to create or open an exchenge
 //
 type AMQPExchange struct {
-	Uri          string
-	HostName     string
+	Broker       AMQPConnectionConfig
 	ExchangeName string
 	ExchangeType string
 	QueueName    string
 	RoutingKey   string
-	UserName     string
-	Password     string
 	Durable      bool
 	AutoDelete   bool
 	Reliable     bool
@@ -27,6 +24,14 @@ type AMQPExchange struct {
 	Messages     []string
 	Confirms     chan amqp.Confirmation
 	IsOpen       bool
+	Exclusive    bool
+	AutoAck      bool
+	Prefetch     int
+	QueueArgs    amqp.Table
+	// Bindings are the routing keys the queue is bound with. Without bindings, RoutingKey is used
+	Bindings     []string
+	// publishLock serializes publishing, so each publish gets its own confirm
+	publishLock  sync.Mutex
 }
 
 var (
@@ -35,23 +40,29 @@ var (
 
 
 //
-// AMQPExchangeNew creates a new exchange in the Broker
+// AMQPExchangeNew creates a new exchange in the Broker. Other connection settings (vhost, TLS, connection name, heartbeat)
+// and queue settings can be set on the exchange before it is opened
 func AMQPExchangeNew(hostName string, port int, exchangeName string, exchangeType string, queueName string, routingKey string,
 	userName string, password string, durable bool, autoDelete bool, reliable bool) *AMQPExchange {
-	uri := buildURI(hostName, port, userName, password)
-	exch := AMQPExchange{uri, hostName, exchangeName, exchangeType, queueName, routingKey, userName, password, durable, autoDelete, reliable, nil, nil, nil, []string{}, nil, false}
-	return &exch
-}
-
-// buildURI creates the full broker URI string
-func buildURI(hostName string, port int, userName string, password string) string {
-	// "amqp://" + userName + ":" + password + "@" + hostName + ":5672"
-	return fmt.Sprintf("%s%s:%s@%s:%d", "amqp://", userName, password, hostName, port)
+	broker := AMQPConnectionConfig{HostName: hostName, Port: port, UserName: userName, Password: password}
+	return &AMQPExchange{
+		Broker:       broker,
+		ExchangeName: exchangeName,
+		ExchangeType: exchangeType,
+		QueueName:    queueName,
+		RoutingKey:   routingKey,
+		Durable:      durable,
+		AutoDelete:   autoDelete,
+		Reliable:     reliable,
+		Messages:     []string{},
+		Exclusive:    true,
+		AutoAck:      true,
+	}
 }
 
 // Open opens a previosly created Exchange
 func (exch *AMQPExchange) Open(isQueued bool) error {
-	conn, err := amqp.Dial(exch.Uri)
+	conn, err := exch.Broker.Dial()
 	if err != nil {
 		return fmt.Errorf("Connection: %s", err)
 	}
@@ -93,9 +104,9 @@ func (exch *AMQPExchange) Open(isQueued bool) error {
 			exch.QueueName,  // name
 			exch.Durable,    // durable
 			exch.AutoDelete, // delete when unused
-			true,            // exclusive
+			exch.Exclusive,  // exclusive
 			false,           // no-wait
-			nil,             // arguments
+			exch.QueueArgs,  // arguments
 		)
 		if err != nil {
 			exch.Connection.Close()
@@ -106,20 +117,37 @@ func (exch *AMQPExchange) Open(isQueued bool) error {
 			return fmt.Errorf("Queue Declare: %s", err)
 		}
 
-		if err = exch.Channel.QueueBind(
-			exch.QueueName,    // queue name
-			exch.RoutingKey,   // routing key
-			exch.ExchangeName, // exchange
-			false,
-			nil); err != nil {
-			exch.Connection.Close()
-			exch.Queue = nil
-			exch.Channel = nil
-			exch.Connection = nil
-			exch.IsOpen = false
-			return fmt.Errorf("Queue Bind: %s", err)
+		// the queue is bound once per binding. Without bindings, the exchange routing key is used
+		bindings := exch.Bindings
+		if len(bindings) == 0 {
+			bindings = []string{exch.RoutingKey}
+		}
+		for _, binding := range bindings {
+			if err = exch.Channel.QueueBind(
+				exch.QueueName,    // queue name
+				binding,           // routing key
+				exch.ExchangeName, // exchange
+				false,
+				nil); err != nil {
+				exch.Connection.Close()
+				exch.Queue = nil
+				exch.Channel = nil
+				exch.Connection = nil
+				exch.IsOpen = false
+				return fmt.Errorf("Queue Bind '%s': %s", binding, err)
+			}
 		}
 		exch.Queue = &queue
+		if exch.Prefetch > 0 && !exch.AutoAck {
+			if err = exch.Channel.Qos(exch.Prefetch, 0, false); err != nil {
+				exch.Connection.Close()
+				exch.Queue = nil
+				exch.Channel = nil
+				exch.Connection = nil
+				exch.IsOpen = false
+				return fmt.Errorf("Queue Qos: %s", err)
+			}
+		}
 	}
 	exch.IsOpen = true
 	return err
@@ -153,24 +181,40 @@ func (exch *AMQPExchange) PublishObject(obj interface{}) error {
 
 // Publish publishes a new message into an existing exchange
 func (exch *AMQPExchange) Publish(body string) error {
+	return exch.publish(exch.ExchangeName, AMQPMessage{RoutingKey: exch.RoutingKey, Body: body})
+}
+
+// PublishMessage publishes a new message, with its own routing key and properties, into an existing exchange
+func (exch *AMQPExchange) PublishMessage(msg AMQPMessage) error {
+	return exch.publish(exch.ExchangeName, msg)
+}
+
+// PublishReply publishes a reply straight to the queue named by the Reply To address of a request
+func (exch *AMQPExchange) PublishReply(replyTo string, msg AMQPMessage) error {
+	msg.RoutingKey = replyTo
+	return exch.publish("", msg)
+}
+
+func (exch *AMQPExchange) publish(exchangeName string, msg AMQPMessage) error {
+
+	publishing, err := msg.publishing()
+	if err != nil {
+		return err
+	}
+
+	exch.publishLock.Lock()
+	defer exch.publishLock.Unlock()
 
 	if (exch.Connection == nil) || (exch.IsOpen == false) {
 		return fmt.Errorf("Connection for exchange: " + exch.ExchangeName + " is not open")
 	}
 
 	if err := exch.Channel.Publish(
-		exch.ExchangeName, // publish to an exchange
-		exch.RoutingKey,   // routing to 0 or more queues
+		exchangeName,      // publish to an exchange
+		msg.RoutingKey,    // routing to 0 or more queues
 		false,             // mandatory
 		false,             // immediate
-		amqp.Publishing{
-			Headers:         amqp.Table{},
-			ContentType:     "text/plain",
-			ContentEncoding: "",
-			Body:            []byte(body),
-			DeliveryMode:    amqp.Transient, // 1=non-persistent, 2=persistent
-			Priority:        0,              // 0-9
-		},
+		publishing,
 	); err != nil {
 		exch.Connection.Close()
 		exch.IsOpen = false
@@ -190,8 +234,8 @@ func (exch *AMQPExchange) Publish(body string) error {
 func (exch *AMQPExchange) PrepareReceiveFunc(f func(msgs <-chan amqp.Delivery)) error {
 	msgs, err := exch.Channel.Consume(
 		exch.QueueName, // queue
-		"",             // consumer
-		true,           // auto ack
+		exch.QueueName, // consumer
+		exch.AutoAck,   // auto ack
 		false,          // exclusive
 		false,          // no local
 		false,          // no wait
@@ -210,6 +254,14 @@ func (exch *AMQPExchange) PrepareReceiveFunc(f func(msgs <-chan amqp.Delivery))
 	return nil
 }
 
+// Cancel stops the deliveries to the consumer. Deliveries already received can still be acked
+func (exch *AMQPExchange) Cancel() error {
+	if (exch.Channel == nil) || (exch.IsOpen == false) {
+		return fmt.Errorf("Channel for exchange: " + exch.ExchangeName + " is not open")
+	}
+	return exch.Channel.Cancel(exch.QueueName, false)
+}
+
 // ReadMessages reads the messajes accumulated in the queue
 func (exch *AMQPExchange) ReadMessages() ([]string, error) {
 	msgsLock.Lock()
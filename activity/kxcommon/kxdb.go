@@ -1,7 +1,11 @@
 package kxcommon
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"github.com/go-redis/redis"
 )
 
@@ -19,6 +23,8 @@ type RTDB struct {
 }
 
 var (
+	// ErrTagNotFound is reported for tags that have no object in RTDB
+	ErrTagNotFound = errors.New("Tag not found in Realtime Database")
 )
 // RTDBNew creates a new RT DB connection object
 func (rtdb *RTDB) RTDBNew (hostName string, port int, userName string, password string, defaultDB int, jsonField string) {
@@ -36,7 +42,7 @@ func (rtdb *RTDB) RTDBNew (hostName string, port int, userName string, password
 func (rtdb *RTDB) OpenRTDB() error {
 
 	client := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%d", rtdb.hostName, rtdb.port),
+		Addr:     net.JoinHostPort(rtdb.hostName, strconv.Itoa(rtdb.port)),
 		Password: rtdb.password, 
 		DB:       rtdb.defaultDB,
 	})
@@ -44,6 +50,7 @@ func (rtdb *RTDB) OpenRTDB() error {
 	_, err := client.Ping().Result()
 
 	if err != nil {
+		client.Close()
 		return err
 	}
 
@@ -54,6 +61,10 @@ func (rtdb *RTDB) OpenRTDB() error {
 
 // CloseRTDB closes the RealTime DB
 func (rtdb *RTDB) CloseRTDB() error {
+	if rtdb.client == nil {
+		return nil
+	}
+	rtdb.isConnected = false
 	return rtdb.client.Close()
 }
 
@@ -62,6 +73,20 @@ func (rtdb *RTDB) IsRTDBConnected() bool {
 	return rtdb.isConnected 
 }
 
+// PingRTDB checks the RealTime DB is still reachable
+func (rtdb *RTDB) PingRTDB() error {
+	if rtdb.client == nil {
+		return fmt.Errorf("RTDB %s:%d is not open", rtdb.hostName, rtdb.port)
+	}
+	_, err := rtdb.client.Ping().Result()
+	if err != nil {
+		rtdb.isConnected = false
+		return err
+	}
+	rtdb.isConnected = true
+	return nil
+}
+
 
 // GetRTPObject get RTpObject form RTDB (if exists)
 func (rtdb *RTDB) GetRTPObject(key string) (KXRTPObject, error) {
@@ -93,4 +118,118 @@ func (rtdb *RTDB) SetValueForKey(key string, value string) error {
 func (rtdb *RTDB) GetValueFromKey (key string) (string, error) {
 	stringCmd := rtdb.client.HGet(key, rtdb.jsonField)
 	return stringCmd.Result()
-}
\ No newline at end of file
+}
+
+// GetRTPObjects gets a batch of RTPObjects from RTDB in a single pipelined round trip.
+// Tags that could not be read or decoded are reported in the error map and left out of the result;
+// missing tags are reported as ErrTagNotFound.
+func (rtdb *RTDB) GetRTPObjects(keys []string) (map[string]KXRTPObject, map[string]error) {
+	rtpObjects := make(map[string]KXRTPObject, len(keys))
+	tagErrors := make(map[string]error)
+	if len(keys) == 0 {
+		return rtpObjects, tagErrors
+	}
+	pipe := rtdb.client.Pipeline()
+	cmds := make(map[string]*redis.StringCmd, len(keys))
+	for _, key := range keys {
+		cmds[key] = pipe.HGet(key, rtdb.jsonField)
+	}
+	// individual command errors are checked below
+	pipe.Exec()
+	pipe.Close()
+
+	for key, cmd := range cmds {
+		jsonStr, err := cmd.Result()
+		if err == redis.Nil {
+			tagErrors[key] = ErrTagNotFound
+			continue
+		}
+		if err != nil {
+			tagErrors[key] = err
+			continue
+		}
+		var rtpObject KXRTPObject
+		if err := rtpObject.Deserialize(jsonStr); err != nil {
+			tagErrors[key] = tagDecodeError{err}
+			continue
+		}
+		rtpObjects[key] = rtpObject
+	}
+	return rtpObjects, tagErrors
+}
+
+// tagDecodeError is reported for tags whose object could not be decoded
+type tagDecodeError struct {
+	err error
+}
+
+func (e tagDecodeError) Error() string {
+	return "Tag object could not be decoded: " + e.err.Error()
+}
+
+// HasConnectionError checks if a batch failed on the connection, not just on missing or undecodable tags,
+// so the pooled connection is only checked again when it may be broken
+func HasConnectionError(tagErrors map[string]error) bool {
+	for _, err := range tagErrors {
+		if _, decode := err.(tagDecodeError); err != ErrTagNotFound && !decode {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateRTPObjects updates a batch of RTPObjects into RTDB in a single pipelined round trip.
+// Tags that could not be serialized or written are reported in the error map; the rest are written.
+func (rtdb *RTDB) UpdateRTPObjects(rtpObjects map[string]KXRTPObject) map[string]error {
+	tagErrors := make(map[string]error)
+	if len(rtpObjects) == 0 {
+		return tagErrors
+	}
+	pipe := rtdb.client.Pipeline()
+	cmds := make(map[string]*redis.BoolCmd, len(rtpObjects))
+	for key, rtpObject := range rtpObjects {
+		jsonStr, err := rtpObject.Serialize()
+		if err != nil {
+			tagErrors[key] = err
+			continue
+		}
+		cmds[key] = pipe.HSet(key, rtdb.jsonField, jsonStr)
+	}
+	if len(cmds) > 0 {
+		pipe.Exec()
+	}
+	pipe.Close()
+
+	for key, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			tagErrors[key] = err
+		}
+	}
+	return tagErrors
+}
+
+// KeyspaceChannel returns the keyspace notification channel for keys matching a glob pattern
+func (rtdb *RTDB) KeyspaceChannel(keyPattern string) string {
+	return fmt.Sprintf("__keyspace@%d__:%s", rtdb.defaultDB, keyPattern)
+}
+
+// KeyFromKeyspaceChannel extracts the key from a keyspace notification channel name
+func (rtdb *RTDB) KeyFromKeyspaceChannel(channel string) string {
+	return strings.TrimPrefix(channel, rtdb.KeyspaceChannel(""))
+}
+
+// EnableKeyspaceNotifications configures RTDB to publish keyspace events for hash commands
+func (rtdb *RTDB) EnableKeyspaceNotifications() error {
+	return rtdb.client.ConfigSet("notify-keyspace-events", "Kh").Err()
+}
+
+// PSubscribe subscribes to all RTDB pub/sub channels matching the given patterns
+func (rtdb *RTDB) PSubscribe(patterns ...string) (*redis.PubSub, error) {
+	pubsub := rtdb.client.PSubscribe(patterns...)
+	// wait for the subscription to be confirmed
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	return pubsub, nil
+}
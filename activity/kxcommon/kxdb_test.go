@@ -0,0 +1,30 @@
+package kxcommon
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasConnectionError(t *testing.T) {
+
+	var obj KXRTPObject
+	decodeErr := tagDecodeError{obj.Deserialize("{")}
+
+	tests := []struct {
+		name      string
+		tagErrors map[string]error
+		expected  bool
+	}{
+		{"no errors", map[string]error{}, false},
+		{"missing tags", map[string]error{"T1": ErrTagNotFound, "T2": ErrTagNotFound}, false},
+		{"undecodable tag", map[string]error{"T1": decodeErr}, false},
+		{"connection error", map[string]error{"T1": errors.New("dial tcp: connection refused")}, true},
+		{"mixed", map[string]error{"T1": ErrTagNotFound, "T2": errors.New("i/o timeout")}, true},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, HasConnectionError(test.tagErrors), test.name)
+	}
+}
@@ -0,0 +1,242 @@
+package kxcommon
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Analytics functions run in process (see RegisterAnalyticsFunction). Single input functions read the "input"
+// argument; SUM, MIN, MAX, AND and OR take every argument
+const (
+	AnalyticsInput  = "input"
+	AnalyticsOutput = "output"
+)
+
+func init() {
+	for _, function := range []AnalyticsFunction{
+		AnalyticsFunctionNew(AnalyticsFunctionMetadata{
+			Name:        "SCALE",
+			Description: "Linear scaling: input * gain + offset, or input range [inMin, inMax] mapped onto [outMin, outMax]",
+			Inputs:      []AnalyticsFunctionIO{{AnalyticsInput, ValueTypeFloat, "Value to scale"}},
+			Outputs:     []AnalyticsFunctionIO{{AnalyticsOutput, ValueTypeFloat, "Scaled value"}},
+			Params:      []string{"gain", "offset", "inMin", "inMax", "outMin", "outMax", "units"},
+		}, scaleFunc),
+		AnalyticsFunctionNew(AnalyticsFunctionMetadata{
+			Name:        "LINEARIZE",
+			Description: "Piecewise linear interpolation on a table of x:y points, clamped at its ends",
+			Inputs:      []AnalyticsFunctionIO{{AnalyticsInput, ValueTypeFloat, "Value to linearize"}},
+			Outputs:     []AnalyticsFunctionIO{{AnalyticsOutput, ValueTypeFloat, "Linearized value"}},
+			Params:      []string{"table", "units"},
+		}, linearizeFunc),
+		numericFunctionNew("SUM", "Sum of the inputs", func(acc, v float64) float64 { return acc + v }),
+		numericFunctionNew("MIN", "Minimum of the inputs", func(acc, v float64) float64 {
+			if v < acc {
+				return v
+			}
+			return acc
+		}),
+		numericFunctionNew("MAX", "Maximum of the inputs", func(acc, v float64) float64 {
+			if v > acc {
+				return v
+			}
+			return acc
+		}),
+		logicFunctionNew("AND", "True when all the inputs are true", func(acc, v bool) bool { return acc && v }),
+		logicFunctionNew("OR", "True when any input is true", func(acc, v bool) bool { return acc || v }),
+		AnalyticsFunctionNew(AnalyticsFunctionMetadata{
+			Name:        "NOT",
+			Description: "Negation of the input",
+			Inputs:      []AnalyticsFunctionIO{{AnalyticsInput, ValueTypeBool, "Value to negate"}},
+			Outputs:     []AnalyticsFunctionIO{{AnalyticsOutput, ValueTypeBool, "Negated value"}},
+		}, func(inputs map[string]TypedValue, params map[string]string) (map[string]TypedValue, error) {
+			return map[string]TypedValue{AnalyticsOutput: BoolValue(!inputs[AnalyticsInput].Bool)}, nil
+		}),
+		AnalyticsFunctionNew(AnalyticsFunctionMetadata{
+			Name:        "LIMITCHECK",
+			Description: "Checks the input against a low and/or a high limit",
+			Inputs:      []AnalyticsFunctionIO{{AnalyticsInput, ValueTypeFloat, "Value to check"}},
+			Outputs: []AnalyticsFunctionIO{
+				{"high", ValueTypeBool, "Input above the high limit"},
+				{"low", ValueTypeBool, "Input below the low limit"},
+				{"alarm", ValueTypeBool, "Input out of limits"}},
+			Params: []string{"low", "high"},
+		}, limitCheckFunc),
+	} {
+		if err := RegisterAnalyticsFunction(function); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func scaleFunc(inputs map[string]TypedValue, params map[string]string) (map[string]TypedValue, error) {
+	input := inputs[AnalyticsInput]
+	var output float64
+	if params["inMin"] != "" || params["inMax"] != "" {
+		bounds := make(map[string]float64)
+		for _, name := range []string{"inMin", "inMax", "outMin", "outMax"} {
+			bound, ok, err := paramFloat(params, name)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fmt.Errorf("parameter %s is needed for range scaling", name)
+			}
+			bounds[name] = bound
+		}
+		if bounds["inMax"] == bounds["inMin"] {
+			return nil, fmt.Errorf("input range is empty")
+		}
+		output = bounds["outMin"] + (input.Float-bounds["inMin"])*(bounds["outMax"]-bounds["outMin"])/(bounds["inMax"]-bounds["inMin"])
+	} else {
+		gain, ok, err := paramFloat(params, "gain")
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			gain = 1
+		}
+		offset, _, err := paramFloat(params, "offset")
+		if err != nil {
+			return nil, err
+		}
+		output = input.Float*gain + offset
+	}
+	return map[string]TypedValue{AnalyticsOutput: FloatValue(output).WithUnits(outputUnits(params, input))}, nil
+}
+
+func linearizeFunc(inputs map[string]TypedValue, params map[string]string) (map[string]TypedValue, error) {
+	type point struct{ x, y float64 }
+	points := []point{}
+	for _, pair := range strings.Split(params["table"], ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		xy := strings.SplitN(pair, ":", 2)
+		if len(xy) != 2 {
+			return nil, fmt.Errorf("table point '%s' must be x:y", pair)
+		}
+		x, errx := strconv.ParseFloat(strings.TrimSpace(xy[0]), 64)
+		y, erry := strconv.ParseFloat(strings.TrimSpace(xy[1]), 64)
+		if errx != nil || erry != nil {
+			return nil, fmt.Errorf("table point '%s' must be numeric", pair)
+		}
+		points = append(points, point{x, y})
+	}
+	if len(points) < 2 {
+		return nil, fmt.Errorf("table must have at least 2 points")
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].x < points[j].x })
+
+	input := inputs[AnalyticsInput]
+	output := points[len(points)-1].y
+	if input.Float <= points[0].x {
+		output = points[0].y
+	} else {
+		for i := 1; i < len(points); i++ {
+			if input.Float <= points[i].x {
+				p0, p1 := points[i-1], points[i]
+				output = p0.y + (input.Float-p0.x)*(p1.y-p0.y)/(p1.x-p0.x)
+				break
+			}
+		}
+	}
+	return map[string]TypedValue{AnalyticsOutput: FloatValue(output).WithUnits(outputUnits(params, input))}, nil
+}
+
+func limitCheckFunc(inputs map[string]TypedValue, params map[string]string) (map[string]TypedValue, error) {
+	low, hasLow, err := paramFloat(params, "low")
+	if err != nil {
+		return nil, err
+	}
+	high, hasHigh, err := paramFloat(params, "high")
+	if err != nil {
+		return nil, err
+	}
+	if !hasLow && !hasHigh {
+		return nil, fmt.Errorf("a low or a high limit is needed")
+	}
+	input := inputs[AnalyticsInput].Float
+	isHigh := hasHigh && input > high
+	isLow := hasLow && input < low
+	return map[string]TypedValue{
+		"high":  BoolValue(isHigh),
+		"low":   BoolValue(isLow),
+		"alarm": BoolValue(isHigh || isLow),
+	}, nil
+}
+
+// numericFunctionNew creates a function folding any number of numeric inputs. The output keeps the units of the
+// inputs when they all have the same
+func numericFunctionNew(name string, description string, fold func(acc, v float64) float64) AnalyticsFunction {
+	return AnalyticsFunctionNew(AnalyticsFunctionMetadata{
+		Name:        name,
+		Description: description,
+		Inputs:      []AnalyticsFunctionIO{{AnalyticsAnyInput, ValueTypeFloat, "Values"}},
+		Outputs:     []AnalyticsFunctionIO{{AnalyticsOutput, ValueTypeFloat, description}},
+	}, func(inputs map[string]TypedValue, params map[string]string) (map[string]TypedValue, error) {
+		first := true
+		var acc float64
+		units := ""
+		for _, name := range sortedInputNames(inputs) {
+			input := inputs[name]
+			if first {
+				acc, units, first = input.Float, input.Units, false
+				continue
+			}
+			acc = fold(acc, input.Float)
+			if input.Units != units {
+				units = ""
+			}
+		}
+		return map[string]TypedValue{AnalyticsOutput: FloatValue(acc).WithUnits(units)}, nil
+	})
+}
+
+// logicFunctionNew creates a function folding any number of boolean inputs
+func logicFunctionNew(name string, description string, fold func(acc, v bool) bool) AnalyticsFunction {
+	return AnalyticsFunctionNew(AnalyticsFunctionMetadata{
+		Name:        name,
+		Description: description,
+		Inputs:      []AnalyticsFunctionIO{{AnalyticsAnyInput, ValueTypeBool, "Values"}},
+		Outputs:     []AnalyticsFunctionIO{{AnalyticsOutput, ValueTypeBool, description}},
+	}, func(inputs map[string]TypedValue, params map[string]string) (map[string]TypedValue, error) {
+		names := sortedInputNames(inputs)
+		acc := inputs[names[0]].Bool
+		for _, name := range names[1:] {
+			acc = fold(acc, inputs[name].Bool)
+		}
+		return map[string]TypedValue{AnalyticsOutput: BoolValue(acc)}, nil
+	})
+}
+
+func sortedInputNames(inputs map[string]TypedValue) []string {
+	names := make([]string, 0, len(inputs))
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// paramFloat gets a numeric parameter, and whether it was given
+func paramFloat(params map[string]string, name string) (float64, bool, error) {
+	str := strings.TrimSpace(params[name])
+	if str == "" {
+		return 0, false, nil
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("parameter %s must be a number. Found '%s'", name, str)
+	}
+	return value, true, nil
+}
+
+// outputUnits gets the units parameter, or else the units of the input
+func outputUnits(params map[string]string, input TypedValue) string {
+	if units, ok := params["units"]; ok {
+		return units
+	}
+	return input.Units
+}
@@ -0,0 +1,164 @@
+package kxcommon
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func evalFunction(t *testing.T, name string, input TypedValue, params map[string]string) (map[string]TypedValue, error) {
+	function, ok := GetAnalyticsFunction(name)
+	assert.True(t, ok, name)
+	return function.Eval(map[string]TypedValue{AnalyticsInput: input}, params)
+}
+
+func TestScaleFunction(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		input    TypedValue
+		params   map[string]string
+		expected float64
+		units    string
+		fails    bool
+	}{
+		{"gain and offset", FloatValue(10), map[string]string{"gain": "2", "offset": "1"}, 21, "", false},
+		{"default gain", FloatValue(10).WithUnits("m"), map[string]string{"offset": "-5"}, 5, "m", false},
+		{"range mid", FloatValue(12), map[string]string{"inMin": "4", "inMax": "20", "outMin": "0", "outMax": "100", "units": "%"}, 50, "%", false},
+		{"range low end", FloatValue(4), map[string]string{"inMin": "4", "inMax": "20", "outMin": "0", "outMax": "100"}, 0, "", false},
+		{"range high end", FloatValue(20), map[string]string{"inMin": "4", "inMax": "20", "outMin": "0", "outMax": "100"}, 100, "", false},
+		{"range out of bounds", FloatValue(24), map[string]string{"inMin": "4", "inMax": "20", "outMin": "0", "outMax": "100"}, 125, "", false},
+		{"range missing bound", FloatValue(12), map[string]string{"inMin": "4", "inMax": "20", "outMin": "0"}, 0, "", true},
+		{"empty range", FloatValue(12), map[string]string{"inMin": "4", "inMax": "4", "outMin": "0", "outMax": "100"}, 0, "", true},
+		{"invalid gain", FloatValue(12), map[string]string{"gain": "abc"}, 0, "", true},
+	}
+
+	for _, test := range tests {
+		outputs, err := evalFunction(t, "SCALE", test.input, test.params)
+		if test.fails {
+			assert.NotNil(t, err, test.name)
+			continue
+		}
+		assert.Nil(t, err, test.name)
+		assert.InDelta(t, test.expected, outputs[AnalyticsOutput].Float, 1e-9, test.name)
+		assert.Equal(t, test.units, outputs[AnalyticsOutput].Units, test.name)
+	}
+}
+
+func TestLinearizeFunction(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		table    string
+		input    float64
+		expected float64
+		fails    bool
+	}{
+		{"first segment", "0:0, 10:100, 20:150", 5, 50, false},
+		{"second segment", "0:0, 10:100, 20:150", 15, 125, false},
+		{"on a point", "0:0, 10:100, 20:150", 10, 100, false},
+		{"clamped low", "0:0, 10:100, 20:150", -5, 0, false},
+		{"clamped high", "0:0, 10:100, 20:150", 30, 150, false},
+		{"unsorted table", "20:150, 0:0, 10:100", 15, 125, false},
+		{"one point", "0:0", 5, 0, true},
+		{"not a pair", "0:0, 10", 5, 0, true},
+		{"not numeric", "0:0, a:b", 5, 0, true},
+	}
+
+	for _, test := range tests {
+		outputs, err := evalFunction(t, "LINEARIZE", FloatValue(test.input), map[string]string{"table": test.table})
+		if test.fails {
+			assert.NotNil(t, err, test.name)
+			continue
+		}
+		assert.Nil(t, err, test.name)
+		assert.InDelta(t, test.expected, outputs[AnalyticsOutput].Float, 1e-9, test.name)
+	}
+}
+
+func TestLimitCheckFunction(t *testing.T) {
+
+	tests := []struct {
+		name                    string
+		input                   float64
+		params                  map[string]string
+		high, low, alarm, fails bool
+	}{
+		{"within limits", 50, map[string]string{"low": "10", "high": "90"}, false, false, false, false},
+		{"above high", 95, map[string]string{"low": "10", "high": "90"}, true, false, true, false},
+		{"below low", 5, map[string]string{"low": "10", "high": "90"}, false, true, true, false},
+		{"on the limit", 90, map[string]string{"low": "10", "high": "90"}, false, false, false, false},
+		{"high only", 5, map[string]string{"high": "90"}, false, false, false, false},
+		{"low only", 5, map[string]string{"low": "10"}, false, true, true, false},
+		{"no limits", 5, map[string]string{}, false, false, false, true},
+		{"invalid limit", 5, map[string]string{"low": "x"}, false, false, false, true},
+	}
+
+	for _, test := range tests {
+		outputs, err := evalFunction(t, "LIMITCHECK", FloatValue(test.input), test.params)
+		if test.fails {
+			assert.NotNil(t, err, test.name)
+			continue
+		}
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, test.high, outputs["high"].Bool, test.name)
+		assert.Equal(t, test.low, outputs["low"].Bool, test.name)
+		assert.Equal(t, test.alarm, outputs["alarm"].Bool, test.name)
+	}
+}
+
+func TestAnalyticsInputs(t *testing.T) {
+
+	function, _ := GetAnalyticsFunction("SCALE")
+
+	// text arguments are converted to the input type
+	inputs, err := analyticsInputs(function.Metadata(), []AnalyticsArg{AnalyticsArgNew(AnalyticsInput, "12.5", "OK")})
+	assert.Nil(t, err)
+	assert.Equal(t, ValueTypeFloat, inputs[AnalyticsInput].Type)
+	assert.Equal(t, 12.5, inputs[AnalyticsInput].Float)
+
+	_, err = analyticsInputs(function.Metadata(), []AnalyticsArg{AnalyticsArgNew("other", "1", "OK")})
+	assert.NotNil(t, err)
+
+	// the '*' input takes every argument
+	function, _ = GetAnalyticsFunction("SUM")
+	args := []AnalyticsArg{AnalyticsArgNew("a", "1", "OK"), AnalyticsArgNew("b", "2", "OK"), AnalyticsArgNew("c", "3", "OK")}
+	inputs, err = analyticsInputs(function.Metadata(), args)
+	assert.Nil(t, err)
+	assert.Len(t, inputs, 3)
+
+	_, err = analyticsInputs(function.Metadata(), nil)
+	assert.NotNil(t, err)
+
+	function, _ = GetAnalyticsFunction("AND")
+	_, err = analyticsInputs(function.Metadata(), []AnalyticsArg{AnalyticsArgNewTyped("a", StringValue("maybe"), "OK")})
+	assert.NotNil(t, err)
+}
+
+func TestEvalAnalyticsRequest(t *testing.T) {
+
+	tests := []struct {
+		function string
+		args     []AnalyticsArg
+		expected TypedValue
+	}{
+		{"SUM", []AnalyticsArg{AnalyticsArgNewTyped("a", FloatValue(1).WithUnits("kW"), "OK"), AnalyticsArgNewTyped("b", FloatValue(2).WithUnits("kW"), "OK")}, FloatValue(3).WithUnits("kW")},
+		{"SUM", []AnalyticsArg{AnalyticsArgNewTyped("a", FloatValue(1).WithUnits("kW"), "OK"), AnalyticsArgNewTyped("b", FloatValue(2).WithUnits("W"), "OK")}, FloatValue(3)},
+		{"MIN", []AnalyticsArg{AnalyticsArgNew("a", "4", "OK"), AnalyticsArgNew("b", "-2", "OK"), AnalyticsArgNew("c", "7", "OK")}, FloatValue(-2)},
+		{"MAX", []AnalyticsArg{AnalyticsArgNew("a", "4", "OK"), AnalyticsArgNew("b", "-2", "OK"), AnalyticsArgNew("c", "7", "OK")}, FloatValue(7)},
+		{"AND", []AnalyticsArg{AnalyticsArgNewTyped("a", BoolValue(true), "OK"), AnalyticsArgNewTyped("b", BoolValue(false), "OK")}, BoolValue(false)},
+		{"OR", []AnalyticsArg{AnalyticsArgNewTyped("a", BoolValue(true), "OK"), AnalyticsArgNewTyped("b", BoolValue(false), "OK")}, BoolValue(true)},
+		{"NOT", []AnalyticsArg{AnalyticsArgNewTyped(AnalyticsInput, BoolValue(true), "OK")}, BoolValue(false)},
+	}
+
+	for _, test := range tests {
+		response, err := EvalAnalyticsRequest(AnalyticsRequest{Function: test.function, Args: test.args, Quality: "OLD"}, nil)
+		assert.Nil(t, err, test.function)
+		assert.Len(t, response.Results, 1, test.function)
+		assert.Equal(t, test.expected, response.Results[0].TypedValue(), test.function)
+		assert.Equal(t, "OLD", response.Results[0].Quality, test.function)
+	}
+
+	_, err := EvalAnalyticsRequest(AnalyticsRequest{Function: "UNKNOWN"}, nil)
+	assert.NotNil(t, err)
+}
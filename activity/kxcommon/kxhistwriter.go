@@ -0,0 +1,523 @@
+package kxcommon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb "github.com/influxdata/influxdb1-client/v2"
+)
+
+// history keys, shared by raw data and derived analytics results
+const (
+	histPTypeKey      = "ptype"
+	histValueField    = "value"
+	histValueStrField = "valueStr"
+	histQualityField  = "quality"
+	histVTypeField    = "vtype"
+	histUnitsField    = "units"
+)
+
+// histMaxPending caps the records kept in memory for a writer without a buffer file while the TSDB is unreachable
+const histMaxPending = 10000
+
+// tsPrecisions write precisions accepted by the TSDB
+var tsPrecisions = map[string]string{
+	"": "ns", "ns": "ns", "n": "ns", "u": "u", "us": "u", "ms": "ms", "s": "s",
+}
+
+// GetPrecisionFromString validates a write precision (ns, us, ms, s). Empty means ns
+func GetPrecisionFromString(precision string) (string, error) {
+	rtn, ok := tsPrecisions[strings.ToLower(strings.TrimSpace(precision))]
+	if !ok {
+		return "", fmt.Errorf("Precision %s is not supported", precision)
+	}
+	return rtn, nil
+}
+
+// KXHistTSRecordNew creates a new history record
+func KXHistTSRecordNew(tag string, ptype string, value float64, valueStr string, quality string, timeStamp time.Time) KXHistTSRecord {
+	return KXHistTSRecord{Tag: tag, PType: ptype, Value: value, ValueStr: valueStr, Quality: quality, TimeStamp: timeStamp}
+}
+
+// KXHistTSRecordNewTyped creates a new history record out of a typed value. Value is its numeric view, and non float
+// values also keep their text in ValueStr
+func KXHistTSRecordNewTyped(tag string, ptype string, value TypedValue, quality string, timeStamp time.Time) KXHistTSRecord {
+	record := KXHistTSRecord{Tag: tag, PType: ptype, Value: value.Float64(), Quality: quality, TimeStamp: timeStamp,
+		VType: value.Type, Units: value.Units}
+	if value.Type != ValueTypeFloat {
+		record.ValueStr = value.String()
+	}
+	return record
+}
+
+// KXHistTSRecordFromScanMessageUnit creates a history record out of a scan message unit. Non numeric values are kept in ValueStr
+func KXHistTSRecordFromScanMessageUnit(smu ScanMessageUnit) KXHistTSRecord {
+	record := KXHistTSRecordNewTyped(smu.Tag, "", smu.TypedValue(), smu.Quality, smu.TimeStamp)
+	if record.Quality == "" {
+		record.Quality = QualityUnknown.String()
+	}
+	if record.TimeStamp.IsZero() {
+		record.TimeStamp = time.Now().UTC()
+	}
+	return record
+}
+
+// point converts a history record into a TSDB point of the given table
+func (record KXHistTSRecord) point(table string) (*influxdb.Point, error) {
+	tags := map[string]string{tsTagKey: record.Tag}
+	if record.PType != "" {
+		tags[histPTypeKey] = record.PType
+	}
+	fields := map[string]interface{}{
+		histValueField:   record.Value,
+		histQualityField: record.Quality,
+	}
+	if record.ValueStr != "" {
+		fields[histValueStrField] = record.ValueStr
+	}
+	if record.VType != ValueTypeFloat {
+		fields[histVTypeField] = record.VType.String()
+	}
+	if record.Units != "" {
+		fields[histUnitsField] = record.Units
+	}
+	return influxdb.NewPoint(table, tags, fields, record.TimeStamp)
+}
+
+// TypedValueFromRecord decodes the typed value of a history record read back from the TSDB, with its "value" and
+// optional "valueStr", "vtype" and "units" columns. Records written before types existed are floats
+func TypedValueFromRecord(record map[string]interface{}) (TypedValue, error) {
+	units, _ := record[histUnitsField].(string)
+	valueType := ValueTypeFloat
+	if vtypeStr, ok := record[histVTypeField].(string); ok {
+		var err error
+		if valueType, err = GetValueTypeFromString(vtypeStr); err != nil {
+			return TypedValue{}, err
+		}
+	}
+	if valueStr, ok := record[histValueStrField].(string); ok && valueStr != "" {
+		if valueType == ValueTypeFloat {
+			// untyped text values
+			if _, err := strconv.ParseFloat(valueStr, 64); err != nil {
+				return StringValue(valueStr).WithUnits(units), nil
+			}
+		}
+		value, err := ParseTypedValue(valueType, valueStr)
+		return value.WithUnits(units), err
+	}
+	switch v := record[histValueField].(type) {
+	case json.Number:
+		value, err := ParseTypedValue(valueType, v.String())
+		return value.WithUnits(units), err
+	case float64:
+		value, err := ParseTypedValue(valueType, strconv.FormatFloat(v, 'f', -1, 64))
+		return value.WithUnits(units), err
+	}
+	return TypedValue{}, fmt.Errorf("value is invalid %v", record[histValueField])
+}
+
+// Validate checks that a history record can be stored by the TSDB
+func (record KXHistTSRecord) Validate() error {
+	if record.Tag == "" {
+		return errors.New("History record has no tag")
+	}
+	if math.IsNaN(record.Value) || math.IsInf(record.Value, 0) {
+		return fmt.Errorf("History record for %s has an invalid value %f", record.Tag, record.Value)
+	}
+	return nil
+}
+
+// InvalidHistRecordsError reports the records dropped because the TSDB cannot store them. The rest of their batch is written
+type InvalidHistRecordsError struct {
+	Records []KXHistTSRecord
+	Err     error
+}
+
+func (e *InvalidHistRecordsError) Error() string {
+	return fmt.Sprintf("%d invalid history records dropped. First error: %s", len(e.Records), e.Err)
+}
+
+// WritePoints writes history records into a table as a single batch. precision (ns, us, ms, s) is the time stamp resolution sent.
+// Invalid records are skipped and reported with an InvalidHistRecordsError once the others are written
+func (tsdb *TSDB) WritePoints(database string, table string, precision string, records []KXHistTSRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	precision, err := GetPrecisionFromString(precision)
+	if err != nil {
+		return err
+	}
+	bp, err := influxdb.NewBatchPoints(influxdb.BatchPointsConfig{Database: database, Precision: precision})
+	if err != nil {
+		return err
+	}
+	var invalid *InvalidHistRecordsError
+	for _, record := range records {
+		err := record.Validate()
+		if err == nil {
+			var pt *influxdb.Point
+			if pt, err = record.point(table); err == nil {
+				bp.AddPoint(pt)
+				continue
+			}
+			err = fmt.Errorf("History record for %s is invalid: %s", record.Tag, err)
+		}
+		if invalid == nil {
+			invalid = &InvalidHistRecordsError{Err: err}
+		}
+		invalid.Records = append(invalid.Records, record)
+	}
+	if len(bp.Points()) > 0 {
+		if err := tsdb.connection.Write(bp); err != nil {
+			return err
+		}
+	}
+	if invalid != nil {
+		return invalid
+	}
+	return nil
+}
+
+// HistBuffer is a local on-disk buffer (one JSON record per line) of history records that could not be written
+type HistBuffer struct {
+	fileName string
+	lock     sync.Mutex
+}
+
+// HistBufferNew creates a new history buffer on a file. The file is created on first use
+func HistBufferNew(fileName string) *HistBuffer {
+	return &HistBuffer{fileName: fileName}
+}
+
+// Append adds records at the end of the buffer
+func (buffer *HistBuffer) Append(records []KXHistTSRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	return writeHistFile(buffer.fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, records)
+}
+
+// writeHistFile writes records as JSON lines and syncs them to disk
+func writeHistFile(fileName string, flag int, records []KXHistTSRecord) error {
+	file, err := os.OpenFile(fileName, flag, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// read gets all the buffered records. A missing file is an empty buffer
+func (buffer *HistBuffer) read() ([]KXHistTSRecord, error) {
+	file, err := os.Open(buffer.fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []KXHistTSRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var record KXHistTSRecord
+		// a line cut by a crash while appending is dropped
+		if err := json.Unmarshal(line, &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// Backfill writes the buffered records in batches of batchSize. The ones written are removed from the buffer,
+// the rest stay for a later backfill. It returns how many records were written
+func (buffer *HistBuffer) Backfill(write func([]KXHistTSRecord) error, batchSize int) (int, error) {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+
+	records, err := buffer.read()
+	if err != nil || len(records) == 0 {
+		return 0, err
+	}
+	if batchSize <= 0 {
+		batchSize = len(records)
+	}
+	written := 0
+	for written < len(records) {
+		end := written + batchSize
+		if end > len(records) {
+			end = len(records)
+		}
+		if err = write(records[written:end]); err != nil {
+			break
+		}
+		written = end
+	}
+	if written == 0 {
+		return 0, err
+	}
+	if written == len(records) {
+		return written, os.Remove(buffer.fileName)
+	}
+	// replace the buffer with what is left
+	tmpName := buffer.fileName + ".tmp"
+	if tmpErr := writeHistFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, records[written:]); tmpErr != nil {
+		return written, tmpErr
+	}
+	if renameErr := os.Rename(tmpName, buffer.fileName); renameErr != nil {
+		return written, renameErr
+	}
+	return written, err
+}
+
+// HistWriterConfig defines where and how a history writer writes
+type HistWriterConfig struct {
+	Database      string
+	Table         string
+	Precision     string
+	BatchSize     int
+	FlushInterval time.Duration
+	// BufferFile keeps the records on disk while the TSDB is unreachable. Empty keeps them in memory only
+	BufferFile string
+}
+
+// HistWriter batches history records and writes them when the batch is full or the flush interval elapses
+type HistWriter struct {
+	tsdb    *TSDB
+	config  HistWriterConfig
+	buffer  *HistBuffer
+	pending []KXHistTSRecord
+	lock    sync.Mutex
+	stop    chan struct{}
+	lastErr error
+	dropped int
+}
+
+// histWriterKey identifies a shared history writer
+type histWriterKey struct {
+	tsdb   TSDBConfig
+	writer HistWriterConfig
+}
+
+var (
+	histWriters     = make(map[histWriterKey]*HistWriter)
+	histWritersLock sync.Mutex
+)
+
+// HistWriterNew creates a new history writer on an open TSDB
+func HistWriterNew(tsdb *TSDB, config HistWriterConfig) (*HistWriter, error) {
+	precision, err := GetPrecisionFromString(config.Precision)
+	if err != nil {
+		return nil, err
+	}
+	config.Precision = precision
+	if config.Database == "" || config.Table == "" {
+		return nil, errors.New("History writer needs a database and a table")
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	writer := &HistWriter{tsdb: tsdb, config: config, stop: make(chan struct{})}
+	if config.BufferFile != "" {
+		writer.buffer = HistBufferNew(config.BufferFile)
+	}
+	if config.FlushInterval > 0 {
+		go writer.flushLoop()
+	}
+	return writer, nil
+}
+
+// GetPooledHistWriter gets the shared history writer of a TSDB and configuration, creating it on first use
+func GetPooledHistWriter(tsdbConfig TSDBConfig, config HistWriterConfig) (*HistWriter, error) {
+	key := histWriterKey{tsdbConfig, config}
+
+	histWritersLock.Lock()
+	defer histWritersLock.Unlock()
+
+	if writer, ok := histWriters[key]; ok {
+		return writer, nil
+	}
+	tsdb := tsdbConfig.NewTSDB()
+	if err := tsdb.OpenTSDB(); err != nil {
+		return nil, err
+	}
+	writer, err := HistWriterNew(tsdb, config)
+	if err != nil {
+		tsdb.CloseTSDB()
+		return nil, err
+	}
+	histWriters[key] = writer
+	return writer, nil
+}
+
+// CloseHistWriters flushes and closes all the shared history writers. Called when the engine stops
+func CloseHistWriters() error {
+	histWritersLock.Lock()
+	defer histWritersLock.Unlock()
+
+	var rtn error
+	for key, writer := range histWriters {
+		if err := writer.Close(); err != nil {
+			rtn = err
+		}
+		delete(histWriters, key)
+	}
+	return rtn
+}
+
+func (writer *HistWriter) flushLoop() {
+	ticker := time.NewTicker(writer.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			writer.Flush()
+		case <-writer.stop:
+			return
+		}
+	}
+}
+
+// Write queues records, flushing when the batch is full. Invalid records are not queued, they are reported
+// with an InvalidHistRecordsError
+func (writer *HistWriter) Write(records ...KXHistTSRecord) error {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+
+	var invalid *InvalidHistRecordsError
+	for _, record := range records {
+		if err := record.Validate(); err != nil {
+			if invalid == nil {
+				invalid = &InvalidHistRecordsError{Err: err}
+			}
+			invalid.Records = append(invalid.Records, record)
+			continue
+		}
+		writer.pending = append(writer.pending, record)
+	}
+	if invalid != nil {
+		writer.dropped += len(invalid.Records)
+	}
+	if len(writer.pending) >= writer.config.BatchSize {
+		if err := writer.flushLocked(); err != nil {
+			return err
+		}
+	}
+	if invalid != nil {
+		return invalid
+	}
+	return nil
+}
+
+// Flush writes the buffered and queued records now
+func (writer *HistWriter) Flush() error {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	return writer.flushLocked()
+}
+
+// Pending gets the number of records queued in memory
+func (writer *HistWriter) Pending() int {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	return len(writer.pending)
+}
+
+// Dropped gets the number of invalid records dropped so far
+func (writer *HistWriter) Dropped() int {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	return writer.dropped
+}
+
+// LastError gets the error of the last flush, nil if it succeeded
+func (writer *HistWriter) LastError() error {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	return writer.lastErr
+}
+
+// Close stops the interval flush and writes what is left
+func (writer *HistWriter) Close() error {
+	close(writer.stop)
+	err := writer.Flush()
+	writer.tsdb.CloseTSDB()
+	return err
+}
+
+// writeBatch writes a batch. Invalid records are counted as dropped, so only write errors keep a batch for backfill
+func (writer *HistWriter) writeBatch(records []KXHistTSRecord) error {
+	err := writer.tsdb.WritePoints(writer.config.Database, writer.config.Table, writer.config.Precision, records)
+	if invalid, ok := err.(*InvalidHistRecordsError); ok {
+		writer.dropped += len(invalid.Records)
+		return nil
+	}
+	return err
+}
+
+// flushLocked backfills the buffer file first, so history is written in order, then writes the queued records.
+// Records that could not be written go to the buffer file, or stay queued when there is none
+func (writer *HistWriter) flushLocked() error {
+	var err error
+	if writer.buffer != nil {
+		_, err = writer.buffer.Backfill(writer.writeBatch, writer.config.BatchSize)
+	}
+	for err == nil && len(writer.pending) > 0 {
+		end := writer.config.BatchSize
+		if end > len(writer.pending) {
+			end = len(writer.pending)
+		}
+		if err = writer.writeBatch(writer.pending[:end]); err == nil {
+			writer.pending = writer.pending[end:]
+		}
+	}
+	writer.lastErr = err
+	if err == nil {
+		writer.pending = nil
+		return nil
+	}
+	if writer.buffer != nil {
+		if bufErr := writer.buffer.Append(writer.pending); bufErr != nil {
+			return fmt.Errorf("History could not be written (%s) nor buffered (%s)", err, bufErr)
+		}
+		writer.pending = nil
+		return nil
+	}
+	if dropped := len(writer.pending) - histMaxPending; dropped > 0 {
+		writer.pending = writer.pending[dropped:]
+		return fmt.Errorf("History could not be written, %d records dropped. Error %s", dropped, err)
+	}
+	return nil
+}
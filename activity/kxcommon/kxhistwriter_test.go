@@ -0,0 +1,118 @@
+package kxcommon
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	influxdb "github.com/influxdata/influxdb1-client/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeInflux is a TSDB connection that keeps the written points, or fails with err
+type fakeInflux struct {
+	influxdb.Client
+	points []*influxdb.Point
+	err    error
+}
+
+func (client *fakeInflux) Write(bp influxdb.BatchPoints) error {
+	if client.err != nil {
+		return client.err
+	}
+	client.points = append(client.points, bp.Points()...)
+	return nil
+}
+
+func (client *fakeInflux) Close() error {
+	return nil
+}
+
+func newFakeHistWriter(t *testing.T, config HistWriterConfig) (*HistWriter, *fakeInflux) {
+	client := &fakeInflux{}
+	tsdb := TSDBNew("localhost", 8086, "", "")
+	tsdb.connection = client
+	tsdb.isConnected = true
+
+	config.Database = "db"
+	config.Table = "history"
+	writer, err := HistWriterNew(tsdb, config)
+	assert.Nil(t, err)
+	return writer, client
+}
+
+func histRecords(count int, timeStamp time.Time) []KXHistTSRecord {
+	records := make([]KXHistTSRecord, count)
+	for i := range records {
+		records[i] = KXHistTSRecordNew("TAG1", "", float64(i), "", QualityOk.String(), timeStamp.Add(time.Duration(i)*time.Second))
+	}
+	return records
+}
+
+func TestHistWriterInvalidRecords(t *testing.T) {
+
+	writer, client := newFakeHistWriter(t, HistWriterConfig{BatchSize: 3})
+	timeStamp := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	nan := KXHistTSRecordNew("TAG1", "", math.NaN(), "", QualityOk.String(), timeStamp)
+	err := writer.Write(append([]KXHistTSRecord{nan}, histRecords(3, timeStamp)...)...)
+
+	invalid, ok := err.(*InvalidHistRecordsError)
+	assert.True(t, ok)
+	assert.Len(t, invalid.Records, 1)
+
+	// the good records are written, and the writer keeps going
+	assert.Len(t, client.points, 3)
+	assert.Equal(t, 0, writer.Pending())
+	assert.Equal(t, 1, writer.Dropped())
+	assert.Nil(t, writer.LastError())
+
+	assert.Nil(t, writer.Write(histRecords(3, timeStamp.Add(time.Minute))...))
+	assert.Len(t, client.points, 6)
+}
+
+func TestHistWriterBackfillSkipsInvalidRecords(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "kxhist")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	bufferFile := filepath.Join(dir, "history.buf")
+	timeStamp := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// a record without tag buffered ahead of good ones must not stall the backfill
+	noTag := KXHistTSRecordNew("", "", 1, "", QualityOk.String(), timeStamp)
+	assert.Nil(t, HistBufferNew(bufferFile).Append(append([]KXHistTSRecord{noTag}, histRecords(2, timeStamp)...)))
+
+	writer, client := newFakeHistWriter(t, HistWriterConfig{BatchSize: 10, BufferFile: bufferFile})
+	assert.Nil(t, writer.Flush())
+	assert.Len(t, client.points, 2)
+	assert.Equal(t, 1, writer.Dropped())
+
+	_, err = os.Stat(bufferFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHistWriterMaxPending(t *testing.T) {
+
+	writer, client := newFakeHistWriter(t, HistWriterConfig{BatchSize: 100})
+	client.err = errors.New("TSDB unreachable")
+
+	timeStamp := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	err := writer.Write(histRecords(histMaxPending+50, timeStamp)...)
+	assert.NotNil(t, err)
+	assert.Equal(t, histMaxPending, writer.Pending())
+	assert.NotNil(t, writer.LastError())
+
+	client.err = nil
+	assert.Nil(t, writer.Flush())
+	assert.Len(t, client.points, histMaxPending)
+	assert.Equal(t, 0, writer.Pending())
+
+	// the oldest records were dropped
+	assert.Equal(t, timeStamp.Add(50*time.Second), client.points[0].Time())
+}
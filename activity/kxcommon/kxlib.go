@@ -18,12 +18,45 @@ type KXRTPObject struct {
 	Pv *RtVal
 	Avg *RtAvg
 }
-// RtVal represent a realtime sample
+// RtVal represent a realtime sample. Value is the numeric view of the sample, ValueStr its text for
+// non float types (see TypedValue)
 type RtVal struct {
 	Value float64
 	ValueStr string
 	Quality Quality
 	Timestamp time.Time
+	Type ValueType `json:",omitempty"`
+	Units string `json:",omitempty"`
+}
+
+// TypedValue gets the typed value of a sample
+func (rtVal RtVal) TypedValue() TypedValue {
+	var value TypedValue
+	switch rtVal.Type {
+	case ValueTypeFloat:
+		value = FloatValue(rtVal.Value)
+	case ValueTypeString:
+		value = StringValue(rtVal.ValueStr)
+	default:
+		// integers keep all their digits in ValueStr
+		text := rtVal.ValueStr
+		if text == "" {
+			text = strconv.FormatFloat(rtVal.Value, 'f', -1, 64)
+		}
+		value = decodeTypedValue(rtVal.Type, text, "")
+	}
+	return value.WithUnits(rtVal.Units)
+}
+
+// SetTypedValue sets the value of a sample
+func (rtVal *RtVal) SetTypedValue(value TypedValue) {
+	rtVal.Type = value.Type
+	rtVal.Units = value.Units
+	rtVal.Value = value.Float64()
+	rtVal.ValueStr = ""
+	if value.Type != ValueTypeFloat {
+		rtVal.ValueStr = value.String()
+	}
 }
 // RtAvg represent Realtime calculated averages
 type RtAvg struct {
@@ -41,6 +74,17 @@ func DecodeUpdateMessage (message string) (KXRTPObject, error) {
 	}
 	return updateMessage, nil
 }
+
+// DecodeScanMessage get scan messages coming from scanners and analytics activities
+func DecodeScanMessage (message string) (ScanMessage, error) {
+
+	var scanMessage ScanMessage
+	// decode message
+	if err := json.Unmarshal([]byte(message), &scanMessage); err != nil {
+		return ScanMessage{}, err
+	}
+	return scanMessage, nil
+}
 // Scan message Types
 
 type KXScanMessageUnitType int
@@ -69,7 +113,8 @@ type ScanMessage struct {
 	Payload	[]ScanMessageUnit
 
 }
-// ScanMessageUnit contains a single new value to be sent to the data processor
+// ScanMessageUnit contains a single new value to be sent to the data processor. Value is the text of the
+// value, of type VType (FLOAT when not given)
 type ScanMessageUnit struct {
 	ID				int
 	Tag				string
@@ -77,6 +122,8 @@ type ScanMessageUnit struct {
 	Quality			string
 	MType 			KXScanMessageUnitType	
 	TimeStamp		time.Time
+	VType			ValueType	`json:",omitempty"`
+	Units			string		`json:",omitempty"`
 }
 // GUIDNew Generates a new Guid
 func GUIDNew() string {
@@ -98,7 +145,17 @@ func (sm *ScanMessage) ScanMessageAdd(smu ScanMessageUnit) {
 
 // ScanMessageUnitNew creates a new scan message Unit
 func ScanMessageUnitNew(pOID int, tag string, value string, quality string, mType KXScanMessageUnitType, timeStamp time.Time) ScanMessageUnit {
-	return ScanMessageUnit{ pOID, tag, value, quality, mType, timeStamp };
+	return ScanMessageUnit{ pOID, tag, value, quality, mType, timeStamp, ValueTypeFloat, "" };
+}
+
+// ScanMessageUnitNewTyped creates a new scan message Unit out of a typed value
+func ScanMessageUnitNewTyped(pOID int, tag string, value TypedValue, quality string, mType KXScanMessageUnitType, timeStamp time.Time) ScanMessageUnit {
+	return ScanMessageUnit{ pOID, tag, value.String(), quality, mType, timeStamp, value.Type, value.Units };
+}
+
+// TypedValue gets the typed value of a scan message Unit
+func (smu ScanMessageUnit) TypedValue() TypedValue {
+	return decodeTypedValue(smu.VType, smu.Value, smu.Units)
 }
 
 func SerializeObject (obj interface{}) (string, error) {
@@ -129,6 +186,28 @@ func ToBool(val interface{}) (bool, error) {
 	return b, nil
 } 
 
+func ToFloat(val interface{}) (float64, error) {
+
+	switch t := val.(type) {
+	case float64:
+		return t, nil
+	case float32:
+		return float64(t), nil
+	case int:
+		return float64(t), nil
+	case int64:
+		return float64(t), nil
+	case int32:
+		return float64(t), nil
+	case json.Number:
+		return t.Float64()
+	case string:
+		return strconv.ParseFloat(t, 64)
+	default:
+		return 0, fmt.Errorf("unable to convert to float")
+	}
+}
+
 // Quality enum
 type Quality int
 
@@ -181,12 +260,15 @@ func (rtpObject * KXRTPObject) Deserialize(jsonInput string) error {
 type AnalyticsRequest struct {
 	Function string
 	Args	 []AnalyticsArg
+	Quality	 string
 }
 // AnalyticsArg argument into the request
 type AnalyticsArg struct {
 	Name 	string
 	Value 	string
 	Quality string
+	VType	ValueType	`json:",omitempty"`
+	Units	string		`json:",omitempty"`
 }
 
 type AnalyticsResponse struct {
@@ -195,11 +277,21 @@ type AnalyticsResponse struct {
 }
 
 func AnalyticsRequestNew (function string, args []AnalyticsArg) AnalyticsRequest {
-	return AnalyticsRequest {function, args}
+	return AnalyticsRequest {function, args, ""}
 }
 
 func AnalyticsArgNew (name string, value string, quality string) AnalyticsArg {
-	return AnalyticsArg {name, value, quality}
+	return AnalyticsArg {name, value, quality, ValueTypeFloat, ""}
+}
+
+// AnalyticsArgNewTyped creates an argument out of a typed value
+func AnalyticsArgNewTyped (name string, value TypedValue, quality string) AnalyticsArg {
+	return AnalyticsArg {name, value.String(), quality, value.Type, value.Units}
+}
+
+// TypedValue gets the typed value of an argument
+func (arg AnalyticsArg) TypedValue() TypedValue {
+	return decodeTypedValue(arg.VType, arg.Value, arg.Units)
 }
 
 func Mapkey(m map[string]string, value string) (key string, ok bool) {
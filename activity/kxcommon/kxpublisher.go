@@ -0,0 +1,687 @@
+package kxcommon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// AMQPPublisherConfig defines the broker, exchange and delivery guarantees of a publisher
+type AMQPPublisherConfig struct {
+	Broker AMQPConnectionConfig
+	// ExchangeName empty publishes through the default exchange, to the queue named by the routing key
+	ExchangeName string
+	ExchangeType string
+	Durable      bool
+	AutoDelete   bool
+	// Reliable waits for publisher confirms. Unconfirmed or nacked messages are published again
+	Reliable bool
+	// MaxInFlight is the number of published messages waiting for a confirm before Publish blocks (default 64)
+	MaxInFlight int
+	// ReconnectMin and ReconnectMax bound the backoff between reconnection attempts (default 1s and 30s)
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+	// SpillFile keeps the messages produced while the broker is down on disk. Empty keeps them in memory only
+	SpillFile string
+	// SpillLimit caps the messages kept in memory (default 10000). The oldest ones are dropped
+	SpillLimit int
+}
+
+// AMQPMessage is a message to publish
+type AMQPMessage struct {
+	RoutingKey    string
+	Body          string
+	CorrelationID string          `json:",omitempty"`
+	ReplyTo       string          `json:",omitempty"`
+	Properties    *AMQPProperties `json:",omitempty"`
+}
+
+// AMQPReply is the reply received for a request
+type AMQPReply struct {
+	CorrelationID string
+	Body          string
+}
+
+// AMQPPublisher is a long-lived publisher. It reconnects on its own when the connection is lost, pipelines
+// publisher confirms and keeps the messages it could not publish in a spill buffer until the broker is back.
+type AMQPPublisher struct {
+	config AMQPPublisherConfig
+	// lock serializes publishing, so delivery tags follow the publish order
+	lock      sync.Mutex
+	conn      *amqp.Connection
+	channel   *amqp.Channel
+	connected bool
+	closed    chan *amqp.Error
+	// channelClosed is notified when the broker closes only the channel (e.g. the exchange is gone)
+	channelClosed chan *amqp.Error
+	done          chan struct{}
+	slots         chan struct{}
+	nextTag       uint64
+	pending       map[uint64]AMQPMessage
+	nacked        []AMQPMessage
+	pendingLock   sync.Mutex
+	spill         *amqpSpill
+	lastErr       error
+	// replyQueue is the exclusive callback queue of the current connection, declared on the first request
+	replyQueue  string
+	replies     map[string]chan amqp.Delivery
+	repliesLock sync.Mutex
+	stop        chan struct{}
+	stopped     chan struct{}
+	stopOnce    sync.Once
+}
+
+var (
+	errAMQPDisconnected = errors.New("Connection to the broker was lost")
+	amqpPublishers      = make(map[AMQPPublisherConfig]*AMQPPublisher)
+	amqpPublishersLock  sync.Mutex
+)
+
+// AMQPPublisherNew creates a publisher and starts connecting. A broker that is down is not an error:
+// messages are spilled until the connection succeeds
+func AMQPPublisherNew(config AMQPPublisherConfig) (*AMQPPublisher, error) {
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = 64
+	}
+	if config.ReconnectMin <= 0 {
+		config.ReconnectMin = time.Second
+	}
+	if config.ReconnectMax < config.ReconnectMin {
+		config.ReconnectMax = 30 * time.Second
+	}
+	if config.SpillLimit <= 0 {
+		config.SpillLimit = 10000
+	}
+	spill, err := amqpSpillNew(config.SpillFile, config.SpillLimit)
+	if err != nil {
+		return nil, err
+	}
+	p := &AMQPPublisher{config: config, spill: spill, replies: make(map[string]chan amqp.Delivery), stop: make(chan struct{}), stopped: make(chan struct{})}
+	p.lock.Lock()
+	p.lastErr = p.connectLocked()
+	p.lock.Unlock()
+	go p.run()
+	return p, nil
+}
+
+// GetPooledAMQPPublisher gets the shared publisher of a configuration, creating it on first use
+func GetPooledAMQPPublisher(config AMQPPublisherConfig) (*AMQPPublisher, error) {
+	amqpPublishersLock.Lock()
+	defer amqpPublishersLock.Unlock()
+
+	if p, ok := amqpPublishers[config]; ok {
+		return p, nil
+	}
+	p, err := AMQPPublisherNew(config)
+	if err != nil {
+		return nil, err
+	}
+	amqpPublishers[config] = p
+	return p, nil
+}
+
+// CloseAMQPPublishers closes all the shared publishers. Called when the engine stops
+func CloseAMQPPublishers() error {
+	amqpPublishersLock.Lock()
+	defer amqpPublishersLock.Unlock()
+
+	var rtn error
+	for config, p := range amqpPublishers {
+		if err := p.Close(); err != nil {
+			rtn = err
+		}
+		delete(amqpPublishers, config)
+	}
+	return rtn
+}
+
+// connectLocked dials the broker, declares the exchange and starts listening for confirms
+func (p *AMQPPublisher) connectLocked() error {
+	conn, err := p.config.Broker.Dial()
+	if err != nil {
+		return fmt.Errorf("Connection: %s", err)
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Channel: %s", err)
+	}
+	// the default exchange always exists, and cannot be declared
+	if p.config.ExchangeName != "" {
+		if err := channel.ExchangeDeclare(p.config.ExchangeName, p.config.ExchangeType, p.config.Durable, p.config.AutoDelete, false, false, nil); err != nil {
+			conn.Close()
+			return fmt.Errorf("Exchange Declare: %s", err)
+		}
+	}
+	p.conn = conn
+	p.channel = channel
+	p.closed = conn.NotifyClose(make(chan *amqp.Error, 1))
+	p.channelClosed = channel.NotifyClose(make(chan *amqp.Error, 1))
+	p.done = make(chan struct{})
+	p.nextTag = 0
+	p.replyQueue = ""
+	p.pendingLock.Lock()
+	p.pending = make(map[uint64]AMQPMessage)
+	p.pendingLock.Unlock()
+
+	if p.config.Reliable {
+		if err := channel.Confirm(false); err != nil {
+			conn.Close()
+			return fmt.Errorf("Channel could not be put into confirm mode: %s", err)
+		}
+		p.slots = make(chan struct{}, p.config.MaxInFlight)
+		confirms := channel.NotifyPublish(make(chan amqp.Confirmation, p.config.MaxInFlight))
+		go p.handleConfirms(confirms, p.slots, p.pending)
+	}
+	p.connected = true
+	return nil
+}
+
+// run waits for the connection or its channel to be lost and reconnects with an exponential backoff
+func (p *AMQPPublisher) run() {
+	defer close(p.stopped)
+	backoff := p.config.ReconnectMin
+	for {
+		p.lock.Lock()
+		connected, closed, channelClosed, done := p.connected, p.closed, p.channelClosed, p.done
+		p.lock.Unlock()
+
+		if connected {
+			backoff = p.config.ReconnectMin
+			// messages spilled while disconnected go out before new ones
+			go p.Flush()
+			select {
+			case amqpErr := <-closed:
+				// unblocks a publish waiting for an in-flight slot
+				close(done)
+				p.disconnect(amqpErr)
+			case amqpErr := <-channelClosed:
+				// the confirms of the channel are lost with it: its in-flight messages are spilled
+				// and the next connection gets new slots
+				close(done)
+				p.disconnect(amqpErr)
+			case <-p.stop:
+				p.shutdown(done)
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-p.stop:
+			p.shutdown(nil)
+			return
+		}
+		p.lock.Lock()
+		if err := p.connectLocked(); err != nil {
+			p.lastErr = err
+			backoff *= 2
+			if backoff > p.config.ReconnectMax {
+				backoff = p.config.ReconnectMax
+			}
+		}
+		p.lock.Unlock()
+	}
+}
+
+// disconnect drops the lost connection or channel. Messages still waiting for a confirm are spilled to be published again
+func (p *AMQPPublisher) disconnect(amqpErr *amqp.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if amqpErr != nil {
+		p.lastErr = amqpErr
+	} else {
+		p.lastErr = errAMQPDisconnected
+	}
+	p.connected = false
+	p.conn.Close()
+	p.spillPending()
+}
+
+// spillPending moves the unconfirmed messages of the current connection to the spill buffer
+func (p *AMQPPublisher) spillPending() {
+	p.pendingLock.Lock()
+	var unconfirmed []AMQPMessage
+	for tag, msg := range p.pending {
+		unconfirmed = append(unconfirmed, msg)
+		delete(p.pending, tag)
+	}
+	p.pendingLock.Unlock()
+	if err := p.spill.Append(p.dropRequests(unconfirmed)...); err != nil {
+		p.lastErr = err
+	}
+	p.spillNacked()
+}
+
+// spillNacked moves the messages rejected by the broker to the spill buffer, to be published again
+func (p *AMQPPublisher) spillNacked() {
+	p.pendingLock.Lock()
+	nacked := p.nacked
+	p.nacked = nil
+	p.pendingLock.Unlock()
+	if len(nacked) == 0 {
+		return
+	}
+	p.lastErr = fmt.Errorf("%d messages were rejected by the broker", len(nacked))
+	if err := p.spill.Append(p.dropRequests(nacked)...); err != nil {
+		p.lastErr = err
+	}
+}
+
+// dropRequests removes the requests from messages to be published again. Their callers are told they failed
+// (or time out) instead, and their reply queue may be gone by then
+func (p *AMQPPublisher) dropRequests(messages []AMQPMessage) []AMQPMessage {
+	if p.replyQueue == "" {
+		return messages
+	}
+	kept := messages[:0]
+	for _, msg := range messages {
+		if msg.ReplyTo != p.replyQueue {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// shutdown waits a little for outstanding confirms and closes the connection. done is the one of the current connection, if any
+func (p *AMQPPublisher) shutdown(done chan struct{}) {
+	deadline := time.Now().Add(5 * time.Second)
+	for done != nil && time.Now().Before(deadline) && p.InFlight() > 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if done != nil {
+		close(done)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.connected {
+		p.connected = false
+		p.channel.Close()
+		p.conn.Close()
+	}
+	p.spillPending()
+}
+
+// handleConfirms releases in-flight slots as confirms arrive. Nacked messages are set aside to be published again.
+// It must never block: the broker connection stops reading while confirms are not consumed
+func (p *AMQPPublisher) handleConfirms(confirms <-chan amqp.Confirmation, slots chan struct{}, pending map[uint64]AMQPMessage) {
+	for confirm := range confirms {
+		p.pendingLock.Lock()
+		msg, ok := pending[confirm.DeliveryTag]
+		delete(pending, confirm.DeliveryTag)
+		if ok && !confirm.Ack {
+			p.nacked = append(p.nacked, msg)
+		}
+		p.pendingLock.Unlock()
+		if !ok {
+			continue
+		}
+		select {
+		case <-slots:
+		default:
+		}
+	}
+}
+
+// Publish publishes a message, or spills it when the broker is unreachable. With Reliable set it blocks
+// only while MaxInFlight messages are waiting for a confirm. An error means the message was lost
+func (p *AMQPPublisher) Publish(msg AMQPMessage) error {
+	// a message that cannot be built is never spilled, it would block the ones behind it
+	if _, err := msg.publishing(); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.connected {
+		p.spillNacked()
+		err := p.drainLocked()
+		if err == nil {
+			err = p.publishLocked(msg)
+		}
+		if err == nil {
+			return nil
+		}
+		p.lastErr = err
+	}
+	return p.spill.Append(msg)
+}
+
+// PublishObject serializes an object (JSON) and publishes it
+func (p *AMQPPublisher) PublishObject(routingKey string, obj interface{}) error {
+	bytes, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return p.Publish(AMQPMessage{RoutingKey: routingKey, Body: string(bytes)})
+}
+
+func (p *AMQPPublisher) publishLocked(msg AMQPMessage) error {
+	publishing, err := msg.publishing()
+	if err != nil {
+		return err
+	}
+	var tag uint64
+	if p.config.Reliable {
+		select {
+		case p.slots <- struct{}{}:
+		case <-p.done:
+			return errAMQPDisconnected
+		}
+		// registered before publishing, so a fast confirm always finds it
+		p.nextTag++
+		tag = p.nextTag
+		p.pendingLock.Lock()
+		p.pending[tag] = msg
+		p.pendingLock.Unlock()
+	}
+	err = p.channel.Publish(p.config.ExchangeName, msg.RoutingKey, false, false, publishing)
+	if err != nil && p.config.Reliable {
+		p.pendingLock.Lock()
+		delete(p.pending, tag)
+		p.pendingLock.Unlock()
+		<-p.slots
+	}
+	return err
+}
+
+// Request publishes a request and waits for the reply with the same Correlation ID on the exclusive callback
+// queue of the publisher. A Correlation ID is generated when the message has none. Requests are never spilled:
+// a broker that is down, or no reply within timeout, is an error
+func (p *AMQPPublisher) Request(msg AMQPMessage, timeout time.Duration) (AMQPReply, error) {
+	if msg.CorrelationID == "" {
+		msg.CorrelationID = GUIDNew()
+	}
+	reply := make(chan amqp.Delivery, 1)
+	defer func() {
+		p.repliesLock.Lock()
+		delete(p.replies, msg.CorrelationID)
+		p.repliesLock.Unlock()
+	}()
+
+	p.lock.Lock()
+	if !p.connected {
+		p.lock.Unlock()
+		return AMQPReply{}, errAMQPDisconnected
+	}
+	done := p.done
+	replyQueue, err := p.replyQueueLocked()
+	if err == nil {
+		msg.ReplyTo = replyQueue
+		// registered before publishing, so a fast reply always finds it
+		p.repliesLock.Lock()
+		p.replies[msg.CorrelationID] = reply
+		p.repliesLock.Unlock()
+		err = p.publishLocked(msg)
+	}
+	if err != nil {
+		p.lastErr = err
+	}
+	p.lock.Unlock()
+	if err != nil {
+		return AMQPReply{}, err
+	}
+
+	select {
+	case d := <-reply:
+		return AMQPReply{d.CorrelationId, string(d.Body)}, nil
+	case <-done:
+		return AMQPReply{}, errAMQPDisconnected
+	case <-time.After(timeout):
+		return AMQPReply{}, fmt.Errorf("No reply to request %s within %s", msg.CorrelationID, timeout)
+	}
+}
+
+// replyQueueLocked declares the callback queue of the current connection and starts consuming its replies
+func (p *AMQPPublisher) replyQueueLocked() (string, error) {
+	if p.replyQueue != "" {
+		return p.replyQueue, nil
+	}
+	// server named, exclusive and auto-deleted: it goes away with the connection
+	queue, err := p.channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return "", fmt.Errorf("Reply Queue Declare: %s", err)
+	}
+	deliveries, err := p.channel.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return "", fmt.Errorf("Reply Queue Consume: %s", err)
+	}
+	p.replyQueue = queue.Name
+	go p.handleReplies(deliveries)
+	return queue.Name, nil
+}
+
+// handleReplies hands the replies over to the requests waiting for them. Late replies are dropped
+func (p *AMQPPublisher) handleReplies(deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		p.repliesLock.Lock()
+		reply, ok := p.replies[d.CorrelationId]
+		delete(p.replies, d.CorrelationId)
+		p.repliesLock.Unlock()
+		if !ok {
+			continue
+		}
+		reply <- d
+	}
+}
+
+// Flush publishes the spilled messages now
+func (p *AMQPPublisher) Flush() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.connected {
+		return errAMQPDisconnected
+	}
+	p.spillNacked()
+	err := p.drainLocked()
+	if err != nil {
+		p.lastErr = err
+	}
+	return err
+}
+
+// drainLocked publishes the spilled messages in order
+func (p *AMQPPublisher) drainLocked() error {
+	if p.spill.Len() == 0 {
+		return nil
+	}
+	return p.spill.drain(p.publishLocked)
+}
+
+// ExchangeName gets the name of the exchange the publisher publishes to
+func (p *AMQPPublisher) ExchangeName() string {
+	return p.config.ExchangeName
+}
+
+// Connected checks if the publisher is connected to the broker
+func (p *AMQPPublisher) Connected() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.connected
+}
+
+// InFlight gets the number of messages waiting for a confirm
+func (p *AMQPPublisher) InFlight() int {
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+	return len(p.pending)
+}
+
+// Spilled gets the number of messages waiting in the spill buffer
+func (p *AMQPPublisher) Spilled() int {
+	return p.spill.Len()
+}
+
+// LastError gets the last connection or publish error
+func (p *AMQPPublisher) LastError() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.lastErr
+}
+
+// Close stops reconnecting, waits a little for outstanding confirms and closes the connection.
+// Messages left in a spill file are published by the next publisher on the same file
+func (p *AMQPPublisher) Close() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.stopped
+	return nil
+}
+
+// amqpSpill keeps messages that could not be published, in memory or in a file (one JSON message per line)
+type amqpSpill struct {
+	fileName string
+	limit    int
+	messages []AMQPMessage
+	count    int
+	lock     sync.Mutex
+}
+
+func amqpSpillNew(fileName string, limit int) (*amqpSpill, error) {
+	spill := &amqpSpill{fileName: fileName, limit: limit}
+	if fileName != "" {
+		// messages left by a previous run
+		messages, err := spill.readFile()
+		if err != nil {
+			return nil, fmt.Errorf("Spill file %s could not be read: %s", fileName, err)
+		}
+		spill.count = len(messages)
+	}
+	return spill, nil
+}
+
+// Len gets the number of spilled messages
+func (spill *amqpSpill) Len() int {
+	spill.lock.Lock()
+	defer spill.lock.Unlock()
+	if spill.fileName != "" {
+		return spill.count
+	}
+	return len(spill.messages)
+}
+
+// Append adds messages at the end of the spill buffer
+func (spill *amqpSpill) Append(messages ...AMQPMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	spill.lock.Lock()
+	defer spill.lock.Unlock()
+
+	if spill.fileName == "" {
+		spill.messages = append(spill.messages, messages...)
+		if dropped := len(spill.messages) - spill.limit; dropped > 0 {
+			spill.messages = spill.messages[dropped:]
+			return fmt.Errorf("Spill buffer is full, %d messages dropped", dropped)
+		}
+		return nil
+	}
+	if err := writeSpillFile(spill.fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, messages); err != nil {
+		return err
+	}
+	spill.count += len(messages)
+	return nil
+}
+
+// drain publishes the spilled messages in order, until one fails. The ones published are removed
+func (spill *amqpSpill) drain(publish func(AMQPMessage) error) error {
+	spill.lock.Lock()
+	defer spill.lock.Unlock()
+
+	messages := spill.messages
+	if spill.fileName != "" {
+		var err error
+		if messages, err = spill.readFile(); err != nil {
+			return err
+		}
+	}
+	published := 0
+	var err error
+	for _, msg := range messages {
+		if err = publish(msg); err != nil {
+			break
+		}
+		published++
+	}
+	if published == 0 {
+		return err
+	}
+	if spill.fileName == "" {
+		spill.messages = spill.messages[published:]
+		return err
+	}
+	spill.count = len(messages) - published
+	if spill.count == 0 {
+		if rmErr := os.Remove(spill.fileName); rmErr != nil {
+			return rmErr
+		}
+		return err
+	}
+	// replace the spill file with what is left
+	tmpName := spill.fileName + ".tmp"
+	if tmpErr := writeSpillFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, messages[published:]); tmpErr != nil {
+		return tmpErr
+	}
+	if renameErr := os.Rename(tmpName, spill.fileName); renameErr != nil {
+		return renameErr
+	}
+	return err
+}
+
+// readFile gets all the messages of the spill file. A missing file is an empty buffer
+func (spill *amqpSpill) readFile() ([]AMQPMessage, error) {
+	file, err := os.Open(spill.fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var messages []AMQPMessage
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg AMQPMessage
+		// a line cut by a crash while appending is dropped
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages, scanner.Err()
+}
+
+// writeSpillFile writes messages as JSON lines and syncs them to disk
+func writeSpillFile(fileName string, flag int, messages []AMQPMessage) error {
+	file, err := os.OpenFile(fileName, flag, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, msg := range messages {
+		if err := encoder.Encode(msg); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
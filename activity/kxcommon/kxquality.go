@@ -0,0 +1,206 @@
+package kxcommon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QualityPolicy enum - how the qualities of the inputs of a calculation combine into its output quality
+type QualityPolicy int
+
+const (
+	QualityPolicyWorstOf QualityPolicy = iota
+	QualityPolicyMajority
+	QualityPolicyIgnoreOld
+)
+
+func (policy QualityPolicy) String() string {
+	names := [...]string{
+		"WORSTOF",
+		"MAJORITY",
+		"IGNOREOLD"}
+	if policy < QualityPolicyWorstOf || policy > QualityPolicyIgnoreOld {
+		return "WORSTOF"
+	}
+	return names[policy]
+}
+
+// GetQualityPolicyFromString decodes a quality policy name
+func GetQualityPolicyFromString(policyStr string) (QualityPolicy, error) {
+	policies := map[string]QualityPolicy{
+		"WORSTOF":   QualityPolicyWorstOf,
+		"MAJORITY":  QualityPolicyMajority,
+		"IGNOREOLD": QualityPolicyIgnoreOld}
+	rtn, ok := policies[strings.ToUpper(strings.TrimSpace(policyStr))]
+	if !ok {
+		return QualityPolicyWorstOf, fmt.Errorf("Quality policy %s is unknown", policyStr)
+	}
+	return rtn, nil
+}
+
+// QualityRule describes how input qualities are propagated to an output
+type QualityRule struct {
+	Policy QualityPolicy
+	// MaxOldAge - with QualityPolicyIgnoreOld, OLD inputs younger than this are treated as OK
+	MaxOldAge time.Duration
+}
+
+// QualityInput is the quality of one input contributing to an output
+type QualityInput struct {
+	Quality   Quality
+	Timestamp time.Time
+}
+
+var (
+	functionQualityRules     = make(map[string]QualityRule)
+	functionQualityRulesLock sync.RWMutex
+	// DefaultQualityRule is used by functions without a registered rule
+	DefaultQualityRule = QualityRule{QualityPolicyWorstOf, 0}
+)
+
+// QualityRuleNew creates a new quality propagation rule
+func QualityRuleNew(policy QualityPolicy, maxOldAge time.Duration) QualityRule {
+	return QualityRule{policy, maxOldAge}
+}
+
+// ParseQualityRule decodes a rule in the form <policy>[:<maxOldAgeSeconds>], e.g. "IGNOREOLD:300".
+// An empty string returns DefaultQualityRule.
+func ParseQualityRule(ruleStr string) (QualityRule, error) {
+	if strings.TrimSpace(ruleStr) == "" {
+		return DefaultQualityRule, nil
+	}
+	pars := strings.SplitN(ruleStr, ":", 2)
+	policy, err := GetQualityPolicyFromString(pars[0])
+	if err != nil {
+		return DefaultQualityRule, err
+	}
+	rule := QualityRuleNew(policy, 0)
+	if len(pars) == 2 {
+		seconds, err := strconv.ParseFloat(strings.TrimSpace(pars[1]), 64)
+		if err != nil || seconds < 0 {
+			return DefaultQualityRule, fmt.Errorf("Quality rule %s has an invalid max age", ruleStr)
+		}
+		rule.MaxOldAge = time.Duration(seconds * float64(time.Second))
+	}
+	return rule, nil
+}
+
+// RegisterQualityRule sets the quality propagation rule of an analytics function
+func RegisterQualityRule(function string, rule QualityRule) {
+	functionQualityRulesLock.Lock()
+	functionQualityRules[function] = rule
+	functionQualityRulesLock.Unlock()
+}
+
+// GetQualityRule gets the quality propagation rule of an analytics function
+func GetQualityRule(function string) QualityRule {
+	functionQualityRulesLock.RLock()
+	defer functionQualityRulesLock.RUnlock()
+	rule, ok := functionQualityRules[function]
+	if !ok {
+		return DefaultQualityRule
+	}
+	return rule
+}
+
+// ResolveQualityRule gets the rule given as an activity input, falling back to the one registered for the function
+func ResolveQualityRule(function string, ruleStr string) (QualityRule, error) {
+	if strings.TrimSpace(ruleStr) == "" {
+		return GetQualityRule(function), nil
+	}
+	return ParseQualityRule(ruleStr)
+}
+
+// QualityInputNew creates a new quality input
+func QualityInputNew(quality Quality, timeStamp time.Time) QualityInput {
+	return QualityInput{quality, timeStamp}
+}
+
+// QualityInputFromRtVal creates a quality input out of a realtime sample
+func QualityInputFromRtVal(rtVal *RtVal) QualityInput {
+	if rtVal == nil {
+		return QualityInput{QualityUnknown, time.Time{}}
+	}
+	return QualityInput{rtVal.Quality, rtVal.Timestamp}
+}
+
+// severity orders qualities from best to worst
+func (quality Quality) severity() int {
+	switch quality {
+	case QualityOk:
+		return 0
+	case QualityOld:
+		return 1
+	case QualityBad:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// IsWorseThan checks if a quality is worse than another
+func (quality Quality) IsWorseThan(other Quality) bool {
+	return quality.severity() > other.severity()
+}
+
+// Propagate calculates the output quality out of the input qualities. No inputs give QualityUnknown.
+func (rule QualityRule) Propagate(inputs []QualityInput) Quality {
+	if len(inputs) == 0 {
+		return QualityUnknown
+	}
+	switch rule.Policy {
+	case QualityPolicyMajority:
+		return majorityQuality(inputs)
+	case QualityPolicyIgnoreOld:
+		now := time.Now().UTC()
+		filtered := make([]QualityInput, len(inputs))
+		for i, input := range inputs {
+			filtered[i] = input
+			if input.Quality == QualityOld && now.Sub(input.Timestamp) <= rule.MaxOldAge {
+				filtered[i].Quality = QualityOk
+			}
+		}
+		return worstQuality(filtered)
+	default:
+		return worstQuality(inputs)
+	}
+}
+
+func worstQuality(inputs []QualityInput) Quality {
+	worst := QualityOk
+	for _, input := range inputs {
+		if input.Quality.IsWorseThan(worst) {
+			worst = input.Quality
+		}
+	}
+	return worst
+}
+
+// majorityQuality returns the most common quality. Ties resolve to the worst one.
+func majorityQuality(inputs []QualityInput) Quality {
+	counts := make(map[Quality]int)
+	for _, input := range inputs {
+		counts[input.Quality]++
+	}
+	majority := QualityOk
+	majorityCount := -1
+	for quality, count := range counts {
+		if count > majorityCount || (count == majorityCount && quality.IsWorseThan(majority)) {
+			majority = quality
+			majorityCount = count
+		}
+	}
+	return majority
+}
+
+// MessageUnitTypeForQuality gets the scan message unit type for an output of the given quality.
+// Outputs without a usable value only update the quality.
+func MessageUnitTypeForQuality(quality Quality) KXScanMessageUnitType {
+	if quality == QualityBad || quality == QualityUnknown {
+		return MessageUnitTypeQuality
+	}
+	return MessageUnitTypeValue
+}
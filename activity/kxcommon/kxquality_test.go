@@ -0,0 +1,100 @@
+package kxcommon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQualityRulePropagate(t *testing.T) {
+
+	now := time.Now().UTC()
+	recent := now.Add(-10 * time.Second)
+	expired := now.Add(-120 * time.Second)
+
+	ignoreOld := QualityRuleNew(QualityPolicyIgnoreOld, 60*time.Second)
+
+	tests := []struct {
+		name     string
+		rule     QualityRule
+		inputs   []Quality
+		times    []time.Time
+		expected Quality
+	}{
+		{"no inputs", DefaultQualityRule, nil, nil, QualityUnknown},
+		{"worstof all ok", DefaultQualityRule, []Quality{QualityOk, QualityOk}, nil, QualityOk},
+		{"worstof old", DefaultQualityRule, []Quality{QualityOk, QualityOld}, nil, QualityOld},
+		{"worstof unknown over old", DefaultQualityRule, []Quality{QualityOld, QualityUnknown}, nil, QualityUnknown},
+		{"worstof bad over unknown", DefaultQualityRule, []Quality{QualityUnknown, QualityBad, QualityOk}, nil, QualityBad},
+		{"majority ok", QualityRuleNew(QualityPolicyMajority, 0), []Quality{QualityOk, QualityBad, QualityOk}, nil, QualityOk},
+		{"majority old", QualityRuleNew(QualityPolicyMajority, 0), []Quality{QualityOld, QualityOk, QualityOld}, nil, QualityOld},
+		{"majority tie is worst", QualityRuleNew(QualityPolicyMajority, 0), []Quality{QualityOk, QualityBad}, nil, QualityBad},
+		{"ignoreold recent old", ignoreOld, []Quality{QualityOld, QualityOk}, []time.Time{recent, now}, QualityOk},
+		{"ignoreold expired old", ignoreOld, []Quality{QualityOld, QualityOk}, []time.Time{expired, now}, QualityOld},
+		{"ignoreold keeps bad", ignoreOld, []Quality{QualityOld, QualityBad}, []time.Time{recent, now}, QualityBad},
+	}
+
+	for _, test := range tests {
+		inputs := make([]QualityInput, len(test.inputs))
+		for i, quality := range test.inputs {
+			timeStamp := now
+			if test.times != nil {
+				timeStamp = test.times[i]
+			}
+			inputs[i] = QualityInputNew(quality, timeStamp)
+		}
+		assert.Equal(t, test.expected, test.rule.Propagate(inputs), test.name)
+	}
+}
+
+func TestParseQualityRule(t *testing.T) {
+
+	tests := []struct {
+		ruleStr  string
+		expected QualityRule
+		fails    bool
+	}{
+		{"", DefaultQualityRule, false},
+		{"worstof", QualityRuleNew(QualityPolicyWorstOf, 0), false},
+		{" majority ", QualityRuleNew(QualityPolicyMajority, 0), false},
+		{"IGNOREOLD:300", QualityRuleNew(QualityPolicyIgnoreOld, 300*time.Second), false},
+		{"IGNOREOLD:1.5", QualityRuleNew(QualityPolicyIgnoreOld, 1500*time.Millisecond), false},
+		{"BESTOF", DefaultQualityRule, true},
+		{"IGNOREOLD:-1", DefaultQualityRule, true},
+		{"IGNOREOLD:abc", DefaultQualityRule, true},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseQualityRule(test.ruleStr)
+		if test.fails {
+			assert.NotNil(t, err, test.ruleStr)
+			continue
+		}
+		assert.Nil(t, err, test.ruleStr)
+		assert.Equal(t, test.expected, rule, test.ruleStr)
+	}
+}
+
+func TestResolveQualityRule(t *testing.T) {
+
+	RegisterQualityRule("test-quality", QualityRuleNew(QualityPolicyMajority, 0))
+
+	rule, err := ResolveQualityRule("test-quality", "")
+	assert.Nil(t, err)
+	assert.Equal(t, QualityPolicyMajority, rule.Policy)
+
+	rule, err = ResolveQualityRule("test-quality", "IGNOREOLD:10")
+	assert.Nil(t, err)
+	assert.Equal(t, QualityPolicyIgnoreOld, rule.Policy)
+
+	assert.Equal(t, DefaultQualityRule, GetQualityRule("test-unregistered"))
+}
+
+func TestMessageUnitTypeForQuality(t *testing.T) {
+
+	assert.Equal(t, MessageUnitTypeValue, MessageUnitTypeForQuality(QualityOk))
+	assert.Equal(t, MessageUnitTypeValue, MessageUnitTypeForQuality(QualityOld))
+	assert.Equal(t, MessageUnitTypeQuality, MessageUnitTypeForQuality(QualityBad))
+	assert.Equal(t, MessageUnitTypeQuality, MessageUnitTypeForQuality(QualityUnknown))
+}
@@ -0,0 +1,186 @@
+package kxcommon
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tsTagKey is the InfluxDB tag key holding the KNOX tag name
+const tsTagKey = "tag"
+
+// TSQuery builds InfluxQL select statements. Tag names and time bounds are sent as bound parameters
+// and identifiers are escaped, so values coming from configuration cannot change the statement.
+type TSQuery struct {
+	fields      []string
+	table       string
+	tags        []string
+	start       time.Time
+	end         time.Time
+	endOpen     bool
+	orderDesc   bool
+	limit       int
+	groupByTime time.Duration
+	fill        string
+	err         error
+}
+
+// tsAggregates server side aggregate functions accepted by the queries
+var tsAggregates = map[string]bool{
+	"MEAN": true, "INTEGRAL": true, "MIN": true, "MAX": true, "SUM": true,
+	"COUNT": true, "STDDEV": true, "SPREAD": true, "FIRST": true, "LAST": true,
+}
+
+// tsFills fill options accepted by the GROUP BY time() queries
+var tsFills = map[string]bool{
+	"previous": true, "null": true, "none": true, "linear": true,
+}
+
+// TSQueryNew starts a query on a table (measurement). All fields are selected unless Select is used
+func TSQueryNew(table string) *TSQuery {
+	return &TSQuery{table: table}
+}
+
+// QuoteIdentifier escapes an InfluxQL identifier (measurement, field or tag key)
+func QuoteIdentifier(name string) string {
+	name = strings.Replace(name, `\`, `\\`, -1)
+	name = strings.Replace(name, `"`, `\"`, -1)
+	return `"` + name + `"`
+}
+
+// Select adds fields to the selection
+func (q *TSQuery) Select(fields ...string) *TSQuery {
+	for _, field := range fields {
+		q.fields = append(q.fields, QuoteIdentifier(field))
+	}
+	return q
+}
+
+// SelectAggregate adds an aggregate (MEAN, INTEGRAL, MIN, MAX...) of a field to the selection. INTEGRAL is per second
+func (q *TSQuery) SelectAggregate(function string, field string) *TSQuery {
+	return q.SelectAggregateAs(function, field, "")
+}
+
+// SelectAggregateAs adds an aggregate of a field to the selection, returned in the alias column.
+// Without alias the column is named after the function
+func (q *TSQuery) SelectAggregateAs(function string, field string, alias string) *TSQuery {
+	function = strings.ToUpper(function)
+	if !tsAggregates[function] {
+		q.err = fmt.Errorf("Aggregate function %s is not supported", function)
+		return q
+	}
+	var selection string
+	if function == "INTEGRAL" {
+		selection = fmt.Sprintf("INTEGRAL(%s, 1s)", QuoteIdentifier(field))
+	} else {
+		selection = fmt.Sprintf("%s(%s)", function, QuoteIdentifier(field))
+	}
+	if alias != "" {
+		selection += " as " + QuoteIdentifier(alias)
+	}
+	q.fields = append(q.fields, selection)
+	return q
+}
+
+// Tags restricts the query to one or more tag names
+func (q *TSQuery) Tags(tags ...string) *TSQuery {
+	q.tags = append(q.tags, tags...)
+	return q
+}
+
+// TimeRange restricts the query to start <= time <= end
+func (q *TSQuery) TimeRange(start time.Time, end time.Time) *TSQuery {
+	q.start = start
+	q.end = end
+	q.endOpen = false
+	return q
+}
+
+// Before restricts the query to time < end
+func (q *TSQuery) Before(end time.Time) *TSQuery {
+	q.start = time.Time{}
+	q.end = end
+	q.endOpen = true
+	return q
+}
+
+// OrderDesc returns the newest records first
+func (q *TSQuery) OrderDesc() *TSQuery {
+	q.orderDesc = true
+	return q
+}
+
+// Limit limits the number of records returned per series
+func (q *TSQuery) Limit(limit int) *TSQuery {
+	q.limit = limit
+	return q
+}
+
+// GroupByTime aggregates in time buckets of the given interval. fill is an InfluxQL fill option (previous, null, none, linear)
+func (q *TSQuery) GroupByTime(interval time.Duration, fill string) *TSQuery {
+	if interval < time.Millisecond {
+		q.err = fmt.Errorf("Group by interval %s is too small", interval)
+		return q
+	}
+	fill = strings.ToLower(fill)
+	if !tsFills[fill] {
+		q.err = fmt.Errorf("Fill option %s is not supported", fill)
+		return q
+	}
+	q.groupByTime = interval
+	q.fill = fill
+	return q
+}
+
+// Build gets the InfluxQL statement and its bound parameters
+func (q *TSQuery) Build() (string, map[string]interface{}, error) {
+	if q.err != nil {
+		return "", nil, q.err
+	}
+	if q.table == "" {
+		return "", nil, fmt.Errorf("Query has no table")
+	}
+	params := make(map[string]interface{})
+
+	fieldStr := "*"
+	if len(q.fields) > 0 {
+		fieldStr = strings.Join(q.fields, ", ")
+	}
+	var conditions []string
+	if len(q.tags) > 0 {
+		tagConditions := make([]string, len(q.tags))
+		for i, tag := range q.tags {
+			name := fmt.Sprintf("tag%d", i)
+			params[name] = tag
+			tagConditions[i] = fmt.Sprintf("%s = $%s", QuoteIdentifier(tsTagKey), name)
+		}
+		conditions = append(conditions, "("+strings.Join(tagConditions, " or ")+")")
+	}
+	if !q.start.IsZero() {
+		params["start"] = q.start.UnixNano()
+		conditions = append(conditions, "time >= $start")
+	}
+	if !q.end.IsZero() {
+		params["end"] = q.end.UnixNano()
+		if q.endOpen {
+			conditions = append(conditions, "time < $end")
+		} else {
+			conditions = append(conditions, "time <= $end")
+		}
+	}
+
+	queryStr := fmt.Sprintf("select %s from %s", fieldStr, QuoteIdentifier(q.table))
+	if len(conditions) > 0 {
+		queryStr += " where " + strings.Join(conditions, " and ")
+	}
+	if q.groupByTime > 0 {
+		queryStr += fmt.Sprintf(" group by time(%dms) fill(%s)", q.groupByTime/time.Millisecond, q.fill)
+	}
+	if q.orderDesc {
+		queryStr += " order by time desc"
+	}
+	if q.limit > 0 {
+		queryStr += fmt.Sprintf(" limit %d", q.limit)
+	}
+	return queryStr, params, nil
+}
@@ -0,0 +1,88 @@
+package kxcommon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuoteIdentifier(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"value", `"value"`},
+		{`my "table"`, `"my \"table\""`},
+		{`back\slash`, `"back\\slash"`},
+		{`\"; drop measurement history`, `"\\\"; drop measurement history"`},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, QuoteIdentifier(test.name), test.name)
+	}
+}
+
+func TestTSQueryBuild(t *testing.T) {
+
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+
+	tests := []struct {
+		name      string
+		query     *TSQuery
+		statement string
+		params    map[string]interface{}
+	}{
+		{"all fields",
+			TSQueryNew("history"),
+			`select * from "history"`,
+			map[string]interface{}{}},
+		{"quoted table and fields",
+			TSQueryNew(`his"tory\`).Select("value", `qua"lity`),
+			`select "value", "qua\"lity" from "his\"tory\\"`,
+			map[string]interface{}{}},
+		{"tags and time range",
+			TSQueryNew("history").Tags("T1", `T2" or "tag" =~ /.*/`).TimeRange(start, end),
+			`select * from "history" where ("tag" = $tag0 or "tag" = $tag1) and time >= $start and time <= $end`,
+			map[string]interface{}{"tag0": "T1", "tag1": `T2" or "tag" =~ /.*/`, "start": start.UnixNano(), "end": end.UnixNano()}},
+		{"before",
+			TSQueryNew("history").Tags("T1").Before(end).OrderDesc().Limit(1),
+			`select * from "history" where ("tag" = $tag0) and time < $end order by time desc limit 1`,
+			map[string]interface{}{"tag0": "T1", "end": end.UnixNano()}},
+		{"aggregate",
+			TSQueryNew("history").SelectAggregate("integral", "value").SelectAggregateAs("last", "quality", "quality").TimeRange(start, end),
+			`select INTEGRAL("value", 1s), LAST("quality") as "quality" from "history" where time >= $start and time <= $end`,
+			map[string]interface{}{"start": start.UnixNano(), "end": end.UnixNano()}},
+		{"group by time",
+			TSQueryNew("history").SelectAggregate("mean", "value").Tags("T1").TimeRange(start, end).GroupByTime(90*time.Second, "Previous"),
+			`select MEAN("value") from "history" where ("tag" = $tag0) and time >= $start and time <= $end group by time(90000ms) fill(previous)`,
+			map[string]interface{}{"tag0": "T1", "start": start.UnixNano(), "end": end.UnixNano()}},
+	}
+
+	for _, test := range tests {
+		statement, params, err := test.query.Build()
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, test.statement, statement, test.name)
+		assert.Equal(t, test.params, params, test.name)
+	}
+}
+
+func TestTSQueryBuildErrors(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		query *TSQuery
+	}{
+		{"no table", TSQueryNew("")},
+		{"unknown aggregate", TSQueryNew("history").SelectAggregate("median; drop", "value")},
+		{"interval too small", TSQueryNew("history").GroupByTime(time.Microsecond, "none")},
+		{"unknown fill", TSQueryNew("history").GroupByTime(time.Second, "0)")},
+	}
+
+	for _, test := range tests {
+		_, _, err := test.query.Build()
+		assert.NotNil(t, err, test.name)
+	}
+}
@@ -0,0 +1,192 @@
+package kxcommon
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Records are the structured form of scan messages and analytics requests, so flow mappers can address each
+// result: an array of {tag, value, valueType, units, quality, type, timestamp} objects. Analytics request records
+// also carry the argument name. Values are numbers, booleans or strings as given by valueType (FLOAT, INT, BOOL or
+// STRING); timestamps are RFC 3339 dates
+const (
+	RecordTag       = "tag"
+	RecordName      = "name"
+	RecordValue     = "value"
+	RecordValueType = "valueType"
+	RecordUnits     = "units"
+	RecordQuality   = "quality"
+	RecordType      = "type"
+	RecordTimestamp = "timestamp"
+)
+
+// RecordNew creates a record
+func RecordNew(tag string, value TypedValue, quality string, mType KXScanMessageUnitType, timeStamp time.Time) map[string]interface{} {
+	record := map[string]interface{}{
+		RecordTag:       tag,
+		RecordValue:     recordValue(value),
+		RecordValueType: value.Type.String(),
+		RecordUnits:     value.Units,
+		RecordQuality:   quality,
+		RecordType:      mType.String(),
+	}
+	if timeStamp.IsZero() {
+		record[RecordTimestamp] = ""
+	} else {
+		record[RecordTimestamp] = timeStamp.UTC().Format(time.RFC3339Nano)
+	}
+	return record
+}
+
+// Records gets the records of a scan message
+func (sm ScanMessage) Records() []interface{} {
+	records := make([]interface{}, 0, len(sm.Payload))
+	for _, smu := range sm.Payload {
+		records = append(records, RecordNew(smu.Tag, smu.TypedValue(), smu.Quality, smu.MType, smu.TimeStamp))
+	}
+	return records
+}
+
+// AnalyticsRecords gets the records of the arguments of an analytics request, out of the objects they were read from.
+// inputTags maps the argument names to their tags
+func AnalyticsRecords(inputTags map[string]string, objs map[string]KXRTPObject) []interface{} {
+	names := make([]string, 0, len(inputTags))
+	for name := range inputTags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	records := make([]interface{}, 0, len(objs))
+	for _, name := range names {
+		tag := inputTags[name]
+		obj, ok := objs[tag]
+		if !ok || obj.Cv == nil {
+			continue
+		}
+		record := RecordNew(tag, obj.Cv.TypedValue(), obj.Cv.Quality.String(), MessageUnitTypeForQuality(obj.Cv.Quality), obj.Cv.Timestamp)
+		record[RecordName] = name
+		records = append(records, record)
+	}
+	return records
+}
+
+// ScanMessageFromRecords builds a scan message out of records. Records without valueType get the type of their value
+// (numbers are FLOAT), without quality are OK, without type VALUE and without timestamp are stamped now
+func ScanMessageFromRecords(records []interface{}) (ScanMessage, error) {
+	scanMessage := ScanMessageNew()
+	now := time.Now().UTC()
+	for i, item := range records {
+		record, ok := item.(map[string]interface{})
+		if !ok {
+			return ScanMessage{}, fmt.Errorf("Record %d must be an object, not %T", i, item)
+		}
+		tag, _ := record[RecordTag].(string)
+		if tag == "" {
+			return ScanMessage{}, fmt.Errorf("Record %d has no tag", i)
+		}
+		value, err := recordTypedValue(record)
+		if err != nil {
+			return ScanMessage{}, fmt.Errorf("Record %d: %s", i, err)
+		}
+		quality, _ := record[RecordQuality].(string)
+		if quality == "" {
+			quality = QualityOk.String()
+		}
+		mType := MessageUnitTypeValue
+		if typeStr, _ := record[RecordType].(string); typeStr != "" {
+			if mType, err = GetScanMessageUnitTypeFromString(typeStr); err != nil {
+				return ScanMessage{}, fmt.Errorf("Record %d: %s", i, err)
+			}
+		}
+		timeStamp := now
+		switch ts := record[RecordTimestamp].(type) {
+		case time.Time:
+			timeStamp = ts
+		case string:
+			if ts != "" {
+				if timeStamp, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+					return ScanMessage{}, fmt.Errorf("Record %d timestamp must be a RFC 3339 date. Found '%s'", i, ts)
+				}
+			}
+		}
+		scanMessage.ScanMessageAdd(ScanMessageUnitNewTyped(-1, tag, value, quality, mType, timeStamp))
+	}
+	return scanMessage, nil
+}
+
+// EncodeMessage gets the JSON string of a message given as a string (kept as it is), as records (sent as a
+// scan message) or as any other object
+func EncodeMessage(message interface{}) (string, error) {
+	switch m := message.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return m, nil
+	case []interface{}:
+		scanMessage, err := ScanMessageFromRecords(m)
+		if err != nil {
+			return "", err
+		}
+		return SerializeObject(scanMessage)
+	default:
+		return SerializeObject(m)
+	}
+}
+
+// GetScanMessageUnitTypeFromString decodes a scan message unit type (VALUE or QUALITY)
+func GetScanMessageUnitTypeFromString(typeStr string) (KXScanMessageUnitType, error) {
+	switch strings.ToUpper(typeStr) {
+	case MessageUnitTypeValue.String():
+		return MessageUnitTypeValue, nil
+	case MessageUnitTypeQuality.String():
+		return MessageUnitTypeQuality, nil
+	}
+	return MessageUnitTypeUnknown, fmt.Errorf("Scan message unit type '%s' is unknown", typeStr)
+}
+
+// recordValue gets the value of a record. NaN and infinities stay strings, JSON has no numbers for them
+func recordValue(value TypedValue) interface{} {
+	if value.Type == ValueTypeFloat && (math.IsNaN(value.Float) || math.IsInf(value.Float, 0)) {
+		return value.String()
+	}
+	return value.Interface()
+}
+
+// recordTypedValue decodes the value of a record, of its valueType when given
+func recordTypedValue(record map[string]interface{}) (TypedValue, error) {
+	units, _ := record[RecordUnits].(string)
+	raw := record[RecordValue]
+	if raw == nil {
+		raw = ""
+	}
+	typeStr, _ := record[RecordValueType].(string)
+	if typeStr == "" {
+		value, err := TypedValueOf(raw)
+		if err != nil {
+			return TypedValue{}, err
+		}
+		if value.Type == ValueTypeString {
+			// untyped text that is a number, as sent before types existed
+			if number, err := ParseTypedValue(ValueTypeFloat, value.Str); err == nil {
+				value = number
+			}
+		}
+		return value.WithUnits(units), nil
+	}
+	valueType, err := GetValueTypeFromString(typeStr)
+	if err != nil {
+		return TypedValue{}, err
+	}
+	text := fmt.Sprintf("%v", raw)
+	if f, ok := raw.(float64); ok {
+		text = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	value, err := ParseTypedValue(valueType, text)
+	if err != nil {
+		return TypedValue{}, err
+	}
+	return value.WithUnits(units), nil
+}
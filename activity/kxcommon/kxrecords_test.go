@@ -0,0 +1,142 @@
+package kxcommon
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func recordsScanMessage(now time.Time) ScanMessage {
+	sm := ScanMessageNew()
+	sm.ScanMessageAdd(ScanMessageUnitNewTyped(1, "FLOW", FloatValue(12.345678901).WithUnits("m3/h"), QualityOk.String(), MessageUnitTypeValue, now))
+	sm.ScanMessageAdd(ScanMessageUnitNewTyped(2, "COUNT", IntValue(42).WithUnits("pcs"), QualityOld.String(), MessageUnitTypeValue, now.Add(time.Nanosecond)))
+	sm.ScanMessageAdd(ScanMessageUnitNewTyped(3, "RUNNING", BoolValue(true), QualityBad.String(), MessageUnitTypeQuality, now))
+	sm.ScanMessageAdd(ScanMessageUnitNewTyped(4, "STATE", StringValue("OPEN"), QualityOk.String(), MessageUnitTypeValue, now))
+	sm.ScanMessageAdd(ScanMessageUnitNewTyped(5, "LEVEL", FloatValue(math.NaN()).WithUnits("m"), QualityBad.String(), MessageUnitTypeValue, now))
+	return sm
+}
+
+func assertSamePayload(t *testing.T, expected ScanMessage, actual ScanMessage) {
+	if !assert.Equal(t, len(expected.Payload), len(actual.Payload)) {
+		return
+	}
+	for i, smu := range expected.Payload {
+		got := actual.Payload[i]
+		assert.Equal(t, smu.Tag, got.Tag)
+		assert.True(t, smu.TypedValue().Equal(got.TypedValue()), "%s: %v != %v", smu.Tag, smu.TypedValue(), got.TypedValue())
+		assert.Equal(t, smu.Quality, got.Quality, smu.Tag)
+		assert.Equal(t, smu.MType, got.MType, smu.Tag)
+		assert.True(t, smu.TimeStamp.Equal(got.TimeStamp), "%s: %s != %s", smu.Tag, smu.TimeStamp, got.TimeStamp)
+	}
+}
+
+func TestRecordsRoundTrip(t *testing.T) {
+
+	now := time.Date(2018, 6, 1, 12, 0, 0, 123456789, time.UTC)
+	sm := recordsScanMessage(now)
+
+	records := sm.Records()
+	assert.Equal(t, map[string]interface{}{
+		RecordTag:       "FLOW",
+		RecordValue:     12.345678901,
+		RecordValueType: "FLOAT",
+		RecordUnits:     "m3/h",
+		RecordQuality:   "OK",
+		RecordType:      "VALUE",
+		RecordTimestamp: "2018-06-01T12:00:00.123456789Z",
+	}, records[0])
+	assert.Equal(t, "NaN", records[4].(map[string]interface{})[RecordValue])
+
+	back, err := ScanMessageFromRecords(records)
+	assert.Nil(t, err)
+	assertSamePayload(t, sm, back)
+
+	// records as flow mappers hand them over, after a trip through JSON
+	bytes, err := json.Marshal(records)
+	assert.Nil(t, err)
+	var mapped []interface{}
+	assert.Nil(t, json.Unmarshal(bytes, &mapped))
+
+	back, err = ScanMessageFromRecords(mapped)
+	assert.Nil(t, err)
+	assertSamePayload(t, sm, back)
+}
+
+func TestEncodeMessageRecords(t *testing.T) {
+
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	sm := recordsScanMessage(now)
+
+	// what amqpact publishes when its input message is records
+	message, err := EncodeMessage(sm.Records())
+	assert.Nil(t, err)
+
+	decoded, err := DecodeScanMessage(message)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, decoded.MID)
+	assertSamePayload(t, sm, decoded)
+
+	message, err = EncodeMessage(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", message)
+
+	message, err = EncodeMessage(`{"MID":"1"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"MID":"1"}`, message)
+
+	message, err = EncodeMessage(map[string]interface{}{"tag": "T1"})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"tag":"T1"}`, message)
+
+	_, err = EncodeMessage([]interface{}{map[string]interface{}{RecordValue: 1.0}})
+	assert.NotNil(t, err)
+}
+
+func TestScanMessageFromRecordsDefaults(t *testing.T) {
+
+	before := time.Now().UTC()
+	sm, err := ScanMessageFromRecords([]interface{}{
+		map[string]interface{}{RecordTag: "T1", RecordValue: 1.5},
+		map[string]interface{}{RecordTag: "T2", RecordValue: "2.5", RecordUnits: "bar"},
+		map[string]interface{}{RecordTag: "T3", RecordValue: "OPEN"},
+		map[string]interface{}{RecordTag: "T4", RecordValue: true, RecordType: "quality"},
+		map[string]interface{}{RecordTag: "T5", RecordValue: 7.0, RecordValueType: "int", RecordTimestamp: "2018-06-01T12:00:00Z"},
+	})
+	assert.Nil(t, err)
+
+	assert.True(t, FloatValue(1.5).Equal(sm.Payload[0].TypedValue()))
+	assert.True(t, FloatValue(2.5).WithUnits("bar").Equal(sm.Payload[1].TypedValue()))
+	assert.True(t, StringValue("OPEN").Equal(sm.Payload[2].TypedValue()))
+	assert.True(t, BoolValue(true).Equal(sm.Payload[3].TypedValue()))
+	assert.True(t, IntValue(7).Equal(sm.Payload[4].TypedValue()))
+
+	assert.Equal(t, "OK", sm.Payload[0].Quality)
+	assert.Equal(t, MessageUnitTypeValue, sm.Payload[0].MType)
+	assert.Equal(t, MessageUnitTypeQuality, sm.Payload[3].MType)
+	assert.False(t, sm.Payload[0].TimeStamp.Before(before))
+	assert.Equal(t, time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), sm.Payload[4].TimeStamp)
+}
+
+func TestScanMessageFromRecordsErrors(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		record interface{}
+	}{
+		{"not an object", "T1"},
+		{"no tag", map[string]interface{}{RecordValue: 1.0}},
+		{"unknown value type", map[string]interface{}{RecordTag: "T1", RecordValue: 1.0, RecordValueType: "DOUBLE"}},
+		{"value of another type", map[string]interface{}{RecordTag: "T1", RecordValue: "OPEN", RecordValueType: "INT"}},
+		{"unsupported value", map[string]interface{}{RecordTag: "T1", RecordValue: []interface{}{1.0}}},
+		{"unknown type", map[string]interface{}{RecordTag: "T1", RecordValue: 1.0, RecordType: "ALARM"}},
+		{"bad timestamp", map[string]interface{}{RecordTag: "T1", RecordValue: 1.0, RecordTimestamp: "yesterday"}},
+	}
+
+	for _, test := range tests {
+		_, err := ScanMessageFromRecords([]interface{}{test.record})
+		assert.NotNil(t, err, test.name)
+	}
+}
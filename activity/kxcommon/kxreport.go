@@ -0,0 +1,153 @@
+package kxcommon
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ReportFilter decides which updates of a tag are reported, out of the last update reported for it. A filter without
+// settings reports every update
+type ReportFilter struct {
+	// Deadband - numeric updates are reported when they moved at least this from the last value reported
+	Deadband float64
+	// PercentDeadband - the same as Deadband, as a percent of the last value reported. With both, the larger applies
+	PercentDeadband float64
+	TagDeadband     map[string]float64
+	// MinInterval is the rate limit of a tag: updates closer than this to the last report are not reported
+	MinInterval time.Duration
+	// MaxInterval - updates this far from the last report are reported even when they did not change
+	MaxInterval time.Duration
+	// QualityChange - quality changes are reported regardless of deadbands and MinInterval. Otherwise they are
+	// reported with the next value change
+	QualityChange bool
+}
+
+// ReportFilterNew creates a filter that reports every update
+func ReportFilterNew() ReportFilter {
+	return ReportFilter{TagDeadband: make(map[string]float64), QualityChange: true}
+}
+
+// ParseReportFilter builds a report filter out of deadbands (absolute, percent and per tag) and report intervals in seconds
+func ParseReportFilter(deadband interface{}, percentDeadband interface{}, tagDeadbands map[string]interface{},
+	minInterval interface{}, maxInterval interface{}, qualityChange bool) (ReportFilter, error) {
+	filter := ReportFilterNew()
+	filter.QualityChange = qualityChange
+	var err error
+	if filter.Deadband, err = nonNegative("Deadband", deadband); err != nil {
+		return filter, err
+	}
+	if filter.PercentDeadband, err = nonNegative("Percent deadband", percentDeadband); err != nil {
+		return filter, err
+	}
+	for tag, tagDeadband := range tagDeadbands {
+		if filter.TagDeadband[tag], err = nonNegative("Deadband for tag "+tag, tagDeadband); err != nil {
+			return filter, err
+		}
+	}
+	seconds, err := nonNegative("Min interval", minInterval)
+	if err != nil {
+		return filter, err
+	}
+	filter.MinInterval = secondsToDuration(seconds)
+	if seconds, err = nonNegative("Max interval", maxInterval); err != nil {
+		return filter, err
+	}
+	filter.MaxInterval = secondsToDuration(seconds)
+	if filter.MaxInterval > 0 && filter.MaxInterval < filter.MinInterval {
+		return filter, fmt.Errorf("Max interval must not be shorter than min interval")
+	}
+	return filter, nil
+}
+
+func nonNegative(name string, value interface{}) (float64, error) {
+	if value == nil || value == "" {
+		return 0, nil
+	}
+	number, err := ToFloat(value)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("%s %v is invalid", name, value)
+	}
+	return number, nil
+}
+
+// IsEmpty checks if the filter reports every update
+func (filter ReportFilter) IsEmpty() bool {
+	return filter.Deadband == 0 && filter.PercentDeadband == 0 && len(filter.TagDeadband) == 0 &&
+		filter.MinInterval == 0 && filter.MaxInterval == 0
+}
+
+// ReportState is the last update reported for a tag
+type ReportState struct {
+	Value    TypedValue
+	Quality  Quality
+	Reported time.Time
+}
+
+// ReportFilterStore keeps the last update reported for each key (e.g. flow, activity and tag) across evaluations
+type ReportFilterStore struct {
+	lock   sync.Mutex
+	states map[string]ReportState
+}
+
+// ReportFilterStoreNew creates an empty store
+func ReportFilterStoreNew() *ReportFilterStore {
+	return &ReportFilterStore{states: make(map[string]ReportState)}
+}
+
+// Accept checks an update of a tag against the filter and the last update reported under the key. Accepted updates
+// become the last reported. The reason is logged by the activities
+func (store *ReportFilterStore) Accept(key string, filter ReportFilter, tag string, value TypedValue, quality Quality, now time.Time) (bool, string) {
+	if filter.IsEmpty() {
+		return true, "no filter"
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	last, found := store.states[key]
+	accepted, reason := filter.accept(last, found, tag, value, quality, now)
+	if accepted {
+		store.states[key] = ReportState{value, quality, now}
+	}
+	return accepted, reason
+}
+
+func (filter ReportFilter) accept(last ReportState, found bool, tag string, value TypedValue, quality Quality, now time.Time) (bool, string) {
+	if !found {
+		return true, "first update"
+	}
+	if quality != last.Quality && filter.QualityChange {
+		return true, "quality changed"
+	}
+	elapsed := now.Sub(last.Reported)
+	if filter.MinInterval > 0 && elapsed < filter.MinInterval {
+		return false, "rate limited"
+	}
+	if filter.MaxInterval > 0 && elapsed >= filter.MaxInterval {
+		return true, "max interval elapsed"
+	}
+	if !filter.moved(last.Value, value, tag) {
+		return false, "within deadband"
+	}
+	return true, "value changed"
+}
+
+// moved checks if a value passes the deadband of its tag. Values that are not numbers pass when they change
+func (filter ReportFilter) moved(last TypedValue, value TypedValue, tag string) bool {
+	if last.Type != value.Type || (value.Type != ValueTypeFloat && value.Type != ValueTypeInt) {
+		return !value.Equal(last)
+	}
+	change := math.Abs(value.Float64() - last.Float64())
+	if change == 0 {
+		return false
+	}
+	deadband := filter.Deadband
+	if tagDeadband, ok := filter.TagDeadband[tag]; ok {
+		deadband = tagDeadband
+	}
+	if percent := filter.PercentDeadband / 100 * math.Abs(last.Float64()); percent > deadband {
+		deadband = percent
+	}
+	return change >= deadband
+}
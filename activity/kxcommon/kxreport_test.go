@@ -0,0 +1,104 @@
+package kxcommon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportFilterAccept(t *testing.T) {
+
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	last := ReportState{FloatValue(100), QualityOk, now.Add(-10 * time.Second)}
+	lastStr := ReportState{StringValue("OPEN"), QualityOk, now.Add(-10 * time.Second)}
+
+	deadband := ReportFilter{Deadband: 5, QualityChange: true}
+	percent := ReportFilter{PercentDeadband: 10, QualityChange: true}
+	both := ReportFilter{Deadband: 5, PercentDeadband: 7, QualityChange: true}
+	tagDeadband := ReportFilter{Deadband: 5, TagDeadband: map[string]float64{"T2": 1}, QualityChange: true}
+	minInterval := ReportFilter{Deadband: 5, MinInterval: 30 * time.Second, QualityChange: true}
+	maxInterval := ReportFilter{Deadband: 5, MaxInterval: 5 * time.Second, QualityChange: true}
+	noQualityChange := ReportFilter{Deadband: 5, QualityChange: false}
+
+	tests := []struct {
+		name     string
+		filter   ReportFilter
+		last     ReportState
+		found    bool
+		tag      string
+		value    TypedValue
+		quality  Quality
+		expected bool
+		reason   string
+	}{
+		{"first update", deadband, ReportState{}, false, "T1", FloatValue(100), QualityOk, true, "first update"},
+		{"within deadband", deadband, last, true, "T1", FloatValue(103), QualityOk, false, "within deadband"},
+		{"on the deadband", deadband, last, true, "T1", FloatValue(105), QualityOk, true, "value changed"},
+		{"below the deadband", deadband, last, true, "T1", FloatValue(94), QualityOk, true, "value changed"},
+		{"within percent deadband", percent, last, true, "T1", FloatValue(108), QualityOk, false, "within deadband"},
+		{"out of percent deadband", percent, last, true, "T1", FloatValue(110), QualityOk, true, "value changed"},
+		{"larger deadband applies", both, last, true, "T1", FloatValue(106), QualityOk, false, "within deadband"},
+		{"tag deadband overrides", tagDeadband, last, true, "T2", FloatValue(101.5), QualityOk, true, "value changed"},
+		{"default deadband for other tags", tagDeadband, last, true, "T1", FloatValue(101.5), QualityOk, false, "within deadband"},
+		{"rate limited", minInterval, last, true, "T1", FloatValue(200), QualityOk, false, "rate limited"},
+		{"max interval elapsed", maxInterval, last, true, "T1", FloatValue(100), QualityOk, true, "max interval elapsed"},
+		{"quality change", minInterval, last, true, "T1", FloatValue(100), QualityOld, true, "quality changed"},
+		{"quality change waits", noQualityChange, last, true, "T1", FloatValue(100), QualityOld, false, "within deadband"},
+		{"quality change with value", noQualityChange, last, true, "T1", FloatValue(110), QualityOld, true, "value changed"},
+		{"same text", deadband, lastStr, true, "T1", StringValue("OPEN"), QualityOk, false, "within deadband"},
+		{"text changed", deadband, lastStr, true, "T1", StringValue("CLOSED"), QualityOk, true, "value changed"},
+		{"type changed", deadband, last, true, "T1", IntValue(100), QualityOk, true, "value changed"},
+	}
+
+	for _, test := range tests {
+		accepted, reason := test.filter.accept(test.last, test.found, test.tag, test.value, test.quality, now)
+		assert.Equal(t, test.expected, accepted, test.name)
+		assert.Equal(t, test.reason, reason, test.name)
+	}
+}
+
+func TestReportFilterStore(t *testing.T) {
+
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	store := ReportFilterStoreNew()
+
+	accepted, _ := store.Accept("key", ReportFilterNew(), "T1", FloatValue(1), QualityOk, now)
+	assert.True(t, accepted)
+
+	filter := ReportFilter{Deadband: 5, QualityChange: true}
+	accepted, _ = store.Accept("key", filter, "T1", FloatValue(100), QualityOk, now)
+	assert.True(t, accepted)
+
+	// rejected updates do not move the reference value
+	accepted, _ = store.Accept("key", filter, "T1", FloatValue(103), QualityOk, now.Add(time.Second))
+	assert.False(t, accepted)
+	accepted, _ = store.Accept("key", filter, "T1", FloatValue(106), QualityOk, now.Add(2*time.Second))
+	assert.True(t, accepted)
+
+	// keys are independent
+	accepted, _ = store.Accept("other", filter, "T1", FloatValue(103), QualityOk, now.Add(3*time.Second))
+	assert.True(t, accepted)
+}
+
+func TestParseReportFilter(t *testing.T) {
+
+	filter, err := ParseReportFilter("0.5", 2, map[string]interface{}{"T1": "1"}, 10, "60", false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.5, filter.Deadband)
+	assert.Equal(t, float64(2), filter.PercentDeadband)
+	assert.Equal(t, float64(1), filter.TagDeadband["T1"])
+	assert.Equal(t, 10*time.Second, filter.MinInterval)
+	assert.Equal(t, time.Minute, filter.MaxInterval)
+	assert.False(t, filter.QualityChange)
+
+	filter, err = ParseReportFilter(nil, "", nil, nil, nil, true)
+	assert.Nil(t, err)
+	assert.True(t, filter.IsEmpty())
+
+	_, err = ParseReportFilter(-1, nil, nil, nil, nil, true)
+	assert.NotNil(t, err)
+
+	_, err = ParseReportFilter(nil, nil, nil, 60, 10, true)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,110 @@
+package kxcommon
+
+import (
+	"sync"
+	"time"
+)
+
+// rtdbPoolEntry is a pooled RTDB connection and the time it was last known healthy.
+// Its lock serializes the dial and health checks of one connection setting, so an
+// unreachable RTDB does not block the users of the others.
+type rtdbPoolEntry struct {
+	lock      sync.Mutex
+	rtdb      *RTDB
+	lastCheck time.Time
+}
+
+var (
+	rtdbPool     = make(map[RTDBConfig]*rtdbPoolEntry)
+	rtdbPoolLock sync.Mutex
+	// RTDBHealthCheckInterval is how long a pooled connection is trusted before it is PINGed again
+	RTDBHealthCheckInterval = 30 * time.Second
+)
+
+const (
+	rtdbDefaultDB        = 0
+	rtdbDefaultJSONField = "json"
+)
+
+// GetPooledRTDB returns the process-wide RTDB connection for a connection setting (see ParseRTDBConfig), opening it on first use.
+// Connections are PINGed at most every RTDBHealthCheckInterval and reopened lazily when unhealthy.
+// The returned RTDB is shared and must not be closed by the caller.
+func GetPooledRTDB(setting interface{}) (*RTDB, error) {
+	config, err := ParseRTDBConfig(setting)
+	if err != nil {
+		return nil, err
+	}
+
+	rtdbPoolLock.Lock()
+	entry, found := rtdbPool[config]
+	if !found {
+		entry = &rtdbPoolEntry{}
+		rtdbPool[config] = entry
+	}
+	rtdbPoolLock.Unlock()
+
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	if entry.rtdb != nil {
+		if time.Since(entry.lastCheck) < RTDBHealthCheckInterval {
+			return entry.rtdb, nil
+		}
+		if err := entry.rtdb.PingRTDB(); err == nil {
+			entry.lastCheck = time.Now()
+			return entry.rtdb, nil
+		}
+		// unhealthy: drop it and reconnect below
+		entry.rtdb.CloseRTDB()
+		entry.rtdb = nil
+	}
+
+	rtdb := config.NewRTDB()
+	if err := rtdb.OpenRTDB(); err != nil {
+		return nil, err
+	}
+	entry.rtdb = rtdb
+	entry.lastCheck = time.Now()
+	return rtdb, nil
+}
+
+// InvalidatePooledRTDB forces the connection for a connection setting to be checked on its next use
+func InvalidatePooledRTDB(setting interface{}) {
+	config, err := ParseRTDBConfig(setting)
+	if err != nil {
+		return
+	}
+	rtdbPoolLock.Lock()
+	entry, found := rtdbPool[config]
+	rtdbPoolLock.Unlock()
+
+	if found {
+		entry.lock.Lock()
+		entry.lastCheck = time.Time{}
+		entry.lock.Unlock()
+	}
+}
+
+// CloseRTDBPool closes every pooled RTDB connection. Called when the engine stops
+func CloseRTDBPool() error {
+	rtdbPoolLock.Lock()
+	entries := make([]*rtdbPoolEntry, 0, len(rtdbPool))
+	for config, entry := range rtdbPool {
+		entries = append(entries, entry)
+		delete(rtdbPool, config)
+	}
+	rtdbPoolLock.Unlock()
+
+	var firstErr error
+	for _, entry := range entries {
+		entry.lock.Lock()
+		if entry.rtdb != nil {
+			if err := entry.rtdb.CloseRTDB(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			entry.rtdb = nil
+		}
+		entry.lock.Unlock()
+	}
+	return firstErr
+}
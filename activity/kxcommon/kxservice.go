@@ -0,0 +1,43 @@
+package kxcommon
+
+import (
+	"github.com/TIBCOSoftware/flogo-lib/util"
+)
+
+const (
+	// ServiceKXConnections is the name of the service closing the shared kx connections
+	ServiceKXConnections = "kxConnections"
+)
+
+// connectionService flushes and closes the shared history writers, AMQP publishers and RTDB connections
+// when the engine stops
+type connectionService struct {
+}
+
+func init() {
+	util.GetDefaultServiceManager().RegisterService(&connectionService{})
+}
+
+func (cs *connectionService) Name() string {
+	return ServiceKXConnections
+}
+
+func (cs *connectionService) Enabled() bool {
+	return true
+}
+
+// Start implements util.Managed.Start(). Connections are opened on first use
+func (cs *connectionService) Start() error {
+	return nil
+}
+
+// Stop implements util.Managed.Stop(). Queued history is written (or buffered) first
+func (cs *connectionService) Stop() error {
+	var rtn error
+	for _, closeFunc := range []func() error{CloseHistWriters, CloseAMQPPublishers, CloseRTDBPool} {
+		if err := closeFunc(); err != nil && rtn == nil {
+			rtn = err
+		}
+	}
+	return rtn
+}
@@ -0,0 +1,72 @@
+package kxcommon
+
+import (
+	"fmt"
+	"time"
+)
+
+// StaleRule holds the maximum age of tag samples before they are considered stale
+type StaleRule struct {
+	// MaxAge applies to every tag without its own max age. Zero disables the check
+	MaxAge    time.Duration
+	TagMaxAge map[string]time.Duration
+}
+
+// StaleRuleNew creates a new staleness rule with a global max age
+func StaleRuleNew(maxAge time.Duration) StaleRule {
+	return StaleRule{maxAge, make(map[string]time.Duration)}
+}
+
+// ParseStaleRule builds a staleness rule out of a global max age and per-tag max ages, all in seconds
+func ParseStaleRule(maxAge interface{}, tagMaxAges map[string]interface{}) (StaleRule, error) {
+	rule := StaleRuleNew(0)
+	if maxAge != nil && maxAge != "" {
+		seconds, err := ToFloat(maxAge)
+		if err != nil || seconds < 0 {
+			return rule, fmt.Errorf("Max age %v is invalid", maxAge)
+		}
+		rule.MaxAge = secondsToDuration(seconds)
+	}
+	for tag, tagMaxAge := range tagMaxAges {
+		seconds, err := ToFloat(tagMaxAge)
+		if err != nil || seconds < 0 {
+			return rule, fmt.Errorf("Max age %v for tag %s is invalid", tagMaxAge, tag)
+		}
+		rule.TagMaxAge[tag] = secondsToDuration(seconds)
+	}
+	return rule, nil
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// MaxAgeFor gets the max age that applies to a tag
+func (rule StaleRule) MaxAgeFor(tag string) time.Duration {
+	if maxAge, ok := rule.TagMaxAge[tag]; ok {
+		return maxAge
+	}
+	return rule.MaxAge
+}
+
+// IsStale checks if a sample of a tag is older than its max age. Samples without timestamp are not checked
+func (rule StaleRule) IsStale(tag string, rtVal *RtVal, now time.Time) bool {
+	maxAge := rule.MaxAgeFor(tag)
+	if maxAge <= 0 || rtVal == nil || rtVal.Timestamp.IsZero() {
+		return false
+	}
+	return now.Sub(rtVal.Timestamp) > maxAge
+}
+
+// ApplyStaleness downgrades the current value of a stale OK object to QualityOld.
+// Returns true when the quality was changed.
+func (rule StaleRule) ApplyStaleness(rtpObject *KXRTPObject, now time.Time) bool {
+	if rtpObject.Cv == nil || rtpObject.Cv.Quality != QualityOk {
+		return false
+	}
+	if !rule.IsStale(rtpObject.Tag, rtpObject.Cv, now) {
+		return false
+	}
+	rtpObject.Cv.Quality = QualityOld
+	return true
+}
@@ -1,7 +1,8 @@
 package kxcommon
 
 import (
-	"fmt"
+	"net"
+	"strconv"
 	"time"
 	_ "github.com/influxdata/influxdb1-client" // this is important because of the bug in go mod
 	influxdb "github.com/influxdata/influxdb1-client/v2"
@@ -33,6 +34,8 @@ type KXHistTSRecord struct {
 	ValueStr	string
 	Quality		string
 	TimeStamp	time.Time
+	VType		ValueType	`json:",omitempty"`
+	Units		string		`json:",omitempty"`
 }
 
 var (
@@ -46,7 +49,7 @@ func TSDBNew (hostName string, port int, userName string, password string) *TSDB
 // OpenTSDB opens the Time-Stamped DB
 func (tsdb *TSDB) OpenTSDB () error {
 	con, err := influxdb.NewHTTPClient(influxdb.HTTPConfig{
-		Addr:     fmt.Sprintf("http://%s:%d", tsdb.hostName, tsdb.port),
+		Addr:     "http://" + net.JoinHostPort(tsdb.hostName, strconv.Itoa(tsdb.port)),
 		Username: tsdb.userName,
 		Password: tsdb.password,
 	})
@@ -63,92 +66,80 @@ func (tsdb *TSDB) CloseTSDB() error {
 	return tsdb.connection.Close()
 }
 
-// QueryTSOneTagTimeRange get records from TimeStamped database for one tag in a time range
-func (tsdb *TSDB)  QueryTSOneTagTimeRange(database string, table string, tag string, startTimeStamp time.Time, endTimeStamp time.Time) ([]map[string]interface{}, error){
-	// start building the query sentence
-	// select time, "tag", value from timeseries where "tag" = 'IED1.A.TOTALSCANS' and "time" = 1553356273872000000
-
-	startTimeMs := startTimeStamp.UnixNano()
-	endTimeMs := endTimeStamp.UnixNano()
-	var rtn []map[string]interface{}
-
-	//fmt.Printf("start Time: %d - end time: %d\n", startTimeMs, endTimeMs)
-
-	queryStr := " select %s from %s %s"
-	fieldStr := "*"
-	whereClause := fmt.Sprintf(" where \"tag\" = '%s' and time >= %d and time <= %d", tag, startTimeMs, endTimeMs)
-
-	queryStr = fmt.Sprintf(queryStr, fieldStr, table, whereClause)
-
-	query := influxdb.Query {
-		Command: queryStr,
-		Database: database,
-		Precision: tsdb.precision,
-	}
-	resp, err := tsdb.connection.Query(query)
+// QueryTS runs a query built with TSQuery. Tag names and time bounds are sent as bound parameters
+func (tsdb *TSDB) QueryTS(database string, query *TSQuery) ([]map[string]interface{}, error) {
+	queryStr, params, err := query.Build()
 	if err != nil {
 		return nil, err
 	}
-	//
-	// any rows returned?
-	//
-	if (len(resp.Results) > 0) {
-		 //res := make (map[string]string, len(res.Series.Columns))
-		 for _, res := range resp.Results {
-			 for _,sr := range res.Series {
-				for _, val := range sr.Values {
-					rec := make(map[string]interface{})
-					for j, col := range sr.Columns {
-						rec[col] = val[j] 
-					}
-					rtn = append(rtn, rec)
-				}
-			 }
-		 }
+	return tsdb.queryRecords(queryStr, database, params)
+}
+
+// QueryTSTags get records from TimeStamped database for several tags in a time range. No fields selects all of them.
+// Records are ordered by time (newest first if desc) and carry the "tag" column
+func (tsdb *TSDB) QueryTSTags(database string, table string, tags []string, fields []string, startTimeStamp time.Time, endTimeStamp time.Time, desc bool) ([]map[string]interface{}, error) {
+	if len(tags) == 0 {
+		return nil, nil
 	}
-	return rtn, nil
+	query := TSQueryNew(table).Tags(tags...).TimeRange(startTimeStamp, endTimeStamp)
+	if len(fields) > 0 {
+		query.Select(tsTagKey)
+		query.Select(fields...)
+	}
+	if desc {
+		query.OrderDesc()
+	}
+	return tsdb.QueryTS(database, query)
+}
+
+// QueryTSOneTagTimeRange get records from TimeStamped database for one tag in a time range
+func (tsdb *TSDB)  QueryTSOneTagTimeRange(database string, table string, tag string, startTimeStamp time.Time, endTimeStamp time.Time) ([]map[string]interface{}, error){
+	query := TSQueryNew(table).Tags(tag).TimeRange(startTimeStamp, endTimeStamp)
+	return tsdb.QueryTS(database, query)
 }
 
 // QueryTSOneTagLastValue get lasr record from TimeStamped database for one tag where time < specified
 func (tsdb *TSDB)  QueryTSOneTagLastValue(database string, table string, tag string, endTimeStamp time.Time) (map[string]interface{}, error){
-	// start building the query sentence
-	// select time, "tag", value from timeseries where "tag" = 'IED1.A.TOTALSCANS' and "time" = 1553356273872000000
-
-	endTimeMs := endTimeStamp.UnixNano()
-	var rtn map[string]interface{}
-
-	//fmt.Printf("end time: %d\n", endTimeMs)
-
-	queryStr := " select %s from %s %s"
-	fieldStr := "*"
-	whereClause := fmt.Sprintf(" where \"tag\" = '%s' and time < %d order by time desc limit 1", tag, endTimeMs)
-
-	queryStr = fmt.Sprintf(queryStr, fieldStr, table, whereClause)
-	//fmt.Printf("Query: %s\n", queryStr)
+	query := TSQueryNew(table).Tags(tag).Before(endTimeStamp).OrderDesc().Limit(1)
+	records, err := tsdb.QueryTS(database, query)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return records[0], nil
+}
 
-	query := influxdb.Query {
-		Command: queryStr,
-		Database: database,
+// QueryTSOneTagGroupBy gets a server side aggregate of fields of one tag per time bucket of the given interval.
+// fill is an InfluxQL fill option (previous, null, none, linear). Records have "time" and the field names as columns
+func (tsdb *TSDB) QueryTSOneTagGroupBy(database string, table string, tag string, function string, fields []string, startTimeStamp time.Time, endTimeStamp time.Time, interval time.Duration, fill string) ([]map[string]interface{}, error) {
+	query := TSQueryNew(table)
+	for _, field := range fields {
+		query.SelectAggregateAs(function, field, field)
 	}
+	query.Tags(tag).TimeRange(startTimeStamp, endTimeStamp).GroupByTime(interval, fill)
+	return tsdb.QueryTS(database, query)
+}
+
+// queryRecords runs a query and flattens all returned rows into records keyed by column name
+func (tsdb *TSDB) queryRecords(queryStr string, database string, params map[string]interface{}) ([]map[string]interface{}, error) {
+	query := influxdb.NewQueryWithParameters(queryStr, database, tsdb.precision, params)
 	resp, err := tsdb.connection.Query(query)
 	if err != nil {
 		return nil, err
 	}
-	//
-	// any rows returned?
-	//
-	if (len(resp.Results) > 0) {
-		 //res := make (map[string]string, len(res.Series.Columns))
-		 // create an array of KXHistTSRecord out of the response
-		 for _, res := range resp.Results {
-			 for _,sr := range res.Series {
-				//fmt.Printf("name: %s\n", sr.Name)
-				rtn = make(map[string]interface{})
+	if resp.Error() != nil {
+		return nil, resp.Error()
+	}
+	var rtn []map[string]interface{}
+	for _, res := range resp.Results {
+		for _, sr := range res.Series {
+			for _, val := range sr.Values {
+				rec := make(map[string]interface{})
 				for j, col := range sr.Columns {
-					rtn[col] = sr.Values[0][j] 
+					rec[col] = val[j]
 				}
-			 }
-		 }
+				rtn = append(rtn, rec)
+			}
+		}
 	}
 	return rtn, nil
-}
\ No newline at end of file
+}
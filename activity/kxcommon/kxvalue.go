@@ -0,0 +1,230 @@
+package kxcommon
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ValueType enum - the type of the value of a point
+type ValueType int
+
+// Values without a type are floats, as every value was before types existed
+const (
+	ValueTypeFloat ValueType = iota
+	ValueTypeInt
+	ValueTypeBool
+	ValueTypeString
+)
+
+var valueTypeNames = [...]string{
+	"FLOAT",
+	"INT",
+	"BOOL",
+	"STRING"}
+
+func (valueType ValueType) String() string {
+	if valueType < ValueTypeFloat || valueType > ValueTypeString {
+		return "UNKNOWN"
+	}
+	return valueTypeNames[valueType]
+}
+
+// GetValueTypeFromString decodes a value type (FLOAT, INT, BOOL or STRING, in any case). Empty is FLOAT
+func GetValueTypeFromString(valueTypeStr string) (ValueType, error) {
+	name := strings.ToUpper(strings.TrimSpace(valueTypeStr))
+	if name == "" {
+		return ValueTypeFloat, nil
+	}
+	for i, n := range valueTypeNames {
+		if n == name {
+			return ValueType(i), nil
+		}
+	}
+	return ValueTypeFloat, fmt.Errorf("Value type '%s' is unknown", valueTypeStr)
+}
+
+// MarshalText encodes value types by name in JSON messages
+func (valueType ValueType) MarshalText() ([]byte, error) {
+	return []byte(valueType.String()), nil
+}
+
+// UnmarshalText decodes value types by name
+func (valueType *ValueType) UnmarshalText(text []byte) error {
+	vt, err := GetValueTypeFromString(string(text))
+	if err != nil {
+		return err
+	}
+	*valueType = vt
+	return nil
+}
+
+// TypedValue is the value of a point, with its engineering units. Only the field of its type is meaningful
+type TypedValue struct {
+	Type  ValueType
+	Float float64
+	Int   int64
+	Bool  bool
+	Str   string
+	Units string
+}
+
+// FloatValue creates a float value
+func FloatValue(value float64) TypedValue {
+	return TypedValue{Type: ValueTypeFloat, Float: value}
+}
+
+// IntValue creates an integer value
+func IntValue(value int64) TypedValue {
+	return TypedValue{Type: ValueTypeInt, Int: value}
+}
+
+// BoolValue creates a boolean value
+func BoolValue(value bool) TypedValue {
+	return TypedValue{Type: ValueTypeBool, Bool: value}
+}
+
+// StringValue creates a text value
+func StringValue(value string) TypedValue {
+	return TypedValue{Type: ValueTypeString, Str: value}
+}
+
+// WithUnits sets the engineering units of a value
+func (value TypedValue) WithUnits(units string) TypedValue {
+	value.Units = units
+	return value
+}
+
+// ParseTypedValue decodes the text of a value of the given type
+func ParseTypedValue(valueType ValueType, text string) (TypedValue, error) {
+	text = strings.TrimSpace(text)
+	switch valueType {
+	case ValueTypeFloat:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return TypedValue{}, fmt.Errorf("Value '%s' is not a float", text)
+		}
+		return FloatValue(f), nil
+	case ValueTypeInt:
+		i, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			// integers written as floats, as long as they have no fraction
+			f, ferr := strconv.ParseFloat(text, 64)
+			if ferr != nil || f != math.Trunc(f) || math.Abs(f) > math.MaxInt64 {
+				return TypedValue{}, fmt.Errorf("Value '%s' is not an integer", text)
+			}
+			i = int64(f)
+		}
+		return IntValue(i), nil
+	case ValueTypeBool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			// digital points written as numbers
+			f, ferr := strconv.ParseFloat(text, 64)
+			if ferr != nil {
+				return TypedValue{}, fmt.Errorf("Value '%s' is not a boolean", text)
+			}
+			b = f != 0
+		}
+		return BoolValue(b), nil
+	case ValueTypeString:
+		return StringValue(text), nil
+	}
+	return TypedValue{}, fmt.Errorf("Value type %d is unknown", valueType)
+}
+
+// TypedValueOf gets the typed value of a Go value (bool, integers, floats, json.Number or string)
+func TypedValueOf(value interface{}) (TypedValue, error) {
+	switch v := value.(type) {
+	case TypedValue:
+		return v, nil
+	case bool:
+		return BoolValue(v), nil
+	case int:
+		return IntValue(int64(v)), nil
+	case int32:
+		return IntValue(int64(v)), nil
+	case int64:
+		return IntValue(v), nil
+	case float32:
+		return FloatValue(float64(v)), nil
+	case float64:
+		return FloatValue(v), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return IntValue(i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return TypedValue{}, err
+		}
+		return FloatValue(f), nil
+	case string:
+		return StringValue(v), nil
+	}
+	return TypedValue{}, fmt.Errorf("Values of type %T are not supported", value)
+}
+
+// String gets the text of the value, without loss: floats keep all their digits
+func (value TypedValue) String() string {
+	switch value.Type {
+	case ValueTypeInt:
+		return strconv.FormatInt(value.Int, 10)
+	case ValueTypeBool:
+		return strconv.FormatBool(value.Bool)
+	case ValueTypeString:
+		return value.Str
+	}
+	return strconv.FormatFloat(value.Float, 'f', -1, 64)
+}
+
+// Float64 gets the numeric view of the value, for calculations and numeric history: booleans are 0 or 1, and
+// text that is not a number is 0
+func (value TypedValue) Float64() float64 {
+	switch value.Type {
+	case ValueTypeInt:
+		return float64(value.Int)
+	case ValueTypeBool:
+		if value.Bool {
+			return 1
+		}
+		return 0
+	case ValueTypeString:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value.Str), 64)
+		if err != nil {
+			return 0
+		}
+		return f
+	}
+	return value.Float
+}
+
+// Interface gets the value as a float64, int64, bool or string
+func (value TypedValue) Interface() interface{} {
+	switch value.Type {
+	case ValueTypeInt:
+		return value.Int
+	case ValueTypeBool:
+		return value.Bool
+	case ValueTypeString:
+		return value.Str
+	}
+	return value.Float
+}
+
+// Equal checks if two values have the same type, value and units
+func (value TypedValue) Equal(other TypedValue) bool {
+	return value.Type == other.Type && value.Units == other.Units && value.String() == other.String()
+}
+
+// decodeTypedValue decodes the text of a value sent with its type. Untyped values that are not numbers, as
+// written before types existed, are text
+func decodeTypedValue(valueType ValueType, text string, units string) TypedValue {
+	value, err := ParseTypedValue(valueType, text)
+	if err != nil {
+		value = StringValue(text)
+	}
+	return value.WithUnits(units)
+}
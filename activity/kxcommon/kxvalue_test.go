@@ -0,0 +1,85 @@
+package kxcommon
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOldPayloadsDecodeAsFloat(t *testing.T) {
+
+	// payloads written before values had types and units
+	sm, err := DecodeScanMessage(`{"MID":"1","Payload":[` +
+		`{"ID":1,"Tag":"T1","Value":"12.5","Quality":"OK","MType":0,"TimeStamp":"2018-06-01T12:00:00Z"},` +
+		`{"ID":2,"Tag":"T2","Value":"OPEN","Quality":"OK","MType":0,"TimeStamp":"2018-06-01T12:00:00Z"}]}`)
+	assert.Nil(t, err)
+	assert.Equal(t, ValueTypeFloat, sm.Payload[0].VType)
+	assert.Equal(t, FloatValue(12.5), sm.Payload[0].TypedValue())
+	assert.Equal(t, StringValue("OPEN"), sm.Payload[1].TypedValue())
+
+	var obj KXRTPObject
+	err = obj.Deserialize(`{"ID":1,"Tag":"T1","Ptype":"AI","Cv":{"Value":3.25,"ValueStr":"","Quality":0,"Timestamp":"2018-06-01T12:00:00Z"}}`)
+	assert.Nil(t, err)
+	assert.Equal(t, ValueTypeFloat, obj.Cv.Type)
+	assert.Equal(t, FloatValue(3.25), obj.Cv.TypedValue())
+
+	var arg AnalyticsArg
+	assert.Nil(t, json.Unmarshal([]byte(`{"Name":"x","Value":"7","Quality":"OK"}`), &arg))
+	assert.Equal(t, FloatValue(7), arg.TypedValue())
+}
+
+func TestTypedPayloadsRoundTrip(t *testing.T) {
+
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	values := []TypedValue{
+		FloatValue(12.5).WithUnits("degC"),
+		IntValue(9007199254740993).WithUnits("pcs"),
+		BoolValue(true),
+		StringValue("OPEN").WithUnits("state"),
+	}
+
+	for _, value := range values {
+		sm := ScanMessageNew()
+		sm.ScanMessageAdd(ScanMessageUnitNewTyped(1, "T1", value, QualityOk.String(), MessageUnitTypeValue, now))
+		text, err := SerializeObject(sm)
+		assert.Nil(t, err)
+		decoded, err := DecodeScanMessage(text)
+		assert.Nil(t, err)
+		assert.Equal(t, value, decoded.Payload[0].TypedValue(), value.String())
+
+		obj := KXRTPObject{ID: 1, Tag: "T1", Cv: &RtVal{Quality: QualityOk, Timestamp: now}}
+		obj.Cv.SetTypedValue(value)
+		text, err = obj.Serialize()
+		assert.Nil(t, err)
+		var decodedObj KXRTPObject
+		assert.Nil(t, decodedObj.Deserialize(text))
+		assert.Equal(t, value, decodedObj.Cv.TypedValue(), value.String())
+
+		bytes, err := json.Marshal(AnalyticsArgNewTyped("x", value, QualityOk.String()))
+		assert.Nil(t, err)
+		var arg AnalyticsArg
+		assert.Nil(t, json.Unmarshal(bytes, &arg))
+		assert.Equal(t, value, arg.TypedValue(), value.String())
+	}
+}
+
+func TestValueTypeJSON(t *testing.T) {
+
+	bytes, err := json.Marshal(ScanMessageUnitNewTyped(1, "T1", IntValue(1).WithUnits("pcs"), "OK", MessageUnitTypeValue, time.Time{}))
+	assert.Nil(t, err)
+	assert.Contains(t, string(bytes), `"VType":"INT","Units":"pcs"`)
+
+	// floats keep the old payload
+	bytes, err = json.Marshal(ScanMessageUnitNew(1, "T1", "1.5", "OK", MessageUnitTypeValue, time.Time{}))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(bytes), "VType")
+	assert.NotContains(t, string(bytes), "Units")
+
+	var smu ScanMessageUnit
+	assert.Nil(t, json.Unmarshal([]byte(`{"Tag":"T1","Value":"1","VType":"bool"}`), &smu))
+	assert.Equal(t, BoolValue(true), smu.TypedValue())
+
+	assert.NotNil(t, json.Unmarshal([]byte(`{"Tag":"T1","Value":"1","VType":"DOUBLE"}`), &smu))
+}
@@ -0,0 +1,291 @@
+package kxcommon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// TSSample is a single time stamped value. It holds until the next sample (step interpolation)
+type TSSample struct {
+	TimeStamp time.Time
+	Value     float64
+	Quality   Quality
+}
+
+// TSWindow contains the samples of a tag in the time window [Start, End]. The last sample before
+// the window, if any, is carried forward to Start.
+type TSWindow struct {
+	Tag     string
+	Start   time.Time
+	End     time.Time
+	Samples []TSSample
+}
+
+// tsSegment is the span of time a sample holds inside the window
+type tsSegment struct {
+	value    float64
+	duration float64
+}
+
+// QueryTSWindow gets the samples of one tag in a time window, including the carried forward value before it
+func (tsdb *TSDB) QueryTSWindow(database string, table string, tag string, startTimeStamp time.Time, endTimeStamp time.Time) (TSWindow, error) {
+	window := TSWindow{tag, startTimeStamp, endTimeStamp, nil}
+
+	windowResult, err := tsdb.QueryTSOneTagTimeRange(database, table, tag, startTimeStamp, endTimeStamp)
+	if err != nil {
+		return window, err
+	}
+	lastValueOutOfWindow, err := tsdb.QueryTSOneTagLastValue(database, table, tag, startTimeStamp)
+	if err != nil {
+		return window, err
+	}
+	if len(lastValueOutOfWindow) != 0 {
+		sample, err := SampleFromRecord(lastValueOutOfWindow)
+		if err != nil {
+			return window, err
+		}
+		sample.TimeStamp = startTimeStamp
+		window.Samples = append(window.Samples, sample)
+	}
+	for _, record := range windowResult {
+		sample, err := SampleFromRecord(record)
+		if err != nil {
+			return window, err
+		}
+		window.Samples = append(window.Samples, sample)
+	}
+	return window, nil
+}
+
+// QueryTSWindowDownsampled gets the window of one tag aggregated by the TSDB into buckets of the given resolution
+// (last value and quality of each bucket, filled with the previous ones), so only one record per bucket is transferred.
+// Changes are moved to the start of their bucket.
+func (tsdb *TSDB) QueryTSWindowDownsampled(database string, table string, tag string, startTimeStamp time.Time, endTimeStamp time.Time, resolution time.Duration) (TSWindow, error) {
+	window := TSWindow{tag, startTimeStamp, endTimeStamp, nil}
+
+	buckets, err := tsdb.QueryTSOneTagGroupBy(database, table, tag, "LAST", []string{histValueField, histQualityField}, startTimeStamp, endTimeStamp, resolution, "previous")
+	if err != nil {
+		return window, err
+	}
+	lastValueOutOfWindow, err := tsdb.QueryTSOneTagLastValue(database, table, tag, startTimeStamp)
+	if err != nil {
+		return window, err
+	}
+	if len(lastValueOutOfWindow) != 0 {
+		sample, err := SampleFromRecord(lastValueOutOfWindow)
+		if err != nil {
+			return window, err
+		}
+		sample.TimeStamp = startTimeStamp
+		window.Samples = append(window.Samples, sample)
+	}
+	for _, bucket := range buckets {
+		// buckets before the first record in the window stay empty
+		if bucket[histValueField] == nil {
+			continue
+		}
+		sample, err := SampleFromRecord(bucket)
+		if err != nil {
+			return window, err
+		}
+		// the first bucket is aligned by the TSDB and may start before the window
+		if sample.TimeStamp.Before(startTimeStamp) {
+			sample.TimeStamp = startTimeStamp
+		}
+		// repeated samples add nothing to a step function
+		if n := len(window.Samples); n > 0 && window.Samples[n-1].Value == sample.Value && window.Samples[n-1].Quality == sample.Quality {
+			continue
+		}
+		window.Samples = append(window.Samples, sample)
+	}
+	return window, nil
+}
+
+// SampleFromRecord decodes a time series record with "time", "value" and optional "quality" columns
+func SampleFromRecord(record map[string]interface{}) (TSSample, error) {
+	var sample TSSample
+
+	tnum, ok := record["time"].(json.Number)
+	if !ok {
+		return sample, fmt.Errorf("time is invalid %v", record["time"])
+	}
+	tint, err := tnum.Int64()
+	if err != nil {
+		return sample, fmt.Errorf("time is invalid %v", record["time"])
+	}
+	vnum, ok := record["value"].(json.Number)
+	if !ok {
+		return sample, fmt.Errorf("value is invalid %v", record["value"])
+	}
+	v, err := vnum.Float64()
+	if err != nil {
+		return sample, fmt.Errorf("value is invalid %v", record["value"])
+	}
+	sample.TimeStamp = time.Unix(0, tint)
+	sample.Value = v
+	sample.Quality = QualityOk
+	if qualityStr, ok := record["quality"].(string); ok {
+		if quality, err := GetQualityFromString(qualityStr); err == nil {
+			sample.Quality = quality
+		}
+	}
+	return sample, nil
+}
+
+// IsEmpty checks if the window has no data at all
+func (window TSWindow) IsEmpty() bool {
+	return len(window.Samples) == 0
+}
+
+// QualityInputs gets the qualities of the samples of the window
+func (window TSWindow) QualityInputs() []QualityInput {
+	inputs := make([]QualityInput, len(window.Samples))
+	for i, sample := range window.Samples {
+		inputs[i] = QualityInputNew(sample.Quality, sample.TimeStamp)
+	}
+	return inputs
+}
+
+// segments gets how long (in seconds) each sample holds until the next one or the end of the window
+func (window TSWindow) segments() []tsSegment {
+	segments := make([]tsSegment, 0, len(window.Samples))
+	for i, sample := range window.Samples {
+		next := window.End
+		if i < len(window.Samples)-1 {
+			next = window.Samples[i+1].TimeStamp
+		}
+		segments = append(segments, tsSegment{sample.Value, next.Sub(sample.TimeStamp).Seconds()})
+	}
+	return segments
+}
+
+// Duration gets the span in seconds covered by data (from the first sample to the end of the window)
+func (window TSWindow) Duration() float64 {
+	if window.IsEmpty() {
+		return 0
+	}
+	return window.End.Sub(window.Samples[0].TimeStamp).Seconds()
+}
+
+var errEmptyWindow = errors.New("no data in the time window")
+
+// Mean calculates the time-weighted mean
+func (window TSWindow) Mean() (float64, error) {
+	total := window.Duration()
+	if total <= 0 {
+		return 0, errEmptyWindow
+	}
+	var sum float64
+	for _, segment := range window.segments() {
+		sum += segment.value * segment.duration
+	}
+	return sum / total, nil
+}
+
+// Min calculates the minimum value held in the window
+func (window TSWindow) Min() (float64, error) {
+	if window.IsEmpty() {
+		return 0, errEmptyWindow
+	}
+	min := math.Inf(1)
+	for _, sample := range window.Samples {
+		min = math.Min(min, sample.Value)
+	}
+	return min, nil
+}
+
+// Max calculates the maximum value held in the window
+func (window TSWindow) Max() (float64, error) {
+	if window.IsEmpty() {
+		return 0, errEmptyWindow
+	}
+	max := math.Inf(-1)
+	for _, sample := range window.Samples {
+		max = math.Max(max, sample.Value)
+	}
+	return max, nil
+}
+
+// StdDev calculates the time-weighted standard deviation
+func (window TSWindow) StdDev() (float64, error) {
+	mean, err := window.Mean()
+	if err != nil {
+		return 0, err
+	}
+	var sum float64
+	for _, segment := range window.segments() {
+		sum += (segment.value - mean) * (segment.value - mean) * segment.duration
+	}
+	return math.Sqrt(sum / window.Duration()), nil
+}
+
+// Integral calculates the area under the values, with time measured in units of the given number of seconds
+// (e.g. 3600 to totalize a flow rate per hour)
+func (window TSWindow) Integral(unitSeconds float64) (float64, error) {
+	if window.IsEmpty() {
+		return 0, errEmptyWindow
+	}
+	if unitSeconds <= 0 {
+		return 0, fmt.Errorf("integral time unit %f is invalid", unitSeconds)
+	}
+	var sum float64
+	for _, segment := range window.segments() {
+		sum += segment.value * segment.duration
+	}
+	return sum / unitSeconds, nil
+}
+
+// TimeInState calculates the seconds the value was equal to state
+func (window TSWindow) TimeInState(state float64) (float64, error) {
+	if window.IsEmpty() {
+		return 0, errEmptyWindow
+	}
+	var sum float64
+	for _, segment := range window.segments() {
+		if segment.value == state {
+			sum += segment.duration
+		}
+	}
+	return sum, nil
+}
+
+// RateOfChange calculates the change of value per second between the first and last samples
+func (window TSWindow) RateOfChange() (float64, error) {
+	if len(window.Samples) < 2 {
+		return 0, errEmptyWindow
+	}
+	first := window.Samples[0]
+	last := window.Samples[len(window.Samples)-1]
+	elapsed := last.TimeStamp.Sub(first.TimeStamp).Seconds()
+	if elapsed <= 0 {
+		return 0, errEmptyWindow
+	}
+	return (last.Value - first.Value) / elapsed, nil
+}
+
+// Percentile calculates the time-weighted percentile (0-100): the value the tag stayed at or below for that share of time
+func (window TSWindow) Percentile(percentile float64) (float64, error) {
+	if percentile < 0 || percentile > 100 {
+		return 0, fmt.Errorf("percentile %f is invalid", percentile)
+	}
+	total := window.Duration()
+	if total <= 0 {
+		return 0, errEmptyWindow
+	}
+	segments := window.segments()
+	sort.Slice(segments, func(i, j int) bool { return segments[i].value < segments[j].value })
+
+	target := total * percentile / 100
+	var accumulated float64
+	for _, segment := range segments {
+		accumulated += segment.duration
+		if accumulated >= target {
+			return segment.value, nil
+		}
+	}
+	return segments[len(segments)-1].value, nil
+}
@@ -0,0 +1,121 @@
+package kxhistwrite
+
+import (
+	"fmt"
+	"time"
+	"github.com/TIBCOSoftware/flogo-lib/core/activity"
+	"github.com/TIBCOSoftware/flogo-lib/logger"
+	"github.com/mtorre-iot/flogo-contrib/activity/kxcommon"
+)
+
+// activityLog is the default logger for the Log Activity
+var activityLog = logger.GetLogger("activity-flogo-kxhistwrite")
+
+const (
+	ivTSDB = "TSDB"
+	ivInputStream = "inputStream"
+	ivPrecision = "precision"
+	ivBatchSize = "batchSize"
+	ivFlushInterval = "flushInterval"
+	ivBufferFile = "bufferFile"
+	ivFlush = "flush"
+	ovPending = "pending"
+)
+
+func init() {
+	activityLog.SetLogLevel(logger.InfoLevel)
+}
+
+// KXHistWriteActivity is an Activity that is used to historize scan messages (raw data or analytics results) into the TSDB
+type KXHistWriteActivity struct {
+	metadata *activity.Metadata
+}
+
+// NewActivity creates a new AppActivity
+func NewActivity(metadata *activity.Metadata) activity.Activity {
+	return &KXHistWriteActivity{metadata: metadata}
+}
+
+// Metadata returns the activity's metadata
+func (a *KXHistWriteActivity) Metadata() *activity.Metadata {
+	return a.metadata
+}
+
+// Eval implements api.Activity.Eval - Queues the scan message units for the TSDB
+func (a *KXHistWriteActivity) Eval(context activity.Context) (done bool, err error) {
+
+	// decode the TSDB connection setting (URI, JSON object or <hostname>:<port>:<userName>:<password>:<databaseName>:<historyTable>)
+	tsdbConfig, err := kxcommon.ParseTSDBConfig(context.GetInput(ivTSDB))
+	if err != nil {
+		activityLog.Errorf("[kxhistwrite] Invalid TSDB setting. Error %s", err)
+		return false, err
+	}
+	config := kxcommon.HistWriterConfig{
+		Database: tsdbConfig.Database,
+		Table: tsdbConfig.Table,
+		Precision: tsdbConfig.Precision,
+		BatchSize: 100,
+		FlushInterval: 10 * time.Second,
+	}
+	if precision, _ := context.GetInput(ivPrecision).(string); precision != "" {
+		config.Precision = precision
+	}
+	config.BufferFile, _ = context.GetInput(ivBufferFile).(string)
+	if batchSize := context.GetInput(ivBatchSize); batchSize != nil && batchSize != "" {
+		size, err := kxcommon.ToFloat(batchSize)
+		if err != nil || size < 1 {
+			return false, fmt.Errorf("[kxhistwrite] Invalid batch size %v", batchSize)
+		}
+		config.BatchSize = int(size)
+	}
+	if flushInterval := context.GetInput(ivFlushInterval); flushInterval != nil && flushInterval != "" {
+		seconds, err := kxcommon.ToFloat(flushInterval)
+		if err != nil || seconds < 0 {
+			return false, fmt.Errorf("[kxhistwrite] Invalid flush interval %v", flushInterval)
+		}
+		config.FlushInterval = time.Duration(seconds * float64(time.Second))
+	}
+
+	// the writer is shared across evaluations, so batches span several scan messages
+	writer, err := kxcommon.GetPooledHistWriter(tsdbConfig, config)
+	if err != nil {
+		activityLog.Errorf("[kxhistwrite] History writer could not be created. Error %s", err)
+		return false, err
+	}
+
+	inputStream, _ := context.GetInput(ivInputStream).(string)
+	if inputStream != "" {
+		scanMessage, err := kxcommon.DecodeScanMessage(inputStream)
+		if err != nil {
+			activityLog.Errorf("[kxhistwrite] Incoming message could not be deserialized. Message: %s Error: %s", inputStream, err)
+			return false, err
+		}
+		records := make([]kxcommon.KXHistTSRecord, 0, len(scanMessage.Payload))
+		for _, smu := range scanMessage.Payload {
+			records = append(records, kxcommon.KXHistTSRecordFromScanMessageUnit(smu))
+		}
+		activityLog.Debugf("[kxhistwrite] %d records queued from message %s", len(records), scanMessage.MID)
+		err = writer.Write(records...)
+		if invalid, ok := err.(*kxcommon.InvalidHistRecordsError); ok {
+			for _, record := range invalid.Records {
+				activityLog.Warnf("[kxhistwrite] Record of tag %s with value %f could not be historized - dropped", record.Tag, record.Value)
+			}
+		} else if err != nil {
+			activityLog.Errorf("[kxhistwrite] History could not be written. Error %s", err)
+			return false, err
+		}
+	}
+	if flush, _ := kxcommon.ToBool(context.GetInput(ivFlush)); flush {
+		err = writer.Flush()
+		if err != nil {
+			activityLog.Errorf("[kxhistwrite] History could not be written. Error %s", err)
+			return false, err
+		}
+	}
+	// records kept in the buffer file are written back (backfilled) once the TSDB is reachable again
+	if lastErr := writer.LastError(); lastErr != nil {
+		activityLog.Warnf("[kxhistwrite] Time Stamp Database unreachable, history is being buffered. Error %s", lastErr)
+	}
+	context.SetOutput(ovPending, writer.Pending())
+	return true, nil
+}
@@ -0,0 +1,106 @@
+package kxhistwrite
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TIBCOSoftware/flogo-lib/core/activity"
+	"github.com/mtorre-iot/flogo-contrib/activity/kxcommon"
+	"github.com/stretchr/testify/assert"
+)
+
+var activityMetadata *activity.Metadata
+
+func getActivityMetadata() *activity.Metadata {
+
+	if activityMetadata == nil {
+		jsonMetadataBytes, err := ioutil.ReadFile("activity.json")
+		if err != nil {
+			panic("No Json Metadata found for activity.json path")
+		}
+
+		activityMetadata = activity.NewMetadata(string(jsonMetadataBytes))
+	}
+
+	return activityMetadata
+}
+
+func TestCreate(t *testing.T) {
+
+	act := NewActivity(getActivityMetadata())
+
+	if act == nil {
+		t.Error("Activity Not Created")
+		t.Fail()
+		return
+	}
+}
+
+func TestRecordFromScanMessageUnit(t *testing.T) {
+
+	timeStamp := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	smu := kxcommon.ScanMessageUnitNew(1, "TAG1", "12.5", "OK", kxcommon.MessageUnitTypeValue, timeStamp)
+	record := kxcommon.KXHistTSRecordFromScanMessageUnit(smu)
+	assert.Equal(t, "TAG1", record.Tag)
+	assert.Equal(t, 12.5, record.Value)
+	assert.Equal(t, "", record.ValueStr)
+	assert.Equal(t, "OK", record.Quality)
+	assert.Equal(t, timeStamp, record.TimeStamp)
+
+	// non numeric values are kept as text, missing quality and time stamp are filled
+	smu = kxcommon.ScanMessageUnitNew(2, "TAG2", "OPEN", "", kxcommon.MessageUnitTypeValue, time.Time{})
+	record = kxcommon.KXHistTSRecordFromScanMessageUnit(smu)
+	assert.Equal(t, "OPEN", record.ValueStr)
+	assert.Equal(t, kxcommon.QualityUnknown.String(), record.Quality)
+	assert.False(t, record.TimeStamp.IsZero())
+}
+
+func TestHistBufferBackfill(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "kxhistwrite")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	bufferFile := filepath.Join(dir, "history.buf")
+	buffer := kxcommon.HistBufferNew(bufferFile)
+
+	timeStamp := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	var records []kxcommon.KXHistTSRecord
+	for i := 0; i < 5; i++ {
+		records = append(records, kxcommon.KXHistTSRecordNew("TAG1", "", float64(i), "", "OK", timeStamp.Add(time.Duration(i)*time.Second)))
+	}
+	assert.Nil(t, buffer.Append(records[:3]))
+	assert.Nil(t, buffer.Append(records[3:]))
+
+	// the second batch fails: the first one leaves the buffer, the rest stays
+	var written []kxcommon.KXHistTSRecord
+	batches := 0
+	count, err := buffer.Backfill(func(batch []kxcommon.KXHistTSRecord) error {
+		batches++
+		if batches == 2 {
+			return errors.New("TSDB unreachable")
+		}
+		written = append(written, batch...)
+		return nil
+	}, 2)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, records[:2], written)
+
+	written = nil
+	count, err = buffer.Backfill(func(batch []kxcommon.KXHistTSRecord) error {
+		written = append(written, batch...)
+		return nil
+	}, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, records[2:], written)
+
+	_, err = os.Stat(bufferFile)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -3,8 +3,7 @@ package kxreadrtdb
 import (
 	"fmt"
 	"errors"
-	"strings"
-	"strconv"
+	"time"
 	"github.com/TIBCOSoftware/flogo-lib/core/activity"
 	"github.com/TIBCOSoftware/flogo-lib/logger"
 	"github.com/mtorre-iot/flogo-contrib/activity/kxcommon"
@@ -17,7 +16,15 @@ const (
 	ivInputTags = "inputTags"
 	ivRTDBFile = "RTDBFile"
 	ivFunctionName = "functionName"
+	ivQualityPolicy = "qualityPolicy"
+	ivMaxAge = "maxAge"
+	ivTagMaxAges = "tagMaxAges"
+	ivOutputTags = "outputTags"
+	ivFunctionParams = "functionParams"
+	ivExecution = "execution"
 	ovOutput = "outputStream"
+	ovRecords = "outputRecords"
+	ovExecutedLocally = "executedLocally"
 )
 
 func init() {
@@ -42,7 +49,7 @@ func (a *KXReadRTDBActivity) Metadata() *activity.Metadata {
 // Eval implements api.Activity.Eval - Logs the Message
 func (a *KXReadRTDBActivity) Eval(context activity.Context) (done bool, err error) {
 
-	rtdbFile := context.GetInput(ivRTDBFile).(string)
+	rtdbFile := context.GetInput(ivRTDBFile)
 	
 	val := context.GetInput(ivInputTags)
 	inputTagsInterface := val.(map[string]interface{})
@@ -59,6 +66,29 @@ func (a *KXReadRTDBActivity) Eval(context activity.Context) (done bool, err erro
 	if functionName == "" {
 		return false, errors.New("[kxreadrtdb] A function name must be provided")
 	}
+	qualityPolicy, _ := context.GetInput(ivQualityPolicy).(string)
+	qualityRule, err := kxcommon.ResolveQualityRule(functionName, qualityPolicy)
+	if err != nil {
+		return false, errors.New("[kxreadrtdb] Invalid quality policy. Error: " + err.Error())
+	}
+	tagMaxAges, _ := context.GetInput(ivTagMaxAges).(map[string]interface{})
+	staleRule, err := kxcommon.ParseStaleRule(context.GetInput(ivMaxAge), tagMaxAges)
+	if err != nil {
+		return false, errors.New("[kxreadrtdb] Invalid max age. Error: " + err.Error())
+	}
+	outputTagsInterface, _ := context.GetInput(ivOutputTags).(map[string]interface{})
+	outputTags := kxcommon.StringParams(outputTagsInterface)
+	functionParamsInterface, _ := context.GetInput(ivFunctionParams).(map[string]interface{})
+	functionParams := kxcommon.StringParams(functionParamsInterface)
+	executionStr, _ := context.GetInput(ivExecution).(string)
+	execution, err := kxcommon.GetAnalyticsExecutionFromString(executionStr)
+	if err != nil {
+		return false, errors.New("[kxreadrtdb] Invalid execution. Error: " + err.Error())
+	}
+	runLocally, err := execution.RunsLocally(functionName, outputTags)
+	if err != nil {
+		return false, errors.New("[kxreadrtdb] " + err.Error())
+	}
 
 	inputValues := make(map[string]float64)
 	inputObjs := make(map[string]kxcommon.KXRTPObject)
@@ -68,31 +98,38 @@ func (a *KXReadRTDBActivity) Eval(context activity.Context) (done bool, err erro
 			inputValues[tag] = 0.0
 	}
 
-	// decode (unmarshall) the RTDB server pars
-	rtdbPars := strings.Split(rtdbFile,":")
-	// create the realtime DB access object
-	var rtdb kxcommon.RTDB
-	port, err := strconv.Atoi(rtdbPars[1])
-	if err != nil {
-		return false, err
-	}
-	rtdb.RTDBNew(rtdbPars[0], port, rtdbPars[2],rtdbPars[3], 0, "json") 
-	// Open the RealTime DB
-	err = rtdb.OpenRTDB()
+	// get the shared realtime DB connection (pooled across evaluations)
+	rtdb, err := kxcommon.GetPooledRTDB(rtdbFile)
 	if err != nil {
 		activityLog.Error(fmt.Sprintf("[kxreadrtdb] Realtime Database could not be opened. Error %s", err))
 		return false, err
 	}
-	// make sure it closes after finish
-	defer rtdb.CloseRTDB()
-	// check all tags
+	// read all input tags in a single round trip
+	readTags := []string{}
 	for key, pobj := range inputObjs {
 		if pobj.Tag == "" {
-			inputObjs[key], err = rtdb.GetRTPObject(key)
-			if (err != nil)	{
-				activityLog.Error(fmt.Sprintf("[kxreadrtdb] Tag: %s could not be accessed from Realtime Database. Error %s", key, err))
-				return false, err
-			}
+			readTags = append(readTags, key)
+		}
+	}
+	readObjs, tagErrs := rtdb.GetRTPObjects(readTags)
+	if len(tagErrs) > 0 {
+		if kxcommon.HasConnectionError(tagErrs) {
+			kxcommon.InvalidatePooledRTDB(rtdbFile)
+		}
+		for key, tagErr := range tagErrs {
+			activityLog.Error(fmt.Sprintf("[kxreadrtdb] Tag: %s could not be accessed from Realtime Database. Error %s", key, tagErr))
+			err = tagErr
+		}
+		return false, err
+	}
+	for key, pobj := range readObjs {
+		inputObjs[key] = pobj
+	}
+	// samples older than their max age are downgraded to OLD
+	now := time.Now().UTC()
+	for key, pobj := range inputObjs {
+		if staleRule.ApplyStaleness(&pobj, now) {
+			activityLog.Debugf("[kxreadrtdb] Tag: %s is stale. Quality set to %s", key, pobj.Cv.Quality)
 		}
 	}
 	//
@@ -101,9 +138,38 @@ func (a *KXReadRTDBActivity) Eval(context activity.Context) (done bool, err erro
 	args:= [] kxcommon.AnalyticsArg{}
 	for _, pobj := range inputObjs {
 		key,_ := kxcommon.Mapkey(inputTags, pobj.Tag)
-		args = append(args, kxcommon.AnalyticsArgNew(key, fmt.Sprintf("%f", pobj.Cv.Value), pobj.Cv.Quality.String()))
+		args = append(args, kxcommon.AnalyticsArgNewTyped(key, pobj.Cv.TypedValue(), pobj.Cv.Quality.String()))
 	}
 	request := kxcommon.AnalyticsRequestNew(functionName, args)
+	// propagate the input qualities into the request quality
+	qualityInputs := []kxcommon.QualityInput{}
+	for _, pobj := range inputObjs {
+		qualityInputs = append(qualityInputs, kxcommon.QualityInputFromRtVal(pobj.Cv))
+	}
+	request.Quality = qualityRule.Propagate(qualityInputs).String()
+
+	// registered functions run in process. In auto mode, the remote request is the fallback
+	if runLocally {
+		response, evalErr := kxcommon.EvalAnalyticsRequest(request, functionParams)
+		if evalErr == nil {
+			scanMessage := kxcommon.ScanMessageFromAnalyticsResponse(response, outputTags, time.Now().UTC())
+			jsonMessage, err := kxcommon.SerializeObject(scanMessage)
+			if err != nil {
+				activityLog.Error(fmt.Sprintf("[kxreadrtdb] Error trying to serialize output message. Error %s", err))
+				return false, err
+			}
+			activityLog.Debugf("[kxreadrtdb] Output Message: %s", jsonMessage)
+			context.SetOutput(ovOutput, jsonMessage)
+			context.SetOutput(ovRecords, scanMessage.Records())
+			context.SetOutput(ovExecutedLocally, true)
+			return true, nil
+		}
+		if execution == kxcommon.AnalyticsExecutionLocal {
+			activityLog.Error(fmt.Sprintf("[kxreadrtdb] Function could not be evaluated. Error %s", evalErr))
+			return false, evalErr
+		}
+		activityLog.Warnf("[kxreadrtdb] Function could not be evaluated locally - sent to the analytics processor. Error %s", evalErr)
+	}
 
 	requestJson, err := kxcommon.SerializeObject(request)
 	if (err != nil) {
@@ -112,6 +178,9 @@ func (a *KXReadRTDBActivity) Eval(context activity.Context) (done bool, err erro
 	}
 	activityLog.Debugf("[kxreadrtdb] Output Message: %s", requestJson)
 	context.SetOutput(ovOutput, requestJson)
+	// the same arguments, addressable one by one by the flow mappers
+	context.SetOutput(ovRecords, kxcommon.AnalyticsRecords(inputTags, inputObjs))
+	context.SetOutput(ovExecutedLocally, false)
 
 	return true, nil
 }
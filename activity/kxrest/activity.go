@@ -2,6 +2,7 @@ package kxrest
 
 import (
 	"bytes"
+	gocontext "context"
 	"fmt"
 	"time"
 	"crypto/tls"
@@ -11,7 +12,6 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"strconv"
 	"github.com/TIBCOSoftware/flogo-lib/core/activity"
 	"github.com/TIBCOSoftware/flogo-lib/logger"
 	"github.com/mtorre-iot/flogo-contrib/activity/kxcommon"
@@ -71,7 +71,7 @@ func (a *KXRESTActivity) Eval(context activity.Context) (done bool, err error) {
 
 	method := strings.ToUpper(context.GetInput(ivMethod).(string))
 	uri := context.GetInput(ivURI).(string)
-	rtdbFile := context.GetInput(ivRTDBFile).(string)
+	rtdbFile := context.GetInput(ivRTDBFile)
 
 	containsParam := strings.Index(uri, "/:") > -1
 
@@ -131,6 +131,11 @@ func (a *KXRESTActivity) Eval(context activity.Context) (done bool, err error) {
 		return false, err
 	}
 
+	// the request is cancelled with the task timeout or the flow deadline
+	if c, ok := context.(interface{ GoContext() gocontext.Context }); ok {
+		req = req.WithContext(c.GoContext())
+	}
+
 	if reqBody != nil {
 		req.Header.Set("Content-Type", contentType)
 	}
@@ -203,38 +208,39 @@ func (a *KXRESTActivity) Eval(context activity.Context) (done bool, err error) {
         outputTags[strKey] = strValue
     }
 
-	outputObjs := make(map[string] kxcommon.KXRTPObject)
-	// decode (unmarshall) the RTDB server pars
-	rtdbPars := strings.Split(rtdbFile,":")
-	// create the realtime DB access object
-	var rtdb kxcommon.RTDB
-	port, err := strconv.Atoi(rtdbPars[1])
-	if err != nil {
-		return false, err
-	}
-	rtdb.RTDBNew(rtdbPars[0], port, rtdbPars[2],rtdbPars[3], 0, "json") 
-	// Open the RealTime DB
-	err = rtdb.OpenRTDB()
+	// get the shared realtime DB connection (pooled across evaluations)
+	rtdb, err := kxcommon.GetPooledRTDB(rtdbFile)
 	if err != nil {
 		activityLog.Error(fmt.Sprintf("[kxrest] Realtime Database could not be opened. Error %s", err))
-	return false, err
+		return false, err
 	}
-	// make sure it closes after finish
-	defer rtdb.CloseRTDB()
 
+	readTags := []string{}
 	for _, tag := range outputTags {
-		outputObjs[tag], err = rtdb.GetRTPObject(tag)
-		if (err != nil)	{
-			activityLog.Error(fmt.Sprintf("[kxrest] Tag: %s could not be accessed from Realtime Database. Error %s", tag, err))
-			return false, err
+		readTags = append(readTags, tag)
+	}
+	outputObjs, tagErrs := rtdb.GetRTPObjects(readTags)
+	if len(tagErrs) > 0 {
+		if kxcommon.HasConnectionError(tagErrs) {
+			kxcommon.InvalidatePooledRTDB(rtdbFile)
+		}
+		for tag, tagErr := range tagErrs {
+			activityLog.Error(fmt.Sprintf("[kxrest] Tag: %s could not be accessed from Realtime Database. Error %s", tag, tagErr))
+			err = tagErr
 		}
+		return false, err
 	}
 	//
 	// Create the json scan message back to KXDataproc
 	//
 	scanMessage := kxcommon.ScanMessageNew()
 	for _,res := range resultx.Results {
-		smu := kxcommon.ScanMessageUnitNew(outputObjs[outputTags[res.Name]].ID, outputTags[res.Name], res.Value, kxcommon.QualityOk.String(), kxcommon.MessageUnitTypeValue, time.Now().UTC())
+		// the analytics service may report a quality per result; otherwise the result is OK
+		quality, err := kxcommon.GetQualityFromString(res.Quality)
+		if err != nil {
+			quality = kxcommon.QualityOk
+		}
+		smu := kxcommon.ScanMessageUnitNewTyped(outputObjs[outputTags[res.Name]].ID, outputTags[res.Name], res.TypedValue(), quality.String(), kxcommon.MessageUnitTypeForQuality(quality), time.Now().UTC())
 		scanMessage.ScanMessageAdd(smu)
 	}
 	jsonMessage, err := kxcommon.SerializeObject(scanMessage)
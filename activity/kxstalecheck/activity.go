@@ -0,0 +1,116 @@
+package kxstalecheck
+
+import (
+	"fmt"
+	"errors"
+	"time"
+	"github.com/TIBCOSoftware/flogo-lib/core/activity"
+	"github.com/TIBCOSoftware/flogo-lib/logger"
+	"github.com/mtorre-iot/flogo-contrib/activity/kxcommon"
+)
+
+// activityLog is the default logger for the Log Activity
+var activityLog = logger.GetLogger("activity-flogo-kxstalecheck")
+
+const (
+	ivInputTags = "inputTags"
+	ivRTDBFile = "RTDBFile"
+	ivMaxAge = "maxAge"
+	ivTagMaxAges = "tagMaxAges"
+	ivUpdateRTDB = "updateRTDB"
+	ovOutput = "outputStream"
+	ovRecords = "outputRecords"
+	ovStaleCount = "staleCount"
+)
+
+func init() {
+	activityLog.SetLogLevel(logger.InfoLevel)
+}
+
+// KXStaleCheckActivity is an Activity that is used to find RTDB tags whose data is older than allowed, and flag them as OLD
+type KXStaleCheckActivity struct {
+	metadata *activity.Metadata
+}
+
+// NewActivity creates a new AppActivity
+func NewActivity(metadata *activity.Metadata) activity.Activity {
+	return &KXStaleCheckActivity{metadata: metadata}
+}
+
+// Metadata returns the activity's metadata
+func (a *KXStaleCheckActivity) Metadata() *activity.Metadata {
+	return a.metadata
+}
+
+// Eval implements api.Activity.Eval - Checks the tags for stale data
+func (a *KXStaleCheckActivity) Eval(context activity.Context) (done bool, err error) {
+
+	rtdbFile := context.GetInput(ivRTDBFile)
+
+	val := context.GetInput(ivInputTags)
+	inputTagsInterface := val.(map[string]interface{})
+	inputTags := []string{}
+
+	for _, value := range inputTagsInterface {
+		inputTags = append(inputTags, fmt.Sprintf("%v", value))
+	}
+
+	tagMaxAges, _ := context.GetInput(ivTagMaxAges).(map[string]interface{})
+	staleRule, err := kxcommon.ParseStaleRule(context.GetInput(ivMaxAge), tagMaxAges)
+	if err != nil {
+		return false, errors.New("[kxstalecheck] Invalid max age. Error: " + err.Error())
+	}
+	updateRTDB, _ := context.GetInput(ivUpdateRTDB).(bool)
+
+	// get the shared realtime DB connection (pooled across evaluations)
+	rtdb, err := kxcommon.GetPooledRTDB(rtdbFile)
+	if err != nil {
+		activityLog.Error(fmt.Sprintf("[kxstalecheck] Realtime Database could not be opened. Error %s", err))
+		return false, err
+	}
+	inputObjs, tagErrs := rtdb.GetRTPObjects(inputTags)
+	if len(tagErrs) > 0 {
+		if kxcommon.HasConnectionError(tagErrs) {
+			kxcommon.InvalidatePooledRTDB(rtdbFile)
+		}
+		for tag, tagErr := range tagErrs {
+			activityLog.Warnf("[kxstalecheck] Tag: %s could not be accessed from Realtime Database - skipped. Error %s", tag, tagErr)
+		}
+	}
+	//
+	// Flag the stale tags and report the quality changes
+	//
+	now := time.Now().UTC()
+	scanMessage := kxcommon.ScanMessageNew()
+	staleObjs := make(map[string]kxcommon.KXRTPObject)
+	for tag, pobj := range inputObjs {
+		if staleRule.ApplyStaleness(&pobj, now) {
+			activityLog.Debugf("[kxstalecheck] Tag: %s is stale. Last update %s", tag, pobj.Cv.Timestamp)
+			smu := kxcommon.ScanMessageUnitNewTyped(pobj.ID, tag, pobj.Cv.TypedValue(), pobj.Cv.Quality.String(), kxcommon.MessageUnitTypeQuality, now)
+			scanMessage.ScanMessageAdd(smu)
+			staleObjs[tag] = pobj
+		}
+	}
+	if updateRTDB {
+		for tag, tagErr := range rtdb.UpdateRTPObjects(staleObjs) {
+			activityLog.Error(fmt.Sprintf("[kxstalecheck] Tag: %s could not be updated in Realtime Database. Error %s", tag, tagErr))
+			err = tagErr
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	jsonMessage, err := kxcommon.SerializeObject(scanMessage)
+	if err != nil {
+		activityLog.Error(fmt.Sprintf("[kxstalecheck] Error trying to serialize output message. Error %s", err))
+		return false, err
+	}
+	activityLog.Debug(fmt.Sprintf("[kxstalecheck] Output Message: %s", jsonMessage))
+	context.SetOutput(ovOutput, jsonMessage)
+	// the same results, addressable one by one by the flow mappers
+	context.SetOutput(ovRecords, scanMessage.Records())
+	context.SetOutput(ovStaleCount, len(staleObjs))
+
+	return true, nil
+}
@@ -0,0 +1,85 @@
+package kxstalecheck
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/TIBCOSoftware/flogo-lib/core/activity"
+	"github.com/mtorre-iot/flogo-contrib/activity/kxcommon"
+	"github.com/stretchr/testify/assert"
+)
+
+var activityMetadata *activity.Metadata
+
+func getActivityMetadata() *activity.Metadata {
+
+	if activityMetadata == nil {
+		jsonMetadataBytes, err := ioutil.ReadFile("activity.json")
+		if err != nil {
+			panic("No Json Metadata found for activity.json path")
+		}
+
+		activityMetadata = activity.NewMetadata(string(jsonMetadataBytes))
+	}
+
+	return activityMetadata
+}
+
+func TestCreate(t *testing.T) {
+
+	act := NewActivity(getActivityMetadata())
+
+	if act == nil {
+		t.Error("Activity Not Created")
+		t.Fail()
+		return
+	}
+}
+
+func newStaleObject(tag string, quality kxcommon.Quality, timeStamp time.Time) *kxcommon.KXRTPObject {
+	return &kxcommon.KXRTPObject{Tag: tag, Cv: &kxcommon.RtVal{Value: 1.0, Quality: quality, Timestamp: timeStamp}}
+}
+
+func TestParseStaleRule(t *testing.T) {
+
+	rule, err := kxcommon.ParseStaleRule(60, map[string]interface{}{"FAST": "5", "SLOW": 3600.0})
+	assert.Nil(t, err)
+	assert.Equal(t, 60*time.Second, rule.MaxAgeFor("OTHER"))
+	assert.Equal(t, 5*time.Second, rule.MaxAgeFor("FAST"))
+	assert.Equal(t, time.Hour, rule.MaxAgeFor("SLOW"))
+
+	_, err = kxcommon.ParseStaleRule(-1, nil)
+	assert.NotNil(t, err)
+
+	_, err = kxcommon.ParseStaleRule(60, map[string]interface{}{"FAST": "abc"})
+	assert.NotNil(t, err)
+}
+
+func TestApplyStaleness(t *testing.T) {
+
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	rule, err := kxcommon.ParseStaleRule(60, map[string]interface{}{"FAST": 5})
+	assert.Nil(t, err)
+
+	// older than the default max age
+	old := newStaleObject("TAG1", kxcommon.QualityOk, now.Add(-61*time.Second))
+	assert.True(t, rule.ApplyStaleness(old, now))
+	assert.Equal(t, kxcommon.QualityOld, old.Cv.Quality)
+
+	// fresh samples are unchanged
+	fresh := newStaleObject("TAG1", kxcommon.QualityOk, now.Add(-30*time.Second))
+	assert.False(t, rule.ApplyStaleness(fresh, now))
+	assert.Equal(t, kxcommon.QualityOk, fresh.Cv.Quality)
+
+	// the per-tag max age overrides the default
+	fast := newStaleObject("FAST", kxcommon.QualityOk, now.Add(-30*time.Second))
+	assert.True(t, rule.ApplyStaleness(fast, now))
+	assert.Equal(t, kxcommon.QualityOld, fast.Cv.Quality)
+
+	// only OK samples are downgraded
+	bad := newStaleObject("TAG1", kxcommon.QualityBad, now.Add(-time.Hour))
+	assert.False(t, rule.ApplyStaleness(bad, now))
+	assert.Equal(t, kxcommon.QualityBad, bad.Cv.Quality)
+}
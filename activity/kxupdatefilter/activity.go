@@ -3,8 +3,7 @@ package kxupdatefilter
 import (
 	"fmt"
 	"errors"
-	"strings"
-	"strconv"
+	"time"
 	"github.com/TIBCOSoftware/flogo-lib/core/activity"
 	"github.com/TIBCOSoftware/flogo-lib/logger"
 	"github.com/mtorre-iot/flogo-contrib/activity/kxcommon"
@@ -19,7 +18,21 @@ const (
 	ivInputTags = "inputTags"
 	ivRTDBFile = "RTDBFile"
 	ivFunctionName = "functionName"
+	ivQualityPolicy = "qualityPolicy"
+	ivMaxAge = "maxAge"
+	ivTagMaxAges = "tagMaxAges"
+	ivOutputTags = "outputTags"
+	ivFunctionParams = "functionParams"
+	ivExecution = "execution"
+	ivDeadband = "deadband"
+	ivPercentDeadband = "percentDeadband"
+	ivTagDeadbands = "tagDeadbands"
+	ivMinInterval = "minInterval"
+	ivMaxInterval = "maxInterval"
+	ivQualityChange = "qualityChange"
 	ovOutput = "outputStream"
+	ovRecords = "outputRecords"
+	ovExecutedLocally = "executedLocally"
 )
 
 func init() {
@@ -29,11 +42,13 @@ func init() {
 // KXUpdateFilterActivity is an Activity that is used to deserialize messages from KXDataProc, to get changes to invoke other activities 
 type KXUpdateFilterActivity struct {
 	metadata *activity.Metadata
+	// reports keeps the last update reported per flow, activity and trigger tag
+	reports *kxcommon.ReportFilterStore
 }
 
 // NewActivity creates a new AppActivity
 func NewActivity(metadata *activity.Metadata) activity.Activity {
-	return &KXUpdateFilterActivity{metadata: metadata}
+	return &KXUpdateFilterActivity{metadata: metadata, reports: kxcommon.ReportFilterStoreNew()}
 }
 
 // Metadata returns the activity's metadata
@@ -46,7 +61,7 @@ func (a *KXUpdateFilterActivity) Eval(context activity.Context) (done bool, err
 
 	message, _ := context.GetInput(ivMessage).(string)
 	triggerTag,_ := context.GetInput(ivTriggerTag).(string)
-	rtdbFile := context.GetInput(ivRTDBFile).(string)
+	rtdbFile := context.GetInput(ivRTDBFile)
 	
 	val := context.GetInput(ivInputTags)
 	inputTagsInterface := val.(map[string]interface{})
@@ -63,6 +78,39 @@ func (a *KXUpdateFilterActivity) Eval(context activity.Context) (done bool, err
 	if functionName == "" {
 		return false, errors.New("[kxupdatefilter] A function name must be provided")
 	}
+	qualityPolicy, _ := context.GetInput(ivQualityPolicy).(string)
+	qualityRule, err := kxcommon.ResolveQualityRule(functionName, qualityPolicy)
+	if err != nil {
+		return false, errors.New("[kxupdatefilter] Invalid quality policy. Error: " + err.Error())
+	}
+	tagMaxAges, _ := context.GetInput(ivTagMaxAges).(map[string]interface{})
+	staleRule, err := kxcommon.ParseStaleRule(context.GetInput(ivMaxAge), tagMaxAges)
+	if err != nil {
+		return false, errors.New("[kxupdatefilter] Invalid max age. Error: " + err.Error())
+	}
+	outputTagsInterface, _ := context.GetInput(ivOutputTags).(map[string]interface{})
+	outputTags := kxcommon.StringParams(outputTagsInterface)
+	functionParamsInterface, _ := context.GetInput(ivFunctionParams).(map[string]interface{})
+	functionParams := kxcommon.StringParams(functionParamsInterface)
+	executionStr, _ := context.GetInput(ivExecution).(string)
+	execution, err := kxcommon.GetAnalyticsExecutionFromString(executionStr)
+	if err != nil {
+		return false, errors.New("[kxupdatefilter] Invalid execution. Error: " + err.Error())
+	}
+	runLocally, err := execution.RunsLocally(functionName, outputTags)
+	if err != nil {
+		return false, errors.New("[kxupdatefilter] " + err.Error())
+	}
+	tagDeadbands, _ := context.GetInput(ivTagDeadbands).(map[string]interface{})
+	qualityChange, ok := context.GetInput(ivQualityChange).(bool)
+	if !ok {
+		qualityChange = true
+	}
+	reportFilter, err := kxcommon.ParseReportFilter(context.GetInput(ivDeadband), context.GetInput(ivPercentDeadband), tagDeadbands,
+		context.GetInput(ivMinInterval), context.GetInput(ivMaxInterval), qualityChange)
+	if err != nil {
+		return false, errors.New("[kxupdatefilter] Invalid report filter. Error: " + err.Error())
+	}
 
 	var inputValues map[string]float64
 
@@ -90,6 +138,16 @@ func (a *KXUpdateFilterActivity) Eval(context activity.Context) (done bool, err
 		activityLog.Debugf("[kxupdatefilter] Found %s in the trigger!", triggerTag)
 		foundTrig = true
 	} 
+	// updates within the deadband or the rate limit of the trigger tag do not fire the analytics
+	if foundTrig && rtPObject.Cv != nil {
+		reportKey := context.ActivityHost().Name() + ":" + context.Name() + ":" + rtPObject.Tag
+		accepted, reason := a.reports.Accept(reportKey, reportFilter, rtPObject.Tag, rtPObject.Cv.TypedValue(), rtPObject.Cv.Quality, time.Now().UTC())
+		if !accepted {
+			activityLog.Debugf("[kxupdatefilter] Tag: %s update filtered out: %s", rtPObject.Tag, reason)
+			return false, nil
+		}
+		activityLog.Debugf("[kxupdatefilter] Tag: %s update reported: %s", rtPObject.Tag, reason)
+	}
 
 	for _, intag := range inputTags {
 		if rtPObject.Tag == intag {
@@ -101,31 +159,38 @@ func (a *KXUpdateFilterActivity) Eval(context activity.Context) (done bool, err
 		//
 		// Trigger was found. Check if the inputs were also in the incoming message. Otherwise, read them from RTDB.
 		//
-		// decode (unmarshall) the RTDB server pars
-		rtdbPars := strings.Split(rtdbFile,":")
-		// create the realtime DB access object
-		var rtdb kxcommon.RTDB
-		port, err := strconv.Atoi(rtdbPars[1])
-		if err != nil {
-			return false, err
-		}
-		rtdb.RTDBNew(rtdbPars[0], port, rtdbPars[2],rtdbPars[3], 0, "json") 
-		// Open the RealTime DB
-		err = rtdb.OpenRTDB()
+		// get the shared realtime DB connection (pooled across evaluations)
+		rtdb, err := kxcommon.GetPooledRTDB(rtdbFile)
 		if err != nil {
 			activityLog.Error(fmt.Sprintf("[kxupdatefilter] Realtime Database could not be opened. Error %s", err))
 			return false, err
 		}
-		// make sure it closes after finish
-		defer rtdb.CloseRTDB()
-		// check all tags
+		// read all tags not in the incoming message in a single round trip
+		readTags := []string{}
 		for key, pobj := range inputObjs {
 			if pobj.Tag == "" {
-				inputObjs[key], err = rtdb.GetRTPObject(key)
-				if (err != nil)	{
-					activityLog.Error(fmt.Sprintf("[kxupdatefilter] Tag: %s could not be accessed from Realtime Database. Error %s", key, err))
-					return false, err
-				}
+				readTags = append(readTags, key)
+			}
+		}
+		readObjs, tagErrs := rtdb.GetRTPObjects(readTags)
+		if len(tagErrs) > 0 {
+			if kxcommon.HasConnectionError(tagErrs) {
+				kxcommon.InvalidatePooledRTDB(rtdbFile)
+			}
+			for key, tagErr := range tagErrs {
+				activityLog.Error(fmt.Sprintf("[kxupdatefilter] Tag: %s could not be accessed from Realtime Database. Error %s", key, tagErr))
+				err = tagErr
+			}
+			return false, err
+		}
+		for key, pobj := range readObjs {
+			inputObjs[key] = pobj
+		}
+		// samples older than their max age are downgraded to OLD
+		now := time.Now().UTC()
+		for key, pobj := range inputObjs {
+			if staleRule.ApplyStaleness(&pobj, now) {
+				activityLog.Debugf("[kxupdatefilter] Tag: %s is stale. Quality set to %s", key, pobj.Cv.Quality)
 			}
 		}
 		//
@@ -134,10 +199,39 @@ func (a *KXUpdateFilterActivity) Eval(context activity.Context) (done bool, err
 		args:= [] kxcommon.AnalyticsArg{}
 		for _, pobj := range inputObjs {
 			key,_ := kxcommon.Mapkey(inputTags, pobj.Tag)
-			args = append(args, kxcommon.AnalyticsArgNew(key, fmt.Sprintf("%f", pobj.Cv.Value), pobj.Cv.Quality.String()))
+			args = append(args, kxcommon.AnalyticsArgNewTyped(key, pobj.Cv.TypedValue(), pobj.Cv.Quality.String()))
 		}
 
 		request := kxcommon.AnalyticsRequestNew(functionName, args)
+		// propagate the input qualities into the request quality
+		qualityInputs := []kxcommon.QualityInput{}
+		for _, pobj := range inputObjs {
+			qualityInputs = append(qualityInputs, kxcommon.QualityInputFromRtVal(pobj.Cv))
+		}
+		request.Quality = qualityRule.Propagate(qualityInputs).String()
+
+		// registered functions run in process. In auto mode, the remote request is the fallback
+		if runLocally {
+			response, evalErr := kxcommon.EvalAnalyticsRequest(request, functionParams)
+			if evalErr == nil {
+				scanMessage := kxcommon.ScanMessageFromAnalyticsResponse(response, outputTags, time.Now().UTC())
+				jsonMessage, err := kxcommon.SerializeObject(scanMessage)
+				if err != nil {
+					activityLog.Error(fmt.Sprintf("[kxupdatefilter] Error trying to serialize output message. Error %s", err))
+					return false, err
+				}
+				activityLog.Debugf("[kxupdatefilter] Output Message: %s", jsonMessage)
+				context.SetOutput(ovOutput, jsonMessage)
+				context.SetOutput(ovRecords, scanMessage.Records())
+				context.SetOutput(ovExecutedLocally, true)
+				return foundTrig, nil
+			}
+			if execution == kxcommon.AnalyticsExecutionLocal {
+				activityLog.Error(fmt.Sprintf("[kxupdatefilter] Function could not be evaluated. Error %s", evalErr))
+				return false, evalErr
+			}
+			activityLog.Warnf("[kxupdatefilter] Function could not be evaluated locally - sent to the analytics processor. Error %s", evalErr)
+		}
 
 		requestJson, err := kxcommon.SerializeObject(request)
 		if (err != nil) {
@@ -146,6 +240,9 @@ func (a *KXUpdateFilterActivity) Eval(context activity.Context) (done bool, err
 		}
 		activityLog.Debugf("[kxupdatefilter] Output Message: %s", requestJson)
 		context.SetOutput(ovOutput, requestJson)
+		// the same arguments, addressable one by one by the flow mappers
+		context.SetOutput(ovRecords, kxcommon.AnalyticsRecords(inputTags, inputObjs))
+		context.SetOutput(ovExecutedLocally, false)
 	}
 	return foundTrig, nil
 }
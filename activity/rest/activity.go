@@ -2,6 +2,7 @@ package rest
 
 import (
 	"bytes"
+	gocontext "context"
 	"crypto/tls"
 	"encoding/json"
 	"io"
@@ -122,6 +123,11 @@ func (a *RESTActivity) Eval(context activity.Context) (done bool, err error) {
 		return false, err
 	}
 
+	// the request is cancelled with the task timeout or the flow deadline
+	if c, ok := context.(interface{ GoContext() gocontext.Context }); ok {
+		req = req.WithContext(c.GoContext())
+	}
+
 	if reqBody != nil {
 		req.Header.Set("Content-Type", contentType)
 	}
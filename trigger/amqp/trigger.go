@@ -6,12 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
 	"math/rand"
 	"time"
 	"github.com/TIBCOSoftware/flogo-lib/core/data"
 	"github.com/TIBCOSoftware/flogo-lib/core/trigger"
 	"github.com/TIBCOSoftware/flogo-lib/logger"
+	"github.com/mtorre-iot/flogo-contrib/activity/kxcommon"
 	"github.com/streadway/amqp"
 )
 
@@ -39,30 +41,35 @@ var (
 	rsDurable      = "responseDurable"
 	rsAutoDelete   = "responseAutoDelete"
 	rsReliable     = "responseReliable"
-	msgs           amqp.Delivery
-	msgsLock       sync.Mutex
+	rqQueueName    = "requestQueueName"
+	rqPrefetchCount  = "requestPrefetchCount"
+	rqMaxConcurrency = "requestMaxConcurrency"
+	rqDeadLetterExchange = "requestDeadLetterExchange"
+	hsAckMode      = "ackMode"
+	hsRoutingKey   = "routingKey"
+	hsOnError      = "onError"
+	rqPrefix       = "request"
+	rsPrefix       = "response"
 )
-//
-// AMQPExchange contains all parameters required to create or open an exchenge
-//
-type AMQPExchange struct {
-	Uri          string
-	HostName     string
-	ExchangeName string
-	ExchangeType string
-	QueueName    string
-	RoutingKey   string
-	UserName     string
-	Password     string
-	Durable      bool
-	AutoDelete   bool
-	Reliable     bool
-	Connection   *amqp.Connection
-	Channel      *amqp.Channel
-	Queue        *amqp.Queue
-	Messages     []string
-	Confirms     chan amqp.Confirmation
-	IsOpen       bool
+// ack modes and flow error actions of the handlers
+const (
+	ackModeAuto    = "auto"
+	ackModeManual  = "manual"
+	onErrorRequeue = "requeue"
+	onErrorReject  = "reject"
+)
+
+// handlerAck is how a handler settles its deliveries
+type handlerAck struct {
+	manual  bool
+	requeue bool
+}
+
+// handlerRoute is the binding of a handler, and how it settles the deliveries it receives
+type handlerRoute struct {
+	routingKey string
+	handler    *trigger.Handler
+	ack        handlerAck
 }
 
 //
@@ -71,14 +78,20 @@ type AmqpTrigger struct {
 	metadata       *trigger.Metadata
 	config         *trigger.Config
 	handlers       []*trigger.Handler
-	topicToHandler map[string]*trigger.Handler
-	reqExch        *AMQPExchange
-	resExch        *AMQPExchange
+	routes         []handlerRoute
+	reqExch        *kxcommon.AMQPExchange
+	// replies go through reconnecting publishers, never through the consumer connection: to the response
+	// exchange, and to the Reply To queue of the requests through the default exchange
+	resPublisher   *kxcommon.AMQPPublisher
+	resRoutingKey  string
+	replyConfig    kxcommon.AMQPPublisherConfig
+	slots          chan struct{}
+	running        sync.WaitGroup
+	// stopping is closed when the trigger stops, received when the receive loop exits
+	stopping       chan struct{}
+	received       chan struct{}
 }
 
-var (
-	routingKey string
-)
 //NewFactory create a new Trigger factory
 func NewFactory(md *trigger.Metadata) trigger.Factory {
 	return &AMQPFactory{metadata: md}
@@ -122,10 +135,34 @@ func (t *AmqpTrigger) Start() error {
 		return errors.New(errMsg)
 	}
 
-	t.topicToHandler = make(map[string]*trigger.Handler)
+	// each handler binds the queue with its own routing key, so one trigger serves many routing keys
+	t.routes = nil
+	bindings := []string{}
+	manualAck := false
 	for _, handler := range t.handlers {
-		routingKey = handler.GetStringSetting("routingKey")
-		t.topicToHandler[routingKey] = handler
+		routingKey := handler.GetStringSetting(hsRoutingKey)
+		hAck, err := getHandlerAck(handler)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		t.routes = append(t.routes, handlerRoute{routingKey, handler, hAck})
+		if !containsString(bindings, routingKey) {
+			bindings = append(bindings, routingKey)
+		}
+		manualAck = manualAck || hAck.manual
+	}
+	// flows run one at a time unless a concurrency limit is set
+	maxConcurrency, err := t.getIntSetting(rqMaxConcurrency, 1)
+	if err != nil {
+		return err
+	}
+	t.slots = make(chan struct{}, maxConcurrency)
+	t.stopping = make(chan struct{})
+	// with manual acks the broker only sends what can be run right away, unless told otherwise
+	prefetchCount, err := t.getIntSetting(rqPrefetchCount, maxConcurrency)
+	if err != nil {
+		return err
 	}
 
 	requestHostName, err := t.checkParameter(rqHostName)
@@ -145,9 +182,18 @@ func (t *AmqpTrigger) Start() error {
 	if  err != nil {
 		return err
 	}
-	s := rand.NewSource(time.Now().UnixNano())
-	r := rand.New(s)
-	requestQueueName := t.config.Id + fmt.Sprintf("-%d", r.Intn(1000))
+	// a named queue outlives the trigger, so messages sent while it is down are not lost
+	requestQueueName := t.config.GetSetting(rqQueueName)
+	requestExclusive := requestQueueName == ""
+	if requestExclusive {
+		s := rand.NewSource(time.Now().UnixNano())
+		r := rand.New(s)
+		requestQueueName = t.config.Id + fmt.Sprintf("-%d", r.Intn(1000))
+	}
+	requestQueueArgs := amqp.Table{}
+	if deadLetterExchange := t.config.GetSetting(rqDeadLetterExchange); deadLetterExchange != "" {
+		requestQueueArgs["x-dead-letter-exchange"] = deadLetterExchange
+	}
 
 	requestExchangeType, err := t.checkParameter(rqExchangeType)
 	if err != nil {
@@ -237,17 +283,28 @@ func (t *AmqpTrigger) Start() error {
 	//
 	//	Create the request exchange object
 	//
-	t.reqExch = AMQPExchangeNew(requestHostName,
+	t.reqExch = kxcommon.AMQPExchangeNew(requestHostName,
 		requestPort,
 		requestExchangeName,
 		requestExchangeType,
 		requestQueueName,
-		routingKey,
+		"",
 		requestUser,
 		requestPassword,
 		requestDurable,
 		requestAutoDelete,
 		requestReliable)
+	t.reqExch.Exclusive = requestExclusive
+	t.reqExch.AutoAck = !manualAck
+	t.reqExch.Prefetch = prefetchCount
+	t.reqExch.QueueArgs = requestQueueArgs
+	t.reqExch.Bindings = bindings
+	// the broker shows the trigger id as connection name, unless told otherwise
+	t.reqExch.Broker.ConnectionName = t.config.Id
+	if err := t.reqExch.Broker.ApplySettings(rqPrefix, t.getSetting); err != nil {
+		log.Errorf("[amqp] Request Exchange: %s", err)
+		return err
+	}
 
 	if t.reqExch == nil {
 		errMsg := fmt.Sprintf("[amqp] Request Exchange: Unable to Create Exchange Object: %s", t.reqExch.ExchangeName)
@@ -264,300 +321,305 @@ func (t *AmqpTrigger) Start() error {
 	//
 	// Prepare to receive
 	//
+	t.received = make(chan struct{})
 	if err := t.reqExch.PrepareReceiveFunc(t.receiverHandler); err != nil {
+		t.received = nil
 		log.Errorf("[amqp] Request Exchange: Unable to Prepare: %s to Receive. Error: %s. Bail out", err)
 		return err
 	}
 	//
-	//	Create the response exchange object
+	//	Create the response publishers
 	//
+	t.replyConfig = kxcommon.AMQPPublisherConfig{Broker: t.reqExch.Broker, Reliable: requestReliable}
 	if responseHostName != "" {
-		t.resExch = AMQPExchangeNew(responseHostName,
-			responsePort,
-			responseExchangeName,
-			responseExchangeType,
-			"",
-			responseRoutingKey,
-			responseUser,
-			responsePassword,
-			responseDurable,
-			responseAutoDelete,
-			responseReliable)
-
-		if t.resExch == nil {
-			errMsg := fmt.Sprintf("[amqp] Response Exchange: Unable to Create Exchange Object: %s", t.resExch.ExchangeName)
-			log.Error(errMsg)
-			return errors.New(errMsg)
+		responseBroker := kxcommon.AMQPConnectionConfig{HostName: responseHostName, Port: responsePort, UserName: responseUser,
+			Password: responsePassword, ConnectionName: t.config.Id}
+		if err := responseBroker.ApplySettings(rsPrefix, t.getSetting); err != nil {
+			log.Errorf("[amqp] Response Exchange: %s", err)
+			return err
 		}
-		//
-		// Create the AMQP Response Exchange
-		//
-		if err := t.resExch.Open(false); err != nil {
-			log.Errorf("[amqp] Response Exchange: Unable to Open Exchange: %s : %s", t.resExch.ExchangeName, err)
+		t.resPublisher, err = kxcommon.GetPooledAMQPPublisher(kxcommon.AMQPPublisherConfig{
+			Broker:       responseBroker,
+			ExchangeName: responseExchangeName,
+			ExchangeType: responseExchangeType,
+			Durable:      responseDurable,
+			AutoDelete:   responseAutoDelete,
+			Reliable:     responseReliable,
+		})
+		if err != nil {
+			log.Errorf("[amqp] Response Exchange: Unable to Create Publisher: %s : %s", responseExchangeName, err)
 			return err
 		}
+		t.resRoutingKey = responseRoutingKey
+		t.replyConfig = kxcommon.AMQPPublisherConfig{Broker: responseBroker, Reliable: responseReliable}
 	}
 	return nil
 }
 
+// receiverHandler runs a flow per delivery, up to the concurrency limit. Deliveries received while stopping are
+// not settled, the broker requeues them when the channel closes
 func (t *AmqpTrigger) receiverHandler(msgs <-chan amqp.Delivery) {
+	defer close(t.received)
 	for d := range msgs {
-		payload := fmt.Sprintf("%s", d.Body)
-		log.Debugf("[amqp] Message received: %s", payload)
-		handler, found := t.topicToHandler[routingKey]
-		if found {
-			t.RunHandler(handler, payload)
-		} else {
-			log.Warnf("[amqp] Handler for Routing Key '%s' not found", routingKey)
+		select {
+		case <-t.stopping:
+			continue
+		default:
+		}
+		select {
+		case <-t.stopping:
+			continue
+		case t.slots <- struct{}{}:
 		}
+		t.running.Add(1)
+		go func(d amqp.Delivery) {
+			defer func() {
+				<-t.slots
+				t.running.Done()
+			}()
+			t.handleDelivery(d)
+		}(d)
 	}
 }
 
-// Stop implements ext.Trigger.Stop
-func (t *AmqpTrigger) Stop() error {
-	//Close Exchange
-	t.reqExch.Close()
-	t.resExch.Close()
-	return nil
+// handleDelivery runs the handlers whose routing key matches the delivery and settles it. Manual deliveries are
+// acked once all the flows complete, and requeued or rejected (dead-lettered, if the queue has a dead letter
+// exchange) when one of them fails
+func (t *AmqpTrigger) handleDelivery(d amqp.Delivery) {
+	log.Debugf("[amqp] Message received. Routing Key: '%s' Message: %s", d.RoutingKey, d.Body)
+	routes := t.matchRoutes(d.RoutingKey)
+	if len(routes) == 0 {
+		log.Warnf("[amqp] Handler for Routing Key '%s' not found", d.RoutingKey)
+		if !t.reqExch.AutoAck {
+			t.settle(d, false, false)
+		}
+		return
+	}
+	manual := false
+	for _, route := range routes {
+		manual = manual || route.ack.manual
+	}
+	if !t.reqExch.AutoAck && !manual {
+		t.settle(d, true, false)
+	}
+	failed, requeue := false, false
+	for _, route := range routes {
+		if err := t.RunHandler(route.handler, d); err != nil && route.ack.manual {
+			failed = true
+			requeue = requeue || route.ack.requeue
+		}
+	}
+	if !manual {
+		return
+	}
+	if !failed {
+		t.settle(d, true, false)
+		return
+	}
+	// a message that failed again after being requeued is rejected, so it cannot loop forever
+	t.settle(d, false, requeue && !d.Redelivered)
 }
 
-// RunHandler runs the handler and associated action
-func (t *AmqpTrigger) RunHandler(handler *trigger.Handler, payload string) {
-	trgData := make(map[string]interface{})
-	trgData["message"] = []byte(payload)
-
-	results, err := handler.Handle(context.Background(), trgData)
-
-	if err != nil {
-		log.Error("[amqp] Error starting action: ", err.Error())
+// matchRoutes gets the handler routes a routing key is delivered to
+func (t *AmqpTrigger) matchRoutes(routingKey string) []handlerRoute {
+	var routes []handlerRoute
+	for _, route := range t.routes {
+		if routingKeyMatch(t.reqExch.ExchangeType, route.routingKey, routingKey) {
+			routes = append(routes, route)
+		}
 	}
+	return routes
+}
 
-	var replyData interface{}
+// routingKeyMatch checks a routing key against a binding the way the broker does. Fanout and headers exchanges
+// ignore routing keys, direct exchanges compare them as they are and topic exchanges match them against the
+// binding pattern, where '*' stands for exactly one word and '#' for zero or more words
+func routingKeyMatch(exchangeType string, binding string, routingKey string) bool {
+	switch exchangeType {
+	case amqp.ExchangeFanout, amqp.ExchangeHeaders:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatch(strings.Split(binding, "."), strings.Split(routingKey, "."))
+	default:
+		return binding == routingKey
+	}
+}
 
-	if len(results) != 0 {
-		dataAttr, ok := results["data"]
-		if ok {
-			replyData = dataAttr.Value()
+// topicMatch matches the words of a routing key against the words of a topic binding
+func topicMatch(pattern []string, words []string) bool {
+	for i, p := range pattern {
+		if p == "#" {
+			rest := pattern[i+1:]
+			for j := i; j <= len(words); j++ {
+				if topicMatch(rest, words[j:]) {
+					return true
+				}
+			}
+			return false
 		}
-	}
-	if replyData != nil {
-		dataJson, err := json.Marshal(replyData)
-		if err != nil {
-			log.Error(err)
-		} else {
-			t.publishMessage(string(dataJson))
+		if i >= len(words) || (p != "*" && p != words[i]) {
+			return false
 		}
 	}
+	return len(pattern) == len(words)
 }
 
-func (t *AmqpTrigger) publishMessage(message string) {
-
-	log.Debug("[amqp] Replying message: ", message)
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
 
-	err := t.resExch.Publish(message)
+// settle acks, or nacks with or without requeue, a delivery
+func (t *AmqpTrigger) settle(d amqp.Delivery, ack bool, requeue bool) {
+	var err error
+	if ack {
+		err = d.Ack(false)
+	} else {
+		err = d.Nack(false, requeue)
+	}
 	if err != nil {
-		// Timeout occurred
-		log.Errorf("[amqp] Error occurred while trying to publish to Exchange '%s'", t.resExch.ExchangeName)
-		return
+		log.Errorf("[amqp] Delivery %d could not be settled. Error: %s", d.DeliveryTag, err)
 	}
 }
 
-//
-// AMQPExchangeNew creates a new exchange in the Broker
-func AMQPExchangeNew(hostName string, port int, exchangeName string, exchangeType string, queueName string, routingKey string,
-	userName string, password string, durable bool, autoDelete bool, reliable bool) *AMQPExchange {
-	uri := buildURI(hostName, port, userName, password)
-	exch := AMQPExchange{uri, hostName, exchangeName, exchangeType, queueName, routingKey, userName, password, durable, autoDelete, reliable, nil, nil, nil, []string{}, nil, false}
-	return &exch
+// getHandlerAck decodes the ack mode and flow error action of a handler
+func getHandlerAck(handler *trigger.Handler) (handlerAck, error) {
+	var hAck handlerAck
+	switch ackMode := handler.GetStringSetting(hsAckMode); ackMode {
+	case "", ackModeAuto:
+	case ackModeManual:
+		hAck.manual = true
+	default:
+		return hAck, fmt.Errorf("[amqp] Handler ack mode '%s' is invalid. Expected '%s' or '%s'", ackMode, ackModeAuto, ackModeManual)
+	}
+	switch onError := handler.GetStringSetting(hsOnError); onError {
+	case "", onErrorRequeue:
+		hAck.requeue = true
+	case onErrorReject:
+	default:
+		return hAck, fmt.Errorf("[amqp] Handler on error action '%s' is invalid. Expected '%s' or '%s'", onError, onErrorRequeue, onErrorReject)
+	}
+	return hAck, nil
 }
 
-// buildURI creates the full broker URI string
-func buildURI(hostName string, port int, userName string, password string) string {
-	// "amqp://" + userName + ":" + password + "@" + hostName + ":5672"
-	return fmt.Sprintf("%s%s:%s@%s:%d", "amqp://", userName, password, hostName, port)
+// getSetting gets a setting of the trigger. Missing settings are empty
+func (t *AmqpTrigger) getSetting(attribute string) interface{} {
+	return t.config.GetSetting(attribute)
 }
 
-// Open opens a previosly created Exchange
-func (exch *AMQPExchange) Open(isQueued bool) error {
-	conn, err := amqp.Dial(exch.Uri)
-	if err != nil {
-		return fmt.Errorf("[amqp] Connection: %s", err)
+// getIntSetting gets a positive integer setting
+func (t *AmqpTrigger) getIntSetting(attribute string, defaultValue int) (int, error) {
+	param := t.config.GetSetting(attribute)
+	if param == "" {
+		return defaultValue, nil
 	}
-	exch.Connection = conn
-	chn, err := exch.Connection.Channel()
-	if err != nil {
-		exch.Connection.Close()
-		return fmt.Errorf("[amqp] Channel: %s", err)
-	}
-	exch.Channel = chn
-	if err := exch.Channel.ExchangeDeclare(
-		exch.ExchangeName, // name
-		exch.ExchangeType, // type
-		exch.Durable,      // durable
-		exch.AutoDelete,   // auto-delete
-		false,             // internal
-		false,             // noWait
-		nil,               // arguments
-	); err != nil {
-		exch.Connection.Close()
-		exch.Channel = nil
-		exch.Connection = nil
-		exch.IsOpen = false
-		return fmt.Errorf("[amqp] Exchange Declare: %s", err)
-	}
-	if exch.Reliable {
-		if err := exch.Channel.Confirm(false); err != nil {
-			exch.Connection.Close()
-			exch.Channel = nil
-			exch.Connection = nil
-			exch.IsOpen = false
-			return fmt.Errorf("[amqp] hannel could not be put into confirm mode: %s", err)
-		}
-		confirms := exch.Channel.NotifyPublish(make(chan amqp.Confirmation, 1))
-		exch.Confirms = confirms
-	}
-	if isQueued == true {
-		queue, err := exch.Channel.QueueDeclare(
-			exch.QueueName,  // name
-			exch.Durable,    // durable
-			exch.AutoDelete, // delete when unused
-			true,            // exclusive
-			false,           // no-wait
-			nil,             // arguments
-		)
-		if err != nil {
-			exch.Connection.Close()
-			exch.Queue = nil
-			exch.Channel = nil
-			exch.Connection = nil
-			exch.IsOpen = false
-			return fmt.Errorf("[amqp] Queue Declare: %s", err)
-		}
-
-		if err = exch.Channel.QueueBind(
-			exch.QueueName,    // queue name
-			exch.RoutingKey,   // routing key
-			exch.ExchangeName, // exchange
-			false,
-			nil); err != nil {
-			exch.Connection.Close()
-			exch.Queue = nil
-			exch.Channel = nil
-			exch.Connection = nil
-			exch.IsOpen = false
-			return fmt.Errorf("[amqp] Queue Bind: %s", err)
-		}
-		exch.Queue = &queue
+	value, err := strconv.Atoi(param)
+	if err != nil || value < 1 {
+		errMsg := fmt.Sprintf("[amqp] Setting '%s' must be a positive integer. Found '%s'", attribute, param)
+		log.Error(errMsg)
+		return 0, errors.New(errMsg)
 	}
-	exch.IsOpen = true
-	return err
+	return value, nil
 }
 
-// Close closes the exchange
-func (exch *AMQPExchange) Close() error {
-	if (exch.Connection == nil) || (exch.IsOpen == false) {
-		return fmt.Errorf("[amqp] Connection for exchange: " + exch.ExchangeName + " was not open")
-	}
-	if err := exch.Channel.Close(); err != nil {
-		return fmt.Errorf("[amqp] Channel for exchange: " + exch.ExchangeName + " couldn't be closed")
-	}
-	if err := exch.Connection.Close(); err != nil {
-		return fmt.Errorf("[amqp] Connection for exchange: " + exch.ExchangeName + " couldn't be closed")
+// Stop implements ext.Trigger.Stop
+func (t *AmqpTrigger) Stop() error {
+	// stop receiving and let the running flows settle their deliveries before closing
+	if t.reqExch != nil {
+		close(t.stopping)
+		t.reqExch.Cancel()
+		// no flow starts once the receive loop is done, so the running ones can be waited for
+		if t.received != nil {
+			<-t.received
+		}
+		t.running.Wait()
+		t.reqExch.Close()
 	}
-	exch.Channel = nil
-	exch.Connection = nil
-	exch.IsOpen = false
+	// the publishers are shared, they are closed when the engine stops
 	return nil
 }
 
-// PublishObject serializes objects (JSON) and publish to existing exchange
-func (exch *AMQPExchange) PublishObject(obj interface{}) error {
-	bytes, err := json.Marshal(obj)
+// RunHandler runs the handler and associated action. It returns the error of the flow, or of its reply, if they failed
+func (t *AmqpTrigger) RunHandler(handler *trigger.Handler, d amqp.Delivery) error {
+	trgData := make(map[string]interface{})
+	trgData["message"] = d.Body
+	trgData["routingKey"] = d.RoutingKey
+	trgData["correlationId"] = d.CorrelationId
+	trgData["replyTo"] = d.ReplyTo
+	// headers, content type and encoding, persistent, priority, expiration, message id and timestamp
+	for name, value := range kxcommon.AMQPPropertiesFromDelivery(d).Outputs() {
+		trgData[name] = value
+	}
+
+	results, err := handler.Handle(context.Background(), trgData)
+
 	if err != nil {
+		log.Error("[amqp] Error starting action: ", err.Error())
 		return err
 	}
-	return exch.Publish(string(bytes))
-}
 
-// Publish publishes a new message into an existing exchange
-func (exch *AMQPExchange) Publish(body string) error {
-
-	if (exch.Connection == nil) || (exch.IsOpen == false) {
-		return fmt.Errorf("[amqp] Connection for exchange: " + exch.ExchangeName + " is not open")
-	}
-
-	if err := exch.Channel.Publish(
-		exch.ExchangeName, // publish to an exchange
-		exch.RoutingKey,   // routing to 0 or more queues
-		false,             // mandatory
-		false,             // immediate
-		amqp.Publishing{
-			Headers:         amqp.Table{},
-			ContentType:     "text/plain",
-			ContentEncoding: "",
-			Body:            []byte(body),
-			DeliveryMode:    amqp.Transient, // 1=non-persistent, 2=persistent
-			Priority:        0,              // 0-9
-		},
-	); err != nil {
-		exch.Connection.Close()
-		exch.IsOpen = false
-		return fmt.Errorf("[amqp] Exchange Publish: %s", err)
-	}
-	// Reliable publisher confirms require confirm.select support from the
-	// connection.
-	if exch.Reliable {
-		if cf := confirmOne(exch.Confirms); cf == false {
-			return fmt.Errorf("[amqp] Publish was not confirmed")
+	var replyData interface{}
+
+	if len(results) != 0 {
+		dataAttr, ok := results["data"]
+		if ok {
+			replyData = dataAttr.Value()
 		}
 	}
+	if replyData != nil {
+		// the reply may also set the properties it is published with
+		props, err := kxcommon.AMQPPropertiesFromSettings(func(name string) interface{} {
+			if attr, ok := results[name]; ok && attr != nil {
+				return attr.Value()
+			}
+			return nil
+		})
+		if err != nil {
+			log.Errorf("[amqp] Invalid reply properties. Error: %s", err)
+			return err
+		}
+		dataJson, err := json.Marshal(replyData)
+		if err != nil {
+			log.Errorf("[amqp] Reply could not be serialized. Error: %s", err)
+			return err
+		}
+		return t.publishMessage(d, kxcommon.AMQPMessage{Body: string(dataJson), CorrelationID: d.CorrelationId, Properties: &props})
+	}
 	return nil
 }
 
-// PrepareReceiveFunc Prepares exchange/queue to receive messages
-func (exch *AMQPExchange) PrepareReceiveFunc(f func(msgs <-chan amqp.Delivery)) error {
-	msgs, err := exch.Channel.Consume(
-		exch.QueueName, // queue
-		"",             // consumer
-		true,           // auto ack
-		false,          // exclusive
-		false,          // no local
-		false,          // no wait
-		nil,            // args
-	)
-	if err != nil {
-		exch.Connection.Close()
-		exch.Queue = nil
-		exch.Channel = nil
-		exch.Connection = nil
-		exch.IsOpen = false
-		return fmt.Errorf("[amqp] Exchange PrepareReceiveFunc: %s", err)
-	}
-	//go receiverTask(exch, msgs)
-	go f(msgs)
-	return nil
-}
-
-// ReadMessages reads the messajes accumulated in the queue
-func (exch *AMQPExchange) ReadMessages() ([]string, error) {
-	msgsLock.Lock()
-	msgsRead := make([]string, len(exch.Messages))
-	copy(msgsRead, exch.Messages)
-	exch.Messages = nil // clear queue
-	msgsLock.Unlock()
-	return msgsRead, nil
-}
-
-func confirmOne(confirms <-chan amqp.Confirmation) bool {
-	confirmed := <-confirms
-	return confirmed.Ack
-}
+// publishMessage publishes the reply of a flow. Requests with a Reply To address are answered there (through the
+// default exchange), with their Correlation ID echoed. Other replies go to the response exchange. Replies published
+// while the broker is down are kept and published once it is back
+func (t *AmqpTrigger) publishMessage(d amqp.Delivery, msg kxcommon.AMQPMessage) error {
+
+	log.Debug("[amqp] Replying message: ", msg.Body)
+	if d.ReplyTo != "" {
+		// the response connection is used when there is one, so replies do not slow down the consumer
+		publisher, err := kxcommon.GetPooledAMQPPublisher(t.replyConfig)
+		if err == nil {
+			msg.RoutingKey = d.ReplyTo
+			err = publisher.Publish(msg)
+		}
+		if err != nil {
+			log.Errorf("[amqp] Error occurred while trying to reply to '%s'. Error: %s", d.ReplyTo, err)
+			return err
+		}
+		return nil
+	}
+	if t.resPublisher == nil {
+		log.Warn("[amqp] Reply dropped, no response exchange configured")
+		return nil
+	}
 
-func receiverTask(exch *AMQPExchange, msgs <-chan amqp.Delivery) {
-	for d := range msgs {
-		msgsLock.Lock()
-		strm := fmt.Sprintf("%s", d.Body)
-		exch.Messages = append(exch.Messages, strm)
-		msgsLock.Unlock()
+	msg.RoutingKey = t.resRoutingKey
+	if err := t.resPublisher.Publish(msg); err != nil {
+		log.Errorf("[amqp] Error occurred while trying to publish to the response exchange. Error: %s", err)
+		return err
 	}
+	return nil
 }
@@ -84,6 +84,31 @@ func TestInit(t *testing.T) {
 	//tgr.Init(runner)
 }
 
+func TestRoutingKeyMatch(t *testing.T) {
+
+	cases := []struct {
+		exchangeType string
+		binding      string
+		routingKey   string
+		match        bool
+	}{
+		{"topic", "#", "plant.area1.tag", true},
+		{"topic", "plant.*", "plant.area1", true},
+		{"topic", "plant.*", "plant.area1.tag", false},
+		{"topic", "plant.#", "plant", true},
+		{"topic", "plant.#.tag", "plant.area1.unit2.tag", true},
+		{"topic", "*.area1.#", "plant.area2.tag", false},
+		{"direct", "plant.*", "plant.area1", false},
+		{"direct", "plant.area1", "plant.area1", true},
+		{"fanout", "plant", "other", true},
+	}
+	for _, c := range cases {
+		if match := routingKeyMatch(c.exchangeType, c.binding, c.routingKey); match != c.match {
+			t.Errorf("%s binding '%s', routing key '%s': expected %t, got %t", c.exchangeType, c.binding, c.routingKey, c.match, match)
+		}
+	}
+}
+
 /*
 // TODO Fix this test
 func TestEndpoint(t *testing.T) {
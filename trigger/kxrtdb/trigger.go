@@ -0,0 +1,289 @@
+package kxrtdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/TIBCOSoftware/flogo-lib/core/data"
+	"github.com/TIBCOSoftware/flogo-lib/core/trigger"
+	"github.com/TIBCOSoftware/flogo-lib/logger"
+	"github.com/go-redis/redis"
+	"github.com/mtorre-iot/flogo-contrib/activity/kxcommon"
+)
+
+// log is the default package logger
+var log = logger.GetLogger("trigger-knox-kxrtdb")
+
+const (
+	stRTDBFile            = "RTDBFile"
+	stMode                = "mode"
+	stChannel             = "channel"
+	stEnableNotifications = "enableNotifications"
+	hsTagFilter           = "tagFilter"
+	hsQualities           = "qualities"
+	hsDeadband            = "deadband"
+	ovMessage             = "message"
+	ovTag                 = "tag"
+	ovValue               = "value"
+	ovValueType           = "valueType"
+	ovUnits               = "units"
+	ovQuality             = "quality"
+
+	modeKeyspace = "keyspace"
+	modeChannel  = "channel"
+)
+
+// KXRTDBTrigger fires flows when tags written into the RealTime DB change
+type KXRTDBTrigger struct {
+	metadata *trigger.Metadata
+	config   *trigger.Config
+	handlers []*tagHandler
+	rtdbFile string
+	mode     string
+	rtdb     *kxcommon.RTDB
+	pubsub   *redis.PubSub
+}
+
+// tagHandler is a flow handler together with its tag filter and deadband state
+type tagHandler struct {
+	handler    *trigger.Handler
+	tagFilter  string
+	qualities  map[kxcommon.Quality]bool
+	deadband   float64
+	lastValues map[string]kxcommon.RtVal
+	lock       sync.Mutex
+}
+
+//NewFactory create a new Trigger factory
+func NewFactory(md *trigger.Metadata) trigger.Factory {
+	return &KXRTDBFactory{metadata: md}
+}
+
+// KXRTDBFactory KNOX RTDB Trigger factory
+type KXRTDBFactory struct {
+	metadata *trigger.Metadata
+}
+
+//New Creates a new trigger instance for a given id
+func (t *KXRTDBFactory) New(config *trigger.Config) trigger.Trigger {
+	return &KXRTDBTrigger{metadata: t.metadata, config: config}
+}
+
+// Metadata implements trigger.Trigger.Metadata
+func (t *KXRTDBTrigger) Metadata() *trigger.Metadata {
+	return t.metadata
+}
+
+// Initialize implements trigger.Initializable.Initialize
+func (t *KXRTDBTrigger) Initialize(ctx trigger.InitContext) error {
+	if t.config.Settings == nil {
+		return fmt.Errorf("[kxrtdb] No Settings found for trigger '%s'", t.config.Id)
+	}
+	t.rtdbFile = t.config.GetSetting(stRTDBFile)
+	if t.rtdbFile == "" {
+		return errors.New("[kxrtdb] Setting 'RTDBFile' not found")
+	}
+	t.mode = strings.ToLower(t.config.GetSetting(stMode))
+	if t.mode == "" {
+		t.mode = modeKeyspace
+	}
+	if t.mode != modeKeyspace && t.mode != modeChannel {
+		return fmt.Errorf("[kxrtdb] Unknown mode '%s'. Expected '%s' or '%s'", t.mode, modeKeyspace, modeChannel)
+	}
+	if t.mode == modeChannel && t.config.GetSetting(stChannel) == "" {
+		return errors.New("[kxrtdb] Setting 'channel' is required in channel mode")
+	}
+
+	for _, handler := range ctx.GetHandlers() {
+		th, err := newTagHandler(handler)
+		if err != nil {
+			return err
+		}
+		t.handlers = append(t.handlers, th)
+	}
+	return nil
+}
+
+func newTagHandler(handler *trigger.Handler) (*tagHandler, error) {
+	th := &tagHandler{handler: handler, lastValues: make(map[string]kxcommon.RtVal)}
+
+	th.tagFilter = handler.GetStringSetting(hsTagFilter)
+	if th.tagFilter == "" {
+		th.tagFilter = "*"
+	}
+	if _, err := path.Match(th.tagFilter, ""); err != nil {
+		return nil, fmt.Errorf("[kxrtdb] Tag filter '%s' is invalid: %s", th.tagFilter, err)
+	}
+
+	if qualities := handler.GetStringSetting(hsQualities); qualities != "" {
+		th.qualities = make(map[kxcommon.Quality]bool)
+		for _, qualityStr := range strings.Split(qualities, ",") {
+			quality, err := kxcommon.GetQualityFromString(strings.ToUpper(strings.TrimSpace(qualityStr)))
+			if err != nil {
+				return nil, fmt.Errorf("[kxrtdb] Quality filter '%s' is invalid: %s", qualities, err)
+			}
+			th.qualities[quality] = true
+		}
+	}
+
+	if deadbandStr := handler.GetStringSetting(hsDeadband); deadbandStr != "" {
+		deadband, err := strconv.ParseFloat(deadbandStr, 64)
+		if err != nil || deadband < 0 {
+			return nil, fmt.Errorf("[kxrtdb] Deadband '%s' is invalid", deadbandStr)
+		}
+		th.deadband = deadband
+	}
+	return th, nil
+}
+
+// Start implements trigger.Trigger.Start
+func (t *KXRTDBTrigger) Start() error {
+	rtdb, err := kxcommon.GetPooledRTDB(t.rtdbFile)
+	if err != nil {
+		log.Errorf("[kxrtdb] Realtime Database could not be opened. Error %s", err)
+		return err
+	}
+	t.rtdb = rtdb
+
+	enableNotifications, _ := data.CoerceToBoolean(t.config.GetSetting(stEnableNotifications))
+	if enableNotifications {
+		if err := t.rtdb.EnableKeyspaceNotifications(); err != nil {
+			log.Errorf("[kxrtdb] Keyspace notifications could not be enabled. Error %s", err)
+			return err
+		}
+	}
+
+	var patterns []string
+	if t.mode == modeKeyspace {
+		// one subscription per distinct tag filter; handlers are matched again on delivery
+		seen := make(map[string]bool)
+		for _, th := range t.handlers {
+			if !seen[th.tagFilter] {
+				seen[th.tagFilter] = true
+				patterns = append(patterns, t.rtdb.KeyspaceChannel(th.tagFilter))
+			}
+		}
+	} else {
+		patterns = []string{t.config.GetSetting(stChannel)}
+	}
+	if len(patterns) == 0 {
+		log.Warn("[kxrtdb] No handlers configured. Nothing to subscribe to")
+		return nil
+	}
+
+	t.pubsub, err = t.rtdb.PSubscribe(patterns...)
+	if err != nil {
+		log.Errorf("[kxrtdb] Unable to subscribe to %v. Error %s", patterns, err)
+		return err
+	}
+	log.Debugf("[kxrtdb] Subscribed to %v", patterns)
+
+	go t.receiverHandler(t.pubsub.Channel())
+	return nil
+}
+
+// Stop implements trigger.Trigger.Stop
+func (t *KXRTDBTrigger) Stop() error {
+	if t.pubsub != nil {
+		return t.pubsub.Close()
+	}
+	return nil
+}
+
+func (t *KXRTDBTrigger) receiverHandler(msgs <-chan *redis.Message) {
+	for msg := range msgs {
+		var rtpObject kxcommon.KXRTPObject
+		var message string
+		var err error
+
+		if t.mode == modeKeyspace {
+			// keyspace events only carry the command name; the object is read back from the hash
+			if msg.Payload != "hset" {
+				continue
+			}
+			key := t.rtdb.KeyFromKeyspaceChannel(msg.Channel)
+			message, err = t.rtdb.GetValueFromKey(key)
+			if err != nil {
+				log.Warnf("[kxrtdb] Tag: %s could not be accessed from Realtime Database. Error %s", key, err)
+				continue
+			}
+		} else {
+			message = msg.Payload
+		}
+
+		rtpObject, err = kxcommon.DecodeUpdateMessage(message)
+		if err != nil {
+			log.Warnf("[kxrtdb] Incoming message could not be deserialized. Message: %s Error: %s", message, err)
+			continue
+		}
+		log.Debugf("[kxrtdb] Update received for %s", rtpObject.Tag)
+
+		for _, th := range t.handlers {
+			// overlapping keyspace patterns deliver once per pattern; only its own subscription counts
+			if t.mode == modeKeyspace && msg.Pattern != t.rtdb.KeyspaceChannel(th.tagFilter) {
+				continue
+			}
+			if th.accept(rtpObject) {
+				t.RunHandler(th.handler, message, rtpObject)
+			}
+		}
+	}
+}
+
+// accept checks an update against the handler tag filter, quality filter and deadband
+func (th *tagHandler) accept(rtpObject kxcommon.KXRTPObject) bool {
+	if matched, _ := path.Match(th.tagFilter, rtpObject.Tag); !matched {
+		return false
+	}
+	if rtpObject.Cv == nil {
+		return false
+	}
+	if th.qualities != nil && !th.qualities[rtpObject.Cv.Quality] {
+		return false
+	}
+
+	th.lock.Lock()
+	defer th.lock.Unlock()
+
+	last, found := th.lastValues[rtpObject.Tag]
+	if found && last.Quality == rtpObject.Cv.Quality && !th.moved(last.TypedValue(), rtpObject.Cv.TypedValue()) {
+		return false
+	}
+	th.lastValues[rtpObject.Tag] = *rtpObject.Cv
+	return true
+}
+
+// moved checks if a value passes the deadband. Only floats and integers have a deadband, other values pass when they change
+func (th *tagHandler) moved(last kxcommon.TypedValue, value kxcommon.TypedValue) bool {
+	if last.Type != value.Type {
+		return true
+	}
+	switch value.Type {
+	case kxcommon.ValueTypeFloat, kxcommon.ValueTypeInt:
+		return math.Abs(value.Float64()-last.Float64()) >= th.deadband
+	}
+	return !value.Equal(last)
+}
+
+// RunHandler runs the handler and associated action
+func (t *KXRTDBTrigger) RunHandler(handler *trigger.Handler, message string, rtpObject kxcommon.KXRTPObject) {
+	trgData := make(map[string]interface{})
+	trgData[ovMessage] = message
+	trgData[ovTag] = rtpObject.Tag
+	value := rtpObject.Cv.TypedValue()
+	trgData[ovValue] = value.Interface()
+	trgData[ovValueType] = value.Type.String()
+	trgData[ovUnits] = value.Units
+	trgData[ovQuality] = rtpObject.Cv.Quality.String()
+
+	_, err := handler.Handle(context.Background(), trgData)
+	if err != nil {
+		log.Error("[kxrtdb] Error starting action: ", err.Error())
+	}
+}
@@ -0,0 +1,176 @@
+package kxrtdb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/TIBCOSoftware/flogo-lib/core/trigger"
+	"github.com/mtorre-iot/flogo-contrib/activity/kxcommon"
+	"github.com/stretchr/testify/assert"
+)
+
+var jsonTestMetadata = getTestJsonMetadata()
+
+func getTestJsonMetadata() string {
+	jsonMetadataBytes, err := ioutil.ReadFile("trigger.json")
+	if err != nil {
+		panic("No Json Metadata found for trigger.json path")
+	}
+	return string(jsonMetadataBytes)
+}
+
+const testConfig string = `{
+  "name": "knox-kxrtdb",
+  "settings": {
+    "RTDBFile": "localhost:6379::",
+    "mode": "keyspace",
+    "enableNotifications": "true"
+  },
+  "handlers": [
+    {
+      "actionId": "tag_update",
+      "settings": {
+        "tagFilter": "IED1.*",
+        "qualities": "OK,BAD",
+        "deadband": "0.5"
+      }
+    }
+  ]
+}`
+
+func TestInit(t *testing.T) {
+
+	// New  factory
+	md := trigger.NewMetadata(jsonTestMetadata)
+	f := NewFactory(md)
+
+	// New Trigger
+	config := trigger.Config{}
+	json.Unmarshal([]byte(testConfig), &config)
+	tgr := f.New(&config)
+
+	if tgr == nil {
+		t.Error("Trigger Not Created")
+	}
+}
+
+func rtpObject(tag string, value kxcommon.TypedValue, quality kxcommon.Quality) kxcommon.KXRTPObject {
+	cv := &kxcommon.RtVal{Quality: quality}
+	cv.SetTypedValue(value)
+	return kxcommon.KXRTPObject{Tag: tag, Cv: cv}
+}
+
+func TestAcceptFilters(t *testing.T) {
+
+	th := &tagHandler{
+		tagFilter:  "IED1.*",
+		qualities:  map[kxcommon.Quality]bool{kxcommon.QualityOk: true, kxcommon.QualityBad: true},
+		lastValues: make(map[string]kxcommon.RtVal),
+	}
+
+	tests := []struct {
+		name     string
+		update   kxcommon.KXRTPObject
+		expected bool
+	}{
+		{"matching tag", rtpObject("IED1.AI1", kxcommon.FloatValue(1), kxcommon.QualityOk), true},
+		{"other tag", rtpObject("IED2.AI1", kxcommon.FloatValue(1), kxcommon.QualityOk), false},
+		{"filtered quality", rtpObject("IED1.AI2", kxcommon.FloatValue(1), kxcommon.QualityOld), false},
+		{"accepted quality", rtpObject("IED1.AI3", kxcommon.FloatValue(1), kxcommon.QualityBad), true},
+		{"no current value", kxcommon.KXRTPObject{Tag: "IED1.AI4"}, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, th.accept(test.update), test.name)
+	}
+}
+
+func TestAcceptDeadband(t *testing.T) {
+
+	th := &tagHandler{tagFilter: "*", deadband: 0.5, lastValues: make(map[string]kxcommon.RtVal)}
+
+	tests := []struct {
+		name     string
+		update   kxcommon.KXRTPObject
+		expected bool
+	}{
+		{"first update", rtpObject("AI1", kxcommon.FloatValue(10), kxcommon.QualityOk), true},
+		{"within deadband", rtpObject("AI1", kxcommon.FloatValue(10.3), kxcommon.QualityOk), false},
+		// rejected updates do not move the reference value
+		{"still within deadband", rtpObject("AI1", kxcommon.FloatValue(10.4), kxcommon.QualityOk), false},
+		{"on the deadband", rtpObject("AI1", kxcommon.FloatValue(10.5), kxcommon.QualityOk), true},
+		{"quality change", rtpObject("AI1", kxcommon.FloatValue(10.5), kxcommon.QualityBad), true},
+		{"other tag", rtpObject("AI2", kxcommon.FloatValue(10.5), kxcommon.QualityOk), true},
+		{"same text", rtpObject("DI1", kxcommon.StringValue("OPEN"), kxcommon.QualityOk), true},
+		{"text unchanged", rtpObject("DI1", kxcommon.StringValue("OPEN"), kxcommon.QualityOk), false},
+		{"text changed", rtpObject("DI1", kxcommon.StringValue("CLOSED"), kxcommon.QualityOk), true},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, th.accept(test.update), test.name)
+	}
+}
+
+func TestMoved(t *testing.T) {
+
+	th := &tagHandler{deadband: 2}
+
+	tests := []struct {
+		name     string
+		last     kxcommon.TypedValue
+		value    kxcommon.TypedValue
+		expected bool
+	}{
+		{"float within", kxcommon.FloatValue(10), kxcommon.FloatValue(11.5), false},
+		{"float out", kxcommon.FloatValue(10), kxcommon.FloatValue(7.9), true},
+		{"int within", kxcommon.IntValue(10), kxcommon.IntValue(11), false},
+		{"int on the deadband", kxcommon.IntValue(10), kxcommon.IntValue(12), true},
+		{"bool unchanged", kxcommon.BoolValue(true), kxcommon.BoolValue(true), false},
+		{"bool changed", kxcommon.BoolValue(true), kxcommon.BoolValue(false), true},
+		{"type changed", kxcommon.FloatValue(10), kxcommon.IntValue(10), true},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, th.moved(test.last, test.value), test.name)
+	}
+
+	// without deadband every update passes, repeated values too
+	th = &tagHandler{}
+	assert.True(t, th.moved(kxcommon.FloatValue(10), kxcommon.FloatValue(10)))
+	assert.True(t, th.moved(kxcommon.FloatValue(10), kxcommon.FloatValue(10.001)))
+}
+
+func TestNewTagHandlerSettings(t *testing.T) {
+
+	newHandler := func(settings map[string]interface{}) *trigger.Handler {
+		return trigger.NewHandler(&trigger.HandlerConfig{Settings: settings}, nil, nil, nil, nil)
+	}
+
+	th, err := newTagHandler(newHandler(map[string]interface{}{}))
+	assert.Nil(t, err)
+	assert.Equal(t, "*", th.tagFilter)
+	assert.Nil(t, th.qualities)
+	assert.Equal(t, float64(0), th.deadband)
+
+	th, err = newTagHandler(newHandler(map[string]interface{}{hsTagFilter: "IED1.*", hsQualities: "ok, bad", hsDeadband: "0.5"}))
+	assert.Nil(t, err)
+	assert.Equal(t, "IED1.*", th.tagFilter)
+	assert.Equal(t, map[kxcommon.Quality]bool{kxcommon.QualityOk: true, kxcommon.QualityBad: true}, th.qualities)
+	assert.Equal(t, 0.5, th.deadband)
+
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+	}{
+		{"bad tag filter", map[string]interface{}{hsTagFilter: "IED1.[AI"}},
+		{"unknown quality", map[string]interface{}{hsQualities: "OK,GOOD"}},
+		{"bad deadband", map[string]interface{}{hsDeadband: "half"}},
+		{"negative deadband", map[string]interface{}{hsDeadband: "-1"}},
+	}
+
+	for _, test := range tests {
+		_, err := newTagHandler(newHandler(test.settings))
+		assert.NotNil(t, err, test.name)
+	}
+}